@@ -0,0 +1,193 @@
+package clone
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/Microsoft/hcsshim/internal/log"
+	"github.com/Microsoft/hcsshim/internal/logfields"
+	"github.com/Microsoft/hcsshim/internal/regstate"
+)
+
+// cloneAnnotationsStoreID is the regstate root under which per-clone
+// annotations are stored, one child key per clone ID. It's a separate root
+// from templateStoreID: annotations (team, workload, tier, etc., for
+// accounting) describe a clone, not the template config it was created from,
+// and outlive whatever RecordCloneCreated/RecordCloneRemoved lineage
+// tracking a template holds for that clone.
+const cloneAnnotationsStoreID = "clone-annotations"
+
+// cloneAnnotationsValue is the name of the registry value holding a clone's
+// annotations under its key.
+const cloneAnnotationsValue = "annotations"
+
+func openCloneAnnotationsKey() (*regstate.Key, error) {
+	return regstate.Open(cloneAnnotationsStoreID, false)
+}
+
+// CloneAnnotationStore persists a clone's annotations keyed by clone ID. The
+// package defaults to a registry-backed store; NewInMemoryCloneAnnotationStore
+// provides an implementation for tests and hosts with no Windows registry to
+// persist to. It mirrors TemplateStore's shape for the same reasons.
+type CloneAnnotationStore interface {
+	// Load returns the annotations stored under `cloneID`. If none exists it
+	// returns an error matching regstate.IsNotFoundError.
+	Load(ctx context.Context, cloneID string) (map[string]string, error)
+	// Store persists `annotations` under `cloneID`, replacing whatever was
+	// stored there before.
+	Store(ctx context.Context, cloneID string, annotations map[string]string) error
+	// Remove deletes the annotations stored under `cloneID`. If none exists
+	// it returns an error matching regstate.IsNotFoundError.
+	Remove(ctx context.Context, cloneID string) error
+}
+
+// cloneAnnotationStore is the CloneAnnotationStore every package-level
+// SetCloneAnnotations/CloneAnnotations/RemoveCloneAnnotations call persists
+// through. It defaults to the registry, but tests can redirect it with
+// SetCloneAnnotationStore to avoid touching the real Windows registry.
+var cloneAnnotationStore CloneAnnotationStore = &registryCloneAnnotationStore{}
+
+// SetCloneAnnotationStore replaces the store this package's clone-annotation
+// functions persist through and returns the previous one, so callers
+// (typically tests) can restore it afterwards.
+func SetCloneAnnotationStore(s CloneAnnotationStore) CloneAnnotationStore {
+	old := cloneAnnotationStore
+	cloneAnnotationStore = s
+	return old
+}
+
+// SetCloneAnnotations replaces the annotations recorded for `cloneID` with
+// `annotations`, creating the entry if this is the first call for `cloneID`.
+// Annotations are independent of any template config: they're keyed by
+// clone ID, not template ID, and are unaffected by RecordCloneCreated/
+// RecordCloneRemoved's own lineage tracking on the template side.
+func SetCloneAnnotations(ctx context.Context, cloneID string, annotations map[string]string) error {
+	if err := cloneAnnotationStore.Store(ctx, cloneID, annotations); err != nil {
+		return fmt.Errorf("failed to store clone annotations for '%s': %w", cloneID, err)
+	}
+	return nil
+}
+
+// CloneAnnotations returns the annotations previously recorded for `cloneID`
+// via SetCloneAnnotations. If none were ever recorded it returns an error
+// matching regstate.IsNotFoundError.
+func CloneAnnotations(ctx context.Context, cloneID string) (map[string]string, error) {
+	annotations, err := cloneAnnotationStore.Load(ctx, cloneID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load clone annotations for '%s': %w", cloneID, err)
+	}
+	return annotations, nil
+}
+
+// RemoveCloneAnnotations deletes the annotations recorded for `cloneID`, e.g.
+// once its clone is torn down. It's a no-op, not an error, if none were ever
+// recorded for `cloneID`, since a clone that was never annotated has nothing
+// left to clean up here.
+func RemoveCloneAnnotations(ctx context.Context, cloneID string) error {
+	if err := cloneAnnotationStore.Remove(ctx, cloneID); err != nil {
+		if regstate.IsNotFoundError(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to remove clone annotations for '%s': %w", cloneID, err)
+	}
+	return nil
+}
+
+// registryCloneAnnotationStore is the default CloneAnnotationStore, backed by
+// the Windows registry via internal/regstate.
+type registryCloneAnnotationStore struct {
+	idLocks keyedMutex
+}
+
+func (s *registryCloneAnnotationStore) Load(ctx context.Context, cloneID string) (map[string]string, error) {
+	s.idLocks.Lock(cloneID)
+	defer s.idLocks.Unlock(cloneID)
+
+	log.G(ctx).WithField(logfields.UVMID, cloneID).Debug("getting clone annotations registry value")
+	k, err := openCloneAnnotationsKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open clone annotation store: %w", err)
+	}
+	defer k.Close()
+
+	var annotations map[string]string
+	if err := k.Get(cloneID, cloneAnnotationsValue, &annotations); err != nil {
+		return nil, err
+	}
+	return annotations, nil
+}
+
+func (s *registryCloneAnnotationStore) Store(ctx context.Context, cloneID string, annotations map[string]string) error {
+	s.idLocks.Lock(cloneID)
+	defer s.idLocks.Unlock(cloneID)
+
+	l := log.G(ctx).WithField(logfields.UVMID, cloneID)
+	k, err := openCloneAnnotationsKey()
+	if err != nil {
+		return fmt.Errorf("failed to open clone annotation store: %w", err)
+	}
+	defer k.Close()
+
+	if err := k.Create(cloneID, cloneAnnotationsValue, annotations); err != nil {
+		l.Debug("clone annotations already exist, overwriting")
+		return k.Set(cloneID, cloneAnnotationsValue, annotations)
+	}
+	return nil
+}
+
+func (s *registryCloneAnnotationStore) Remove(ctx context.Context, cloneID string) error {
+	s.idLocks.Lock(cloneID)
+	defer s.idLocks.Unlock(cloneID)
+
+	log.G(ctx).WithField(logfields.UVMID, cloneID).Debug("removing clone annotations registry value")
+	k, err := openCloneAnnotationsKey()
+	if err != nil {
+		return fmt.Errorf("failed to open clone annotation store: %w", err)
+	}
+	defer k.Close()
+	return k.Remove(cloneID)
+}
+
+// inMemoryCloneAnnotationStore is a CloneAnnotationStore backed by a plain
+// map, for tests and hosts with no Windows registry to persist to. Its
+// Load/Remove not-found errors match regstate.IsNotFoundError so callers
+// don't need to know which store they're talking to.
+type inMemoryCloneAnnotationStore struct {
+	mu   sync.Mutex
+	byID map[string]map[string]string
+}
+
+// NewInMemoryCloneAnnotationStore returns a CloneAnnotationStore that keeps
+// every clone's annotations in memory rather than persisting them, for use
+// with SetCloneAnnotationStore in tests.
+func NewInMemoryCloneAnnotationStore() CloneAnnotationStore {
+	return &inMemoryCloneAnnotationStore{byID: make(map[string]map[string]string)}
+}
+
+func (s *inMemoryCloneAnnotationStore) Load(ctx context.Context, cloneID string) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	annotations, ok := s.byID[cloneID]
+	if !ok {
+		return nil, &regstate.NotFoundError{Id: cloneID}
+	}
+	return annotations, nil
+}
+
+func (s *inMemoryCloneAnnotationStore) Store(ctx context.Context, cloneID string, annotations map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.byID[cloneID] = annotations
+	return nil
+}
+
+func (s *inMemoryCloneAnnotationStore) Remove(ctx context.Context, cloneID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.byID[cloneID]; !ok {
+		return &regstate.NotFoundError{Id: cloneID}
+	}
+	delete(s.byID, cloneID)
+	return nil
+}
@@ -0,0 +1,90 @@
+package clone
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/Microsoft/hcsshim/internal/regstate"
+)
+
+func prepCloneAnnotationsTest(t *testing.T) {
+	err := regstate.RemoveAll(cloneAnnotationsStoreID, false)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+}
+
+func TestCloneAnnotations_SetAndGet(t *testing.T) {
+	prepCloneAnnotationsTest(t)
+	ctx := context.Background()
+	id := "clone-annotations-1"
+
+	want := map[string]string{"team": "compute", "tier": "prod"}
+	if err := SetCloneAnnotations(ctx, id, want); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := CloneAnnotations(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) || got["team"] != "compute" || got["tier"] != "prod" {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestCloneAnnotations_SecondSetReplacesFirst(t *testing.T) {
+	prepCloneAnnotationsTest(t)
+	ctx := context.Background()
+	id := "clone-annotations-2"
+
+	if err := SetCloneAnnotations(ctx, id, map[string]string{"team": "compute"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetCloneAnnotations(ctx, id, map[string]string{"team": "storage"}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := CloneAnnotations(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got["team"] != "storage" {
+		t.Fatalf("got team %q, want %q", got["team"], "storage")
+	}
+}
+
+func TestCloneAnnotations_NotFoundForUnknownClone(t *testing.T) {
+	prepCloneAnnotationsTest(t)
+	ctx := context.Background()
+
+	if _, err := CloneAnnotations(ctx, "clone-never-annotated"); !regstate.IsNotFoundError(err) {
+		t.Fatalf("got %v, want a not-found error", err)
+	}
+}
+
+func TestRemoveCloneAnnotations_DeletesEntry(t *testing.T) {
+	prepCloneAnnotationsTest(t)
+	ctx := context.Background()
+	id := "clone-annotations-3"
+
+	if err := SetCloneAnnotations(ctx, id, map[string]string{"team": "compute"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := RemoveCloneAnnotations(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CloneAnnotations(ctx, id); !regstate.IsNotFoundError(err) {
+		t.Fatalf("got %v, want a not-found error after removal", err)
+	}
+}
+
+func TestRemoveCloneAnnotations_NoEntryIsNotAnError(t *testing.T) {
+	prepCloneAnnotationsTest(t)
+	ctx := context.Background()
+
+	if err := RemoveCloneAnnotations(ctx, "clone-never-annotated"); err != nil {
+		t.Fatalf("expected no error removing annotations that were never set, got %v", err)
+	}
+}
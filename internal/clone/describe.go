@@ -0,0 +1,101 @@
+package clone
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Microsoft/hcsshim/internal/regstate"
+)
+
+// TemplateDescription is DescribeTemplate's stable, JSON-friendly summary of
+// a saved template, for a debug tool to print without decoding the
+// UVMTemplateConfig itself.
+type TemplateDescription struct {
+	ID            string
+	CreatedAt     time.Time
+	SourceHost    string
+	Annotations   map[string]string
+	Provisional   bool
+	CloneRefCount int
+	// Resources describes RawData's contents, one entry per resource,
+	// populated only if a describer was registered with
+	// SetRawDataDescriber. Nil if RawData hasn't been decoded, either
+	// because no describer is registered or because the template is still
+	// Provisional and has no RawData yet.
+	Resources []ResourceDescription
+}
+
+// ResourceDescription is one entry in TemplateDescription.Resources,
+// describing a single resource captured in RawData in a schema-agnostic
+// way, since this package treats RawData as an opaque blob (see the package
+// doc comment).
+type ResourceDescription struct {
+	// Type is the resource's type label (e.g. "scsi-mount", "vsmb-share"),
+	// as assigned by whatever encoded RawData - see resourceTypeLabel in
+	// package uvm for hcsshim's own encoding.
+	Type string
+	// Fields holds the resource's key data (e.g. HostPath). Naming and
+	// shape are entirely up to whatever's registered with
+	// SetRawDataDescriber.
+	Fields map[string]interface{}
+}
+
+// rawDataDescriber decodes `data` into a stable, JSON-friendly resource
+// summary for DescribeTemplate. Nil by default: this package treats RawData
+// as an opaque blob (see the package doc comment), so a caller that knows
+// the blob's actual schema (i.e. the uvm package) must register one with
+// SetRawDataDescriber before DescribeTemplate can describe anything beyond a
+// template's registry metadata.
+var rawDataDescriber func(data []byte) ([]ResourceDescription, error)
+
+// SetRawDataDescriber registers the function DescribeTemplate uses to decode
+// RawData into ResourceDescriptions. It returns the previous value so a
+// caller (typically a test) can restore it afterwards.
+func SetRawDataDescriber(fn func(data []byte) ([]ResourceDescription, error)) (old func(data []byte) ([]ResourceDescription, error)) {
+	old = rawDataDescriber
+	rawDataDescriber = fn
+	return old
+}
+
+// DescribeTemplate returns a stable, JSON-friendly description of the
+// template config persisted under `id`, for a debug tool to print without
+// reaching into the decoded config directly. If no config exists for `id` it
+// returns an error matching errors.Is(err, ErrTemplateNotFound).
+//
+// If `id` was reserved with ReserveTemplateConfig but SaveTemplateConfig
+// hasn't completed yet, the returned description's Provisional field is
+// true and Resources is left nil, same as when no describer is registered.
+//
+// Resources is only populated if a describer was registered with
+// SetRawDataDescriber; this package has no RawData decoding code of its own
+// (see the package doc comment), so a caller wanting Resources populated
+// must register one first.
+func DescribeTemplate(ctx context.Context, id string) (*TemplateDescription, error) {
+	pc, err := store.Load(ctx, id)
+	if err != nil {
+		if regstate.IsNotFoundError(err) {
+			return nil, &notFoundError{id: id, err: err}
+		}
+		return nil, fmt.Errorf("failed to load template config for '%s': %w", id, err)
+	}
+
+	desc := &TemplateDescription{
+		ID:            pc.ID,
+		CreatedAt:     pc.CreatedAt,
+		SourceHost:    pc.SourceHost,
+		Annotations:   pc.Annotations,
+		Provisional:   pc.Provisional,
+		CloneRefCount: pc.CloneRefCount,
+	}
+	if pc.Provisional || rawDataDescriber == nil {
+		return desc, nil
+	}
+
+	resources, err := rawDataDescriber(pc.RawData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe template config for '%s': %w", id, err)
+	}
+	desc.Resources = resources
+	return desc, nil
+}
@@ -0,0 +1,105 @@
+package clone
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestDescribeTemplate_WithoutDescriberOmitsResources(t *testing.T) {
+	prepTest(t)
+	ctx := context.Background()
+	id := "template-describe-no-describer"
+
+	if err := SaveTemplateConfigWithAnnotations(ctx, id, []byte("payload"), map[string]string{"owner": "test"}); err != nil {
+		t.Fatal(err)
+	}
+
+	desc, err := DescribeTemplate(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc.ID != id {
+		t.Fatalf("got ID %q, want %q", desc.ID, id)
+	}
+	if desc.Annotations["owner"] != "test" {
+		t.Fatalf("got annotations %v, want owner=test", desc.Annotations)
+	}
+	if desc.Resources != nil {
+		t.Fatalf("expected nil Resources with no describer registered, got %v", desc.Resources)
+	}
+}
+
+func TestDescribeTemplate_SeededTemplateMatchesDescriber(t *testing.T) {
+	prepTest(t)
+	ctx := context.Background()
+	id := "template-describe-seeded"
+
+	old := SetRawDataDescriber(func(data []byte) ([]ResourceDescription, error) {
+		return []ResourceDescription{
+			{Type: "scsi-mount", Fields: map[string]interface{}{"HostPath": string(data)}},
+		}, nil
+	})
+	defer SetRawDataDescriber(old)
+
+	if err := SaveTemplateConfigWithAnnotations(ctx, id, []byte(`C:\template\scratch.vhdx`), map[string]string{"owner": "test"}); err != nil {
+		t.Fatal(err)
+	}
+
+	desc, err := DescribeTemplate(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []ResourceDescription{
+		{Type: "scsi-mount", Fields: map[string]interface{}{"HostPath": `C:\template\scratch.vhdx`}},
+	}
+	if !reflect.DeepEqual(desc.Resources, want) {
+		t.Fatalf("got Resources %+v, want %+v", desc.Resources, want)
+	}
+	if desc.ID != id || desc.Annotations["owner"] != "test" || desc.Provisional {
+		t.Fatalf("got unexpected metadata: %+v", desc)
+	}
+}
+
+func TestDescribeTemplate_ProvisionalSkipsDescriber(t *testing.T) {
+	prepTest(t)
+	ctx := context.Background()
+	id := "template-describe-provisional"
+
+	called := false
+	old := SetRawDataDescriber(func(data []byte) ([]ResourceDescription, error) {
+		called = true
+		return nil, nil
+	})
+	defer SetRawDataDescriber(old)
+
+	if err := ReserveTemplateConfig(ctx, id, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	desc, err := DescribeTemplate(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !desc.Provisional {
+		t.Fatal("expected Provisional to be true")
+	}
+	if desc.Resources != nil {
+		t.Fatalf("expected nil Resources for a provisional template, got %v", desc.Resources)
+	}
+	if called {
+		t.Fatal("expected the describer not to be called for a provisional template")
+	}
+}
+
+func TestDescribeTemplate_NotFound(t *testing.T) {
+	prepTest(t)
+	ctx := context.Background()
+
+	_, err := DescribeTemplate(ctx, "template-does-not-exist")
+	if !errors.Is(err, ErrTemplateNotFound) {
+		t.Fatalf("expected ErrTemplateNotFound, got %v", err)
+	}
+}
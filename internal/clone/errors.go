@@ -0,0 +1,102 @@
+package clone
+
+import "fmt"
+
+// ErrTemplateExists is returned (wrapped) by SaveTemplateConfig when a
+// template config is already persisted under the requested ID.
+var ErrTemplateExists = fmt.Errorf("template config already exists")
+
+// ErrTemplateNotFound is returned (wrapped) by FetchTemplateConfig and
+// RemoveSavedTemplateConfig when no template config is persisted under the
+// requested ID.
+var ErrTemplateNotFound = fmt.Errorf("template config not found")
+
+// ErrTemplateNotReady is returned (wrapped) by FetchTemplateConfig when a
+// config was reserved via ReserveTemplateConfig but SaveTemplateConfig hasn't
+// completed yet, so RawData isn't the finished template.
+var ErrTemplateNotReady = fmt.Errorf("template config not ready")
+
+// ErrTemplateCorrupt is returned (wrapped) by FetchTemplateConfig when a
+// config's RawData doesn't match its stored checksum.
+var ErrTemplateCorrupt = fmt.Errorf("template config is corrupt")
+
+// existsError is returned when a template config is saved under an ID that's
+// already present. It satisfies errors.Is(err, ErrTemplateExists).
+type existsError struct {
+	id string
+}
+
+func (e *existsError) Error() string {
+	return fmt.Sprintf("template config for '%s' already exists", e.id)
+}
+
+func (e *existsError) Is(target error) bool {
+	return target == ErrTemplateExists
+}
+
+// notFoundError wraps the underlying regstate lookup failure while still
+// satisfying errors.Is(err, ErrTemplateNotFound).
+type notFoundError struct {
+	id  string
+	err error
+}
+
+func (e *notFoundError) Error() string {
+	return fmt.Sprintf("template config for '%s' not found: %s", e.id, e.err)
+}
+
+func (e *notFoundError) Is(target error) bool {
+	return target == ErrTemplateNotFound
+}
+
+func (e *notFoundError) Unwrap() error {
+	return e.err
+}
+
+// notReadyError is returned by FetchTemplateConfig for a config that's still
+// provisional. It satisfies errors.Is(err, ErrTemplateNotReady).
+type notReadyError struct {
+	id string
+}
+
+func (e *notReadyError) Error() string {
+	return fmt.Sprintf("template config for '%s' is reserved but not yet saved", e.id)
+}
+
+func (e *notReadyError) Is(target error) bool {
+	return target == ErrTemplateNotReady
+}
+
+// corruptError is returned by FetchTemplateConfig when a config's checksum
+// doesn't match its RawData. It satisfies errors.Is(err, ErrTemplateCorrupt).
+type corruptError struct {
+	id        string
+	want, got uint32
+}
+
+func (e *corruptError) Error() string {
+	return fmt.Sprintf("template config for '%s' is corrupt: checksum %#x does not match stored %#x", e.id, e.got, e.want)
+}
+
+func (e *corruptError) Is(target error) bool {
+	return target == ErrTemplateCorrupt
+}
+
+// ErrTemplateTooLarge is returned (wrapped) by SaveTemplateConfig when a
+// config's RawData exceeds maxTemplateConfigSize.
+var ErrTemplateTooLarge = fmt.Errorf("template config exceeds the maximum size")
+
+// tooLargeError is returned when a config's RawData is too big to persist.
+// It satisfies errors.Is(err, ErrTemplateTooLarge).
+type tooLargeError struct {
+	id          string
+	size, limit int
+}
+
+func (e *tooLargeError) Error() string {
+	return fmt.Sprintf("template config for '%s' is %d bytes, exceeding the %d byte limit", e.id, e.size, e.limit)
+}
+
+func (e *tooLargeError) Is(target error) bool {
+	return target == ErrTemplateTooLarge
+}
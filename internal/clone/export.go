@@ -0,0 +1,118 @@
+package clone
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/Microsoft/hcsshim/internal/regstate"
+)
+
+// templateConfigExportVersion is the version stamped on every blob produced
+// by ExportTemplateConfig. Bump it whenever exportedTemplateConfig's shape
+// changes in a way that isn't back/forwards compatible, and reject anything
+// else in ImportTemplateConfig rather than guessing at its layout.
+const templateConfigExportVersion = 1
+
+// exportedTemplateConfig is the self-describing, portable wire format
+// produced by ExportTemplateConfig and consumed by ImportTemplateConfig. It
+// wraps persistedUVMConfig so a blob exported from one node's registry can be
+// validated and loaded into another's.
+type exportedTemplateConfig struct {
+	Version int
+	Config  persistedUVMConfig
+}
+
+// ExportTemplateConfig serializes the template config persisted under `id`
+// into a self-describing byte slice suitable for handing to
+// ImportTemplateConfig on another node. If no config exists for `id` it
+// returns an error matching errors.Is(err, ErrTemplateNotFound).
+func ExportTemplateConfig(ctx context.Context, id string) ([]byte, error) {
+	pc, err := store.Load(ctx, id)
+	if err != nil {
+		if regstate.IsNotFoundError(err) {
+			return nil, &notFoundError{id: id, err: err}
+		}
+		return nil, fmt.Errorf("failed to load template config for '%s': %w", id, err)
+	}
+
+	blob, err := json.Marshal(&exportedTemplateConfig{Version: templateConfigExportVersion, Config: *pc})
+	if err != nil {
+		return nil, fmt.Errorf("failed to export template config for '%s': %w", id, err)
+	}
+	return blob, nil
+}
+
+// ImportTemplateConfig loads a blob produced by ExportTemplateConfig into
+// this node's registry under `id`. Unless `overwrite` is true it refuses to
+// clobber an existing config for `id`, returning an error matching
+// errors.Is(err, ErrTemplateExists).
+func ImportTemplateConfig(ctx context.Context, id string, blob []byte, overwrite bool) error {
+	var exported exportedTemplateConfig
+	if err := json.Unmarshal(blob, &exported); err != nil {
+		return fmt.Errorf("failed to parse template config blob: %w", err)
+	}
+	if exported.Version != templateConfigExportVersion {
+		return fmt.Errorf("unsupported template config export version %d (this node supports %d)", exported.Version, templateConfigExportVersion)
+	}
+
+	if !overwrite {
+		if _, err := store.Load(ctx, id); err == nil {
+			return &existsError{id: id}
+		} else if !regstate.IsNotFoundError(err) {
+			return fmt.Errorf("failed to check for existing template config for '%s': %w", id, err)
+		}
+	}
+
+	pc := exported.Config
+	pc.ID = id
+	if err := store.Store(ctx, id, &pc, true); err != nil {
+		return fmt.Errorf("failed to import template config for '%s': %w", id, err)
+	}
+	return nil
+}
+
+// ExportRawConfig returns the raw, undecoded bytes persisted under `id` -
+// persistedUVMConfig.RawData exactly as stored, with none of
+// ExportTemplateConfig's version wrapper. It's a lower-level counterpart to
+// ExportTemplateConfig, for backup tooling that wants to copy config bytes
+// to external storage without a decode step that a future RawData format
+// change could break. If no config exists for `id` it returns an error
+// matching errors.Is(err, ErrTemplateNotFound).
+func ExportRawConfig(ctx context.Context, id string) ([]byte, error) {
+	pc, err := store.Load(ctx, id)
+	if err != nil {
+		if regstate.IsNotFoundError(err) {
+			return nil, &notFoundError{id: id, err: err}
+		}
+		return nil, fmt.Errorf("failed to load template config for '%s': %w", id, err)
+	}
+	return pc.RawData, nil
+}
+
+// ImportRawConfig stores `data` under `id` as-is, the write-side counterpart
+// to ExportRawConfig, for backup tooling restoring bytes it copied out
+// previously without decoding them. Unless `overwrite` is true it refuses to
+// clobber an existing config for `id`, returning an error matching
+// errors.Is(err, ErrTemplateExists).
+func ImportRawConfig(ctx context.Context, id string, data []byte, overwrite bool) error {
+	if !overwrite {
+		if _, err := store.Load(ctx, id); err == nil {
+			return &existsError{id: id}
+		} else if !regstate.IsNotFoundError(err) {
+			return fmt.Errorf("failed to check for existing template config for '%s': %w", id, err)
+		}
+	}
+
+	pc := persistedUVMConfig{
+		ID:             id,
+		RawData:        data,
+		Checksum:       crc32.ChecksumIEEE(data),
+		RawDataVersion: CurrentRawDataVersion,
+	}
+	if err := store.Store(ctx, id, &pc, true); err != nil {
+		return fmt.Errorf("failed to import raw template config for '%s': %w", id, err)
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package clone
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestExportImportRoundTrip(t *testing.T) {
+	prepTest(t)
+	ctx := context.Background()
+	id := "template-export"
+
+	if err := SaveTemplateConfigWithAnnotations(ctx, id, []byte("payload"), map[string]string{"owner": "test"}); err != nil {
+		t.Fatal(err)
+	}
+
+	blob, err := ExportTemplateConfig(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RemoveSavedTemplateConfig(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ImportTemplateConfig(ctx, id, blob, false); err != nil {
+		t.Fatal(err)
+	}
+	got, err := FetchTemplateConfig(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "payload" {
+		t.Fatalf("got %q, want %q", got, "payload")
+	}
+	info, err := GetTemplateInfo(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Annotations["owner"] != "test" {
+		t.Fatalf("got annotations %v, want owner=test", info.Annotations)
+	}
+}
+
+func TestImportTemplateConfig_RefusesToClobber(t *testing.T) {
+	prepTest(t)
+	ctx := context.Background()
+	id := "template-clobber"
+
+	if err := SaveTemplateConfig(ctx, id, []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	blob, err := ExportTemplateConfig(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ImportTemplateConfig(ctx, id, blob, false)
+	if !errors.Is(err, ErrTemplateExists) {
+		t.Fatalf("expected ErrTemplateExists, got %v", err)
+	}
+
+	if err := ImportTemplateConfig(ctx, id, blob, true); err != nil {
+		t.Fatalf("overwrite import failed: %v", err)
+	}
+}
+
+func TestExportImportRawConfigRoundTrip(t *testing.T) {
+	prepTest(t)
+	ctx := context.Background()
+	id := "template-raw-export"
+
+	if err := SaveTemplateConfig(ctx, id, []byte("raw-payload")); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := ExportRawConfig(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(raw) != "raw-payload" {
+		t.Fatalf("got %q, want %q", raw, "raw-payload")
+	}
+	if err := RemoveSavedTemplateConfig(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ImportRawConfig(ctx, id, raw, false); err != nil {
+		t.Fatal(err)
+	}
+	got, err := FetchTemplateConfig(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "raw-payload" {
+		t.Fatalf("got %q, want %q", got, "raw-payload")
+	}
+}
+
+func TestImportRawConfig_RefusesToClobber(t *testing.T) {
+	prepTest(t)
+	ctx := context.Background()
+	id := "template-raw-clobber"
+
+	if err := SaveTemplateConfig(ctx, id, []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+
+	err := ImportRawConfig(ctx, id, []byte("second"), false)
+	if !errors.Is(err, ErrTemplateExists) {
+		t.Fatalf("expected ErrTemplateExists, got %v", err)
+	}
+
+	if err := ImportRawConfig(ctx, id, []byte("second"), true); err != nil {
+		t.Fatalf("overwrite import failed: %v", err)
+	}
+	got, err := FetchTemplateConfig(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "second" {
+		t.Fatalf("got %q, want %q", got, "second")
+	}
+}
+
+func TestExportRawConfig_NotFound(t *testing.T) {
+	prepTest(t)
+	ctx := context.Background()
+
+	_, err := ExportRawConfig(ctx, "template-does-not-exist")
+	if !errors.Is(err, ErrTemplateNotFound) {
+		t.Fatalf("expected ErrTemplateNotFound, got %v", err)
+	}
+}
+
+func TestImportTemplateConfig_VersionMismatch(t *testing.T) {
+	prepTest(t)
+	ctx := context.Background()
+
+	blob := []byte(`{"Version":9999,"Config":{}}`)
+	err := ImportTemplateConfig(ctx, "template-bad-version", blob, false)
+	if err == nil {
+		t.Fatal("expected an error for a mismatched export version")
+	}
+}
@@ -0,0 +1,197 @@
+package clone
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// ErrClonePoolClosed is returned (wrapped) by Acquire once Close has been
+// called on the pool.
+var ErrClonePoolClosed = fmt.Errorf("clone pool is closed")
+
+// Clone is a live object created from a template - typically a
+// *uvm.UtilityVM - that a ClonePool hands out via Acquire and disposes of
+// via Release or Close.
+type Clone interface {
+	Close(ctx context.Context) error
+}
+
+// CloneFactory turns a template's raw, undecoded config (see
+// ExportRawConfig) into a live Clone. This package has no clone-creation
+// code of its own - see the package doc comment on RawData being opaque -
+// so ClonePool needs one supplied by whichever caller does, e.g. package
+// uvm.
+type CloneFactory func(ctx context.Context, templateID string, rawData []byte) (Clone, error)
+
+// ClonePool keeps up to `size` clones of a single template pre-created, so
+// Acquire can hand one out without paying clone-creation latency inline.
+// It builds on FetchTemplateConfig for the template's raw config and a
+// caller-supplied CloneFactory to turn that into a live Clone.
+type ClonePool struct {
+	templateID string
+	size       int
+	factory    CloneFactory
+
+	mu        sync.Mutex
+	available []Clone
+	closed    bool
+}
+
+// NewClonePool returns a ClonePool for templateID that keeps up to `size`
+// clones pre-created via `factory`. It does no I/O itself; call Prewarm to
+// fill the pool before the first Acquire that needs to be instant.
+func NewClonePool(templateID string, size int, factory CloneFactory) *ClonePool {
+	return &ClonePool{
+		templateID: templateID,
+		size:       size,
+		factory:    factory,
+	}
+}
+
+// Prewarm creates clones, via the pool's CloneFactory, until `size` are
+// available. It stops at the first error createOne encounters, leaving
+// whatever it already created available.
+func (p *ClonePool) Prewarm(ctx context.Context) error {
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return &poolClosedError{templateID: p.templateID}
+		}
+		if len(p.available) >= p.size {
+			p.mu.Unlock()
+			return nil
+		}
+		p.mu.Unlock()
+
+		c, err := p.createOne(ctx)
+		if err != nil {
+			return err
+		}
+		p.mu.Lock()
+		p.available = append(p.available, c)
+		p.mu.Unlock()
+	}
+}
+
+// Acquire returns a pre-created clone if one is available, replenishing the
+// pool in the background to bring it back up to `size`; otherwise it
+// creates one inline via the pool's CloneFactory, blocking the caller for
+// the same latency Acquire otherwise avoids.
+func (p *ClonePool) Acquire(ctx context.Context) (Clone, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, &poolClosedError{templateID: p.templateID}
+	}
+	if n := len(p.available); n > 0 {
+		c := p.available[n-1]
+		p.available = p.available[:n-1]
+		p.mu.Unlock()
+		go p.replenish()
+		return c, nil
+	}
+	p.mu.Unlock()
+
+	c, err := p.createOne(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	closed := p.closed
+	p.mu.Unlock()
+	if closed {
+		c.Close(ctx)
+		return nil, &poolClosedError{templateID: p.templateID}
+	}
+	return c, nil
+}
+
+// replenish tops the pool back up to `size` with one freshly created clone.
+// It uses its own background context, since Acquire's caller may cancel its
+// ctx as soon as Acquire returns, well before replenish is done. Errors are
+// dropped: a failed replenish just leaves the pool a clone short until the
+// next successful Acquire or Prewarm call, rather than crashing the
+// goroutine Acquire started.
+func (p *ClonePool) replenish() {
+	p.mu.Lock()
+	closed, short := p.closed, len(p.available) < p.size
+	p.mu.Unlock()
+	if closed || !short {
+		return
+	}
+
+	c, err := p.createOne(context.Background())
+	if err != nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		c.Close(context.Background())
+		return
+	}
+	p.available = append(p.available, c)
+}
+
+// createOne fetches templateID's raw config and turns it into a live Clone
+// via the pool's CloneFactory.
+func (p *ClonePool) createOne(ctx context.Context) (Clone, error) {
+	rawData, err := FetchTemplateConfig(ctx, p.templateID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create pooled clone of '%s': %w", p.templateID, err)
+	}
+	c, err := p.factory(ctx, p.templateID, rawData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create pooled clone of '%s': %w", p.templateID, err)
+	}
+	return c, nil
+}
+
+// Release disposes of a clone previously returned by Acquire. A clone that
+// has already been handed to a caller may have diverged from a fresh one,
+// so it isn't reusable - Release just closes it rather than returning it to
+// the pool.
+func (p *ClonePool) Release(ctx context.Context, c Clone) error {
+	return c.Close(ctx)
+}
+
+// Close marks the pool closed, so any Acquire in flight or afterwards
+// returns an error matching errors.Is(err, ErrClonePoolClosed), and closes
+// every clone still sitting in the pool. It keeps closing the rest even if
+// one fails, then returns a combined error.
+func (p *ClonePool) Close(ctx context.Context) error {
+	p.mu.Lock()
+	p.closed = true
+	drained := p.available
+	p.available = nil
+	p.mu.Unlock()
+
+	var errs []string
+	for _, c := range drained {
+		if err := c.Close(ctx); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to close %d pooled clone(s) of '%s': %s", len(errs), p.templateID, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// poolClosedError is returned once a ClonePool has been Closed. It
+// satisfies errors.Is(err, ErrClonePoolClosed).
+type poolClosedError struct {
+	templateID string
+}
+
+func (e *poolClosedError) Error() string {
+	return fmt.Sprintf("clone pool for '%s' is closed", e.templateID)
+}
+
+func (e *poolClosedError) Is(target error) bool {
+	return target == ErrClonePoolClosed
+}
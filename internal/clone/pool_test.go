@@ -0,0 +1,183 @@
+package clone
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClone is a CloneFactory-produced Clone for pool tests: it records
+// whether it was closed, rather than doing anything a real clone would.
+type fakeClone struct {
+	mu     sync.Mutex
+	closed bool
+}
+
+func (c *fakeClone) Close(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return nil
+}
+
+func (c *fakeClone) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// newCountingFactory returns a CloneFactory that hands back fakeClones and
+// signals `created` once per call, so a test can wait for a background
+// replenish instead of polling or sleeping.
+func newCountingFactory() (CloneFactory, chan *fakeClone) {
+	created := make(chan *fakeClone, 16)
+	factory := func(ctx context.Context, templateID string, rawData []byte) (Clone, error) {
+		c := &fakeClone{}
+		created <- c
+		return c, nil
+	}
+	return factory, created
+}
+
+func waitForCreate(t *testing.T, created chan *fakeClone) *fakeClone {
+	t.Helper()
+	select {
+	case c := <-created:
+		return c
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for the factory to be called")
+		return nil
+	}
+}
+
+func TestClonePool_PrewarmFillsToSize(t *testing.T) {
+	prepTest(t)
+	ctx := context.Background()
+	id := "template-pool-prewarm"
+	if err := SaveTemplateConfig(ctx, id, []byte("payload")); err != nil {
+		t.Fatal(err)
+	}
+
+	factory, created := newCountingFactory()
+	pool := NewClonePool(id, 3, factory)
+	defer pool.Close(ctx)
+
+	if err := pool.Prewarm(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(pool.available) != 3 {
+		t.Fatalf("got %d available, want 3", len(pool.available))
+	}
+	for i := 0; i < 3; i++ {
+		waitForCreate(t, created)
+	}
+}
+
+func TestClonePool_AcquireReplenishesInBackground(t *testing.T) {
+	prepTest(t)
+	ctx := context.Background()
+	id := "template-pool-replenish"
+	if err := SaveTemplateConfig(ctx, id, []byte("payload")); err != nil {
+		t.Fatal(err)
+	}
+
+	factory, created := newCountingFactory()
+	pool := NewClonePool(id, 2, factory)
+	defer pool.Close(ctx)
+
+	if err := pool.Prewarm(ctx); err != nil {
+		t.Fatal(err)
+	}
+	waitForCreate(t, created)
+	waitForCreate(t, created)
+
+	c, err := pool.Acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c == nil {
+		t.Fatal("expected a non-nil clone")
+	}
+
+	// Acquire's replenish runs in the background; wait for the pool's
+	// factory to be called again rather than asserting len(available)
+	// immediately, which would race the goroutine.
+	waitForCreate(t, created)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		pool.mu.Lock()
+		n := len(pool.available)
+		pool.mu.Unlock()
+		if n == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d available after replenish, want 2", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := pool.Release(ctx, c); err != nil {
+		t.Fatal(err)
+	}
+	if !c.(*fakeClone).isClosed() {
+		t.Fatal("expected Release to close the returned clone")
+	}
+}
+
+func TestClonePool_AcquireCreatesInlineWhenEmpty(t *testing.T) {
+	prepTest(t)
+	ctx := context.Background()
+	id := "template-pool-inline"
+	if err := SaveTemplateConfig(ctx, id, []byte("payload")); err != nil {
+		t.Fatal(err)
+	}
+
+	factory, created := newCountingFactory()
+	pool := NewClonePool(id, 1, factory)
+	defer pool.Close(ctx)
+
+	c, err := pool.Acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c == nil {
+		t.Fatal("expected a non-nil clone")
+	}
+	waitForCreate(t, created)
+}
+
+func TestClonePool_CloseDrainsAndClosesAvailableClones(t *testing.T) {
+	prepTest(t)
+	ctx := context.Background()
+	id := "template-pool-close"
+	if err := SaveTemplateConfig(ctx, id, []byte("payload")); err != nil {
+		t.Fatal(err)
+	}
+
+	factory, created := newCountingFactory()
+	pool := NewClonePool(id, 2, factory)
+
+	if err := pool.Prewarm(ctx); err != nil {
+		t.Fatal(err)
+	}
+	first := waitForCreate(t, created)
+	second := waitForCreate(t, created)
+
+	if err := pool.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !first.isClosed() || !second.isClosed() {
+		t.Fatal("expected Close to close every pooled clone")
+	}
+
+	if _, err := pool.Acquire(ctx); !errors.Is(err, ErrClonePoolClosed) {
+		t.Fatalf("expected ErrClonePoolClosed, got %v", err)
+	}
+	if err := pool.Prewarm(ctx); !errors.Is(err, ErrClonePoolClosed) {
+		t.Fatalf("expected ErrClonePoolClosed, got %v", err)
+	}
+}
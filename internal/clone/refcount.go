@@ -0,0 +1,145 @@
+package clone
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/Microsoft/hcsshim/internal/regstate"
+)
+
+// ErrTemplateInUse is returned (wrapped) by RemoveSavedTemplateConfig when
+// the template still has clones referencing it.
+var ErrTemplateInUse = fmt.Errorf("template config still has clones referencing it")
+
+// inUseError is returned by RemoveSavedTemplateConfig for a template with a
+// nonzero clone reference count. It satisfies errors.Is(err,
+// ErrTemplateInUse).
+type inUseError struct {
+	id    string
+	count int
+}
+
+func (e *inUseError) Error() string {
+	return fmt.Sprintf("template config for '%s' still has %d clone(s) referencing it", e.id, e.count)
+}
+
+func (e *inUseError) Is(target error) bool {
+	return target == ErrTemplateInUse
+}
+
+// refCountMu serializes IncrementCloneRef/DecrementCloneRef's read-modify-write
+// of a config's CloneRefCount against each other and against
+// RemoveSavedTemplateConfig's read of it. It only protects callers within this
+// process; store implementations backed by something shared across processes
+// (e.g. the registry) still need an external convention to avoid two shims
+// racing on the same template ID.
+var refCountMu sync.Mutex
+
+// IncrementCloneRef records that a new clone has been created from the
+// template persisted under `id` and returns the updated reference count. If
+// no config exists for `id` it returns an error matching errors.Is(err,
+// ErrTemplateNotFound).
+func IncrementCloneRef(ctx context.Context, id string) (int, error) {
+	refCountMu.Lock()
+	defer refCountMu.Unlock()
+
+	pc, err := store.Load(ctx, id)
+	if err != nil {
+		if regstate.IsNotFoundError(err) {
+			return 0, &notFoundError{id: id, err: err}
+		}
+		return 0, fmt.Errorf("failed to load template config for '%s': %w", id, err)
+	}
+	pc.CloneRefCount++
+	if err := store.Store(ctx, id, pc, true); err != nil {
+		return 0, fmt.Errorf("failed to update clone ref count for '%s': %w", id, err)
+	}
+	return pc.CloneRefCount, nil
+}
+
+// RecordCloneCreated is IncrementCloneRef plus tracking `cloneID` in the
+// template's ClonedIDs, so ClonesFromTemplate can later report which clones
+// came from `id` (e.g. for cascading teardown). If `cloneID` is already
+// recorded this still increments the ref count without duplicating the ID.
+func RecordCloneCreated(ctx context.Context, id string, cloneID string) (int, error) {
+	refCountMu.Lock()
+	defer refCountMu.Unlock()
+
+	pc, err := store.Load(ctx, id)
+	if err != nil {
+		if regstate.IsNotFoundError(err) {
+			return 0, &notFoundError{id: id, err: err}
+		}
+		return 0, fmt.Errorf("failed to load template config for '%s': %w", id, err)
+	}
+	pc.CloneRefCount++
+	found := false
+	for _, existing := range pc.ClonedIDs {
+		if existing == cloneID {
+			found = true
+			break
+		}
+	}
+	if !found {
+		pc.ClonedIDs = append(pc.ClonedIDs, cloneID)
+	}
+	if err := store.Store(ctx, id, pc, true); err != nil {
+		return 0, fmt.Errorf("failed to update clone ref count for '%s': %w", id, err)
+	}
+	return pc.CloneRefCount, nil
+}
+
+// RecordCloneRemoved is DecrementCloneRef plus removing `cloneID` from the
+// template's ClonedIDs. If `cloneID` isn't recorded, ClonedIDs is left as it
+// is, but the ref count is still decremented.
+func RecordCloneRemoved(ctx context.Context, id string, cloneID string) (int, error) {
+	refCountMu.Lock()
+	defer refCountMu.Unlock()
+
+	pc, err := store.Load(ctx, id)
+	if err != nil {
+		if regstate.IsNotFoundError(err) {
+			return 0, &notFoundError{id: id, err: err}
+		}
+		return 0, fmt.Errorf("failed to load template config for '%s': %w", id, err)
+	}
+	if pc.CloneRefCount > 0 {
+		pc.CloneRefCount--
+	}
+	for i, existing := range pc.ClonedIDs {
+		if existing == cloneID {
+			pc.ClonedIDs = append(pc.ClonedIDs[:i], pc.ClonedIDs[i+1:]...)
+			break
+		}
+	}
+	if err := store.Store(ctx, id, pc, true); err != nil {
+		return 0, fmt.Errorf("failed to update clone ref count for '%s': %w", id, err)
+	}
+	return pc.CloneRefCount, nil
+}
+
+// DecrementCloneRef records that a clone created from the template persisted
+// under `id` has gone away and returns the updated reference count. It's a
+// no-op below zero: decrementing an already-zero counter leaves it at zero
+// rather than going negative. If no config exists for `id` it returns an
+// error matching errors.Is(err, ErrTemplateNotFound).
+func DecrementCloneRef(ctx context.Context, id string) (int, error) {
+	refCountMu.Lock()
+	defer refCountMu.Unlock()
+
+	pc, err := store.Load(ctx, id)
+	if err != nil {
+		if regstate.IsNotFoundError(err) {
+			return 0, &notFoundError{id: id, err: err}
+		}
+		return 0, fmt.Errorf("failed to load template config for '%s': %w", id, err)
+	}
+	if pc.CloneRefCount > 0 {
+		pc.CloneRefCount--
+	}
+	if err := store.Store(ctx, id, pc, true); err != nil {
+		return 0, fmt.Errorf("failed to update clone ref count for '%s': %w", id, err)
+	}
+	return pc.CloneRefCount, nil
+}
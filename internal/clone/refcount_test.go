@@ -0,0 +1,115 @@
+package clone
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestCloneRefCount_IncrementDecrement(t *testing.T) {
+	prepTest(t)
+	ctx := context.Background()
+	id := "template-refcount"
+
+	if err := SaveTemplateConfig(ctx, id, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := IncrementCloneRef(ctx, id); err != nil || n != 1 {
+		t.Fatalf("got (%d, %v), want (1, nil)", n, err)
+	}
+	if n, err := IncrementCloneRef(ctx, id); err != nil || n != 2 {
+		t.Fatalf("got (%d, %v), want (2, nil)", n, err)
+	}
+	if n, err := DecrementCloneRef(ctx, id); err != nil || n != 1 {
+		t.Fatalf("got (%d, %v), want (1, nil)", n, err)
+	}
+	if n, err := DecrementCloneRef(ctx, id); err != nil || n != 0 {
+		t.Fatalf("got (%d, %v), want (0, nil)", n, err)
+	}
+	// Decrementing below zero is a no-op, not an underflow.
+	if n, err := DecrementCloneRef(ctx, id); err != nil || n != 0 {
+		t.Fatalf("got (%d, %v), want (0, nil)", n, err)
+	}
+}
+
+func TestRemoveSavedTemplateConfig_RefusesWhileInUse(t *testing.T) {
+	prepTest(t)
+	ctx := context.Background()
+	id := "template-in-use"
+
+	if err := SaveTemplateConfig(ctx, id, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := IncrementCloneRef(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RemoveSavedTemplateConfig(ctx, id); !errors.Is(err, ErrTemplateInUse) {
+		t.Fatalf("expected ErrTemplateInUse, got %v", err)
+	}
+
+	if err := RemoveSavedTemplateConfigForce(ctx, id); err != nil {
+		t.Fatalf("force remove failed: %v", err)
+	}
+	if _, err := FetchTemplateConfig(ctx, id); !errors.Is(err, ErrTemplateNotFound) {
+		t.Fatalf("expected ErrTemplateNotFound after force remove, got %v", err)
+	}
+}
+
+func TestClonesFromTemplate_AddTwoRemoveOne(t *testing.T) {
+	prepTest(t)
+	ctx := context.Background()
+	id := "template-clones"
+
+	if err := SaveTemplateConfig(ctx, id, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := RecordCloneCreated(ctx, id, "clone-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RecordCloneCreated(ctx, id, "clone-2"); err != nil {
+		t.Fatal(err)
+	}
+
+	clones, err := ClonesFromTemplate(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clones) != 2 {
+		t.Fatalf("got %d clones, want 2: %v", len(clones), clones)
+	}
+
+	if n, err := RecordCloneRemoved(ctx, id, "clone-1"); err != nil || n != 1 {
+		t.Fatalf("got (%d, %v), want (1, nil)", n, err)
+	}
+
+	clones, err = ClonesFromTemplate(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clones) != 1 || clones[0] != "clone-2" {
+		t.Fatalf("got %v, want [clone-2]", clones)
+	}
+}
+
+func TestRemoveSavedTemplateConfig_SucceedsAtZeroRefs(t *testing.T) {
+	prepTest(t)
+	ctx := context.Background()
+	id := "template-zero-refs"
+
+	if err := SaveTemplateConfig(ctx, id, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := IncrementCloneRef(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DecrementCloneRef(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RemoveSavedTemplateConfig(ctx, id); err != nil {
+		t.Fatalf("expected removal to succeed once refcount is back to zero, got %v", err)
+	}
+}
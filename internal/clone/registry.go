@@ -0,0 +1,589 @@
+// Package clone persists the template configs used to hot-clone utility VMs.
+//
+// A template config is an opaque, already-encoded blob (typically produced by
+// uvm.GenerateTemplateConfig and gob-encoded by the caller) that is stashed in
+// the registry keyed by the template's UVM ID so that it can be retrieved
+// later to drive cloning, including after a shim restart.
+package clone
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"time"
+
+	"github.com/Microsoft/hcsshim/internal/log"
+	"github.com/Microsoft/hcsshim/internal/logfields"
+	"github.com/Microsoft/hcsshim/internal/metrics"
+	"github.com/Microsoft/hcsshim/internal/regstate"
+	"github.com/sirupsen/logrus"
+)
+
+// templateStoreID is the regstate root under which every template config is
+// stored, one child key per template ID.
+const templateStoreID = "templates"
+
+// templateConfigValue is the name of the registry value holding the encoded
+// config under a template's key.
+const templateConfigValue = "config"
+
+// defaultMaxTemplateConfigSize is the default value of maxTemplateConfigSize.
+const defaultMaxTemplateConfigSize = 1 << 20 // 1 MiB
+
+// maxTemplateConfigSize is the largest RawData SaveTemplateConfig will
+// accept. It exists to turn an oversized config - one that captures more
+// resources than a single registry value can hold - into a clear
+// ErrTemplateTooLarge up front, rather than an opaque failure once
+// registryTemplateStore actually tries to write it. Override with
+// SetMaxTemplateConfigSize.
+var maxTemplateConfigSize = defaultMaxTemplateConfigSize
+
+// SetMaxTemplateConfigSize overrides maxTemplateConfigSize and returns the
+// previous value, so a caller (typically a test, or a host that knows its
+// registry can hold larger values) can restore or raise it.
+func SetMaxTemplateConfigSize(max int) (old int) {
+	old = maxTemplateConfigSize
+	maxTemplateConfigSize = max
+	return old
+}
+
+// persistedUVMConfig is the on-disk representation of a saved template. Its
+// RawData is whatever the caller encoded (see package doc).
+//
+// CreatedAt, SourceHost and Annotations are all optional: configs saved
+// before these fields existed decode with the JSON zero value for each
+// (a zero time.Time, and empty strings/maps), which callers must treat as
+// "unknown" rather than "the epoch" or "no annotations".
+//
+// Provisional is inverted (false, not true, is the "normal" state) so that
+// configs saved before it existed decode as already-ready rather than
+// retroactively becoming unfetchable.
+type persistedUVMConfig struct {
+	ID          string
+	RawData     []byte
+	CreatedAt   time.Time
+	SourceHost  string
+	Annotations map[string]string
+	Provisional bool
+	// CloneRefCount is the number of live clones created from this
+	// template, maintained by IncrementCloneRef/DecrementCloneRef.
+	CloneRefCount int
+	// ClonedIDs holds the UVM IDs of clones created from this template,
+	// maintained by RecordCloneCreated/RecordCloneRemoved. Configs saved
+	// before this field existed decode with a nil ClonedIDs, which callers
+	// must treat as "no clone IDs recorded" rather than "definitely no
+	// clones" - CloneRefCount may still be nonzero for such a config.
+	ClonedIDs []string
+	// Checksum is the crc32 (IEEE) of RawData, set by SaveTemplateConfig and
+	// verified by FetchTemplateConfig. It's zero, and skipped by
+	// verification, for configs saved before this field existed.
+	Checksum uint32
+	// RawDataVersion is the schema version RawData was encoded in, set by
+	// SaveTemplateConfig to CurrentRawDataVersion and updated by
+	// MigrateTemplateConfig. Configs saved before this field existed decode
+	// as version 0, the oldest schema MigrateTemplateConfig knows how to
+	// migrate from.
+	RawDataVersion int
+}
+
+// TemplateInfo describes a persisted template config without its raw
+// resource data, for callers that want to inventory or age-out templates
+// without paying to decode every config's RawData.
+type TemplateInfo struct {
+	ID          string
+	CreatedAt   time.Time
+	SourceHost  string
+	Annotations map[string]string
+	// Provisional is true if `ID` was reserved with ReserveTemplateConfig
+	// but SaveTemplateConfig hasn't completed yet.
+	Provisional bool
+	// CloneRefCount is the number of live clones created from this
+	// template.
+	CloneRefCount int
+}
+
+func openTemplateKey() (*regstate.Key, error) {
+	return regstate.Open(templateStoreID, false)
+}
+
+// ReserveTemplateConfig stakes out `id` in the store with a provisional,
+// dataless config before the actual template resources have been captured.
+// It lets a save-as-template flow claim the ID up front, so a concurrent
+// save under the same ID fails fast, while FetchTemplateConfig continues to
+// report ErrTemplateNotReady for `id` until SaveTemplateConfig completes.
+//
+// If a config, provisional or not, already exists for `id` it returns an
+// error matching errors.Is(err, ErrTemplateExists).
+//
+// It holds templateIDLocks for `id` across its own check-then-store, so a
+// concurrent ReserveTemplateConfig or SaveTemplateConfigWithAnnotations for
+// the same ID can't slip its own store in between this call's check and
+// store.
+func ReserveTemplateConfig(ctx context.Context, id string, annotations map[string]string) error {
+	templateIDLocks.Lock(id)
+	defer templateIDLocks.Unlock(id)
+
+	if _, err := store.Load(ctx, id); err == nil {
+		return &existsError{id: id}
+	} else if !regstate.IsNotFoundError(err) {
+		return fmt.Errorf("failed to check for existing template config for '%s': %w", id, err)
+	}
+
+	hostname, _ := os.Hostname()
+	pc := persistedUVMConfig{
+		ID:          id,
+		CreatedAt:   time.Now(),
+		SourceHost:  hostname,
+		Annotations: annotations,
+		Provisional: true,
+	}
+	if err := store.Store(ctx, id, &pc, false); err != nil {
+		return fmt.Errorf("failed to reserve template config for '%s': %w", id, err)
+	}
+	return nil
+}
+
+// SaveTemplateConfig persists `data` under `id`, marking it ready for
+// FetchTemplateConfig. If `id` was staked out with ReserveTemplateConfig this
+// fills in and clears the reservation; otherwise it creates and immediately
+// readies a new config. If a config that's already ready exists for `id` it
+// returns an error matching errors.Is(err, ErrTemplateExists).
+func SaveTemplateConfig(ctx context.Context, id string, data []byte) error {
+	return SaveTemplateConfigWithAnnotations(ctx, id, data, nil)
+}
+
+// SaveTemplateConfigWithAnnotations is SaveTemplateConfig with caller-defined
+// annotations attached to the saved config, e.g. for tracking why or by whom
+// the template was created. If `id` was reserved with annotations already,
+// these annotations replace them.
+//
+// It holds templateIDLocks for `id` across its own check-then-store, so a
+// concurrent SaveTemplateConfigWithAnnotations or ReserveTemplateConfig for
+// the same ID can't slip its own store in between this call's check and
+// store.
+func SaveTemplateConfigWithAnnotations(ctx context.Context, id string, data []byte, annotations map[string]string) error {
+	op := "clone::SaveTemplateConfig"
+	start := time.Now()
+	l := log.G(ctx).WithField(logfields.UVMID, id)
+	l.Debug(op + " - Begin")
+	defer func() {
+		l.Debug(op + " - End")
+	}()
+
+	if len(data) > maxTemplateConfigSize {
+		return &tooLargeError{id: id, size: len(data), limit: maxTemplateConfigSize}
+	}
+
+	templateIDLocks.Lock(id)
+	defer templateIDLocks.Unlock(id)
+
+	existing, err := store.Load(ctx, id)
+	overwrite := false
+	if err == nil {
+		if !existing.Provisional {
+			return &existsError{id: id}
+		}
+		overwrite = true
+	} else if !regstate.IsNotFoundError(err) {
+		return fmt.Errorf("failed to check for existing template config for '%s': %w", id, err)
+	}
+
+	hostname, _ := os.Hostname()
+	pc := persistedUVMConfig{
+		ID:             id,
+		RawData:        data,
+		CreatedAt:      time.Now(),
+		SourceHost:     hostname,
+		Annotations:    annotations,
+		Checksum:       crc32.ChecksumIEEE(data),
+		RawDataVersion: CurrentRawDataVersion,
+	}
+	if err := store.Store(ctx, id, &pc, overwrite); err != nil {
+		return fmt.Errorf("failed to store template config for '%s': %w", id, err)
+	}
+	elapsed := time.Since(start)
+	l.WithFields(logrus.Fields{
+		"size-bytes": len(data),
+		"duration":   elapsed,
+	}).Info("saved template config")
+	metrics.Record("SaveTemplateConfig", id, elapsed)
+	return nil
+}
+
+// TemplateSave is one config to persist as part of a SaveTemplateConfigs
+// batch.
+type TemplateSave struct {
+	ID          string
+	Data        []byte
+	Annotations map[string]string
+}
+
+// SaveTemplateConfigs persists every config in `saves` via
+// SaveTemplateConfigWithAnnotations, for a pod's auxiliary UVMs that must be
+// templated together atomically. If any save fails, every config already
+// saved earlier in the batch is removed via removeSavedTemplateConfig before
+// the error is returned, so a caller never ends up with a half-saved pod
+// template. This isn't atomic against a concurrent reader observing a
+// partially-saved batch mid-call - only against the batch itself being left
+// half-done once SaveTemplateConfigs returns.
+func SaveTemplateConfigs(ctx context.Context, saves []TemplateSave) error {
+	saved := make([]string, 0, len(saves))
+	for _, s := range saves {
+		if err := SaveTemplateConfigWithAnnotations(ctx, s.ID, s.Data, s.Annotations); err != nil {
+			for _, id := range saved {
+				if rerr := removeSavedTemplateConfig(ctx, id); rerr != nil {
+					log.G(ctx).WithField(logfields.UVMID, id).WithError(rerr).Warn("failed to roll back template config after batch save failure")
+				}
+			}
+			return fmt.Errorf("failed to save template config for '%s', rolled back %d previously saved config(s) in this batch: %w", s.ID, len(saved), err)
+		}
+		saved = append(saved, s.ID)
+	}
+	return nil
+}
+
+// CurrentRawDataVersion is the RawDataVersion SaveTemplateConfig stamps on
+// every newly-saved config, and the version MigrateTemplateConfig migrates
+// an older config up to. Bump it, and extend rawDataMigrator to handle
+// migrating from the previous value, whenever the uvm resource structs
+// RawData encodes change in a way that could leave an old config's decoded
+// structs partially populated.
+const CurrentRawDataVersion = 1
+
+// rawDataMigrator re-encodes `data`, which was encoded at schema version
+// `fromVersion`, into CurrentRawDataVersion's format. Nil by default: this
+// package treats RawData as an opaque blob (see the package doc comment), so
+// a caller that knows the blob's actual schema (i.e. the uvm package) must
+// register one with SetRawDataMigrator before MigrateTemplateConfig can do
+// anything with a config older than CurrentRawDataVersion.
+var rawDataMigrator func(data []byte, fromVersion int) ([]byte, error)
+
+// SetRawDataMigrator registers the function MigrateTemplateConfig uses to
+// re-encode a config's RawData from an older schema version. It returns the
+// previous value so a caller (typically a test) can restore it.
+func SetRawDataMigrator(fn func(data []byte, fromVersion int) ([]byte, error)) (old func(data []byte, fromVersion int) ([]byte, error)) {
+	old = rawDataMigrator
+	rawDataMigrator = fn
+	return old
+}
+
+// MigrateTemplateConfig loads the config persisted under `id`, and, if it's
+// not already at CurrentRawDataVersion, re-encodes its RawData via the
+// function registered with SetRawDataMigrator and stores the result back
+// under the same ID. It's idempotent: a config already at
+// CurrentRawDataVersion is left untouched and this returns nil without
+// consulting the migrator. Run this during shim startup, before any clone
+// is created from a config that might predate the current schema, so a
+// stale config fails fast here instead of decoding into a partially
+// populated struct during Cloneable.Clone.
+//
+// If none exists for `id` it returns an error matching errors.Is(err,
+// ErrTemplateNotFound). If the config needs migrating but no migrator is
+// registered, it returns a descriptive error rather than silently leaving
+// the config on its old schema.
+func MigrateTemplateConfig(ctx context.Context, id string) error {
+	pc, err := store.Load(ctx, id)
+	if err != nil {
+		if regstate.IsNotFoundError(err) {
+			return &notFoundError{id: id, err: err}
+		}
+		return fmt.Errorf("failed to load template config for '%s': %w", id, err)
+	}
+	if pc.RawDataVersion == CurrentRawDataVersion {
+		return nil
+	}
+	if rawDataMigrator == nil {
+		return fmt.Errorf("cannot migrate template config for '%s' from schema version %d to %d: no migrator registered, see SetRawDataMigrator", id, pc.RawDataVersion, CurrentRawDataVersion)
+	}
+
+	migrated, err := rawDataMigrator(pc.RawData, pc.RawDataVersion)
+	if err != nil {
+		return fmt.Errorf("failed to migrate template config for '%s' from schema version %d: %w", id, pc.RawDataVersion, err)
+	}
+	pc.RawData = migrated
+	pc.RawDataVersion = CurrentRawDataVersion
+	pc.Checksum = crc32.ChecksumIEEE(migrated)
+	if err := store.Store(ctx, id, pc, true); err != nil {
+		return fmt.Errorf("failed to store migrated template config for '%s': %w", id, err)
+	}
+	return nil
+}
+
+// rawDataRekeyer re-encodes `data`, previously saved under an old ID, with
+// its embedded UVMID rewritten to `newID`. Nil by default: this package
+// treats RawData as an opaque blob (see the package doc comment), so a
+// caller that knows the blob's actual schema (i.e. the uvm package) must
+// register one with SetRawDataRekeyer before RenameTemplate can update the
+// embedded ID; without one, RenameTemplate still moves the config to the new
+// key but RawData keeps reporting the old UVMID internally.
+var rawDataRekeyer func(data []byte, newID string) ([]byte, error)
+
+// SetRawDataRekeyer registers the function RenameTemplate uses to rewrite a
+// config's embedded UVMID when moving it to a new key. It returns the
+// previous value so a caller (typically a test) can restore it.
+func SetRawDataRekeyer(fn func(data []byte, newID string) ([]byte, error)) (old func(data []byte, newID string) ([]byte, error)) {
+	old = rawDataRekeyer
+	rawDataRekeyer = fn
+	return old
+}
+
+// RenameTemplate moves the config persisted under oldID to newID, e.g. after
+// an ID scheme change makes a template's original UVMID obsolete. If oldID
+// doesn't exist it returns an error matching errors.Is(err,
+// ErrTemplateNotFound). If newID already exists it returns an error matching
+// errors.Is(err, ErrTemplateExists) and leaves oldID untouched.
+//
+// If a rekeyer is registered with SetRawDataRekeyer, RawData's embedded
+// UVMID is rewritten to newID before it's stored under the new key; see
+// SetRawDataRekeyer's doc comment for what happens without one.
+//
+// It holds templateIDLocks for both oldID and newID for the duration, the
+// same coordination RemoveSavedTemplateConfig uses, so it can't race a
+// concurrent FetchTemplateConfig or Remove* for either ID.
+func RenameTemplate(ctx context.Context, oldID, newID string) error {
+	first, second := oldID, newID
+	if second < first {
+		first, second = second, first
+	}
+	templateIDLocks.Lock(first)
+	defer templateIDLocks.Unlock(first)
+	if second != first {
+		templateIDLocks.Lock(second)
+		defer templateIDLocks.Unlock(second)
+	}
+
+	if _, err := store.Load(ctx, newID); err == nil {
+		return &existsError{id: newID}
+	} else if !regstate.IsNotFoundError(err) {
+		return fmt.Errorf("failed to check for existing template config for '%s': %w", newID, err)
+	}
+
+	pc, err := store.Load(ctx, oldID)
+	if err != nil {
+		if regstate.IsNotFoundError(err) {
+			return &notFoundError{id: oldID, err: err}
+		}
+		return fmt.Errorf("failed to load template config for '%s': %w", oldID, err)
+	}
+
+	if rawDataRekeyer != nil {
+		rekeyed, err := rawDataRekeyer(pc.RawData, newID)
+		if err != nil {
+			return fmt.Errorf("failed to rekey template config from '%s' to '%s': %w", oldID, newID, err)
+		}
+		pc.RawData = rekeyed
+		pc.Checksum = crc32.ChecksumIEEE(rekeyed)
+	}
+	pc.ID = newID
+
+	if err := store.Store(ctx, newID, pc, false); err != nil {
+		return fmt.Errorf("failed to store renamed template config for '%s': %w", newID, err)
+	}
+	if err := removeSavedTemplateConfig(ctx, oldID); err != nil {
+		return fmt.Errorf("renamed template config to '%s' but failed to remove old key '%s': %w", newID, oldID, err)
+	}
+	return nil
+}
+
+// GetTemplateInfo returns the metadata recorded for the template config
+// persisted under `id`, without decoding its RawData. If none exists it
+// returns an error matching errors.Is(err, ErrTemplateNotFound).
+func GetTemplateInfo(ctx context.Context, id string) (*TemplateInfo, error) {
+	pc, err := store.Load(ctx, id)
+	if err != nil {
+		if regstate.IsNotFoundError(err) {
+			return nil, &notFoundError{id: id, err: err}
+		}
+		return nil, fmt.Errorf("failed to load template config for '%s': %w", id, err)
+	}
+	return &TemplateInfo{
+		ID:            pc.ID,
+		CreatedAt:     pc.CreatedAt,
+		SourceHost:    pc.SourceHost,
+		Annotations:   pc.Annotations,
+		Provisional:   pc.Provisional,
+		CloneRefCount: pc.CloneRefCount,
+	}, nil
+}
+
+// templateIDLocks serializes every check-then-act sequence registry.go builds
+// on top of store's Load/Store/Remove, per template ID, so two such
+// sequences for the same ID can never interleave: ReserveTemplateConfig and
+// SaveTemplateConfigWithAnnotations against each other, against
+// FetchTemplateConfig, and against
+// RemoveSavedTemplateConfig/RemoveSavedTemplateConfigForce/RenameTemplate.
+// Without it, two concurrent calls could each pass their own existence check
+// before either had stored anything, and one would silently clobber the
+// other - store's own idLocks only cover a single Load/Store/Remove call,
+// not the multi-call sequences here. Whichever call started first runs to
+// completion before the next one proceeds.
+var templateIDLocks keyedMutex
+
+// FetchTemplateConfig returns the raw config bytes previously saved under
+// `id`. If none exists it returns an error matching errors.Is(err,
+// ErrTemplateNotFound). If `id` was reserved with ReserveTemplateConfig but
+// SaveTemplateConfig hasn't completed yet, it returns an error matching
+// errors.Is(err, ErrTemplateNotReady) rather than the reservation's empty
+// RawData. If RawData doesn't match its stored Checksum it returns an error
+// matching errors.Is(err, ErrTemplateCorrupt) instead of the corrupted data;
+// configs saved before Checksum existed (zero value) skip this check. If
+// `ctx` is cancelled or its deadline expires before the registry read
+// completes, it returns ctx.Err() promptly rather than waiting on the read.
+func FetchTemplateConfig(ctx context.Context, id string) ([]byte, error) {
+	templateIDLocks.Lock(id)
+	defer templateIDLocks.Unlock(id)
+
+	pc, err := loadWithContext(ctx, id)
+	if err != nil {
+		if err == ctx.Err() {
+			return nil, err
+		}
+		if regstate.IsNotFoundError(err) {
+			return nil, &notFoundError{id: id, err: err}
+		}
+		return nil, fmt.Errorf("failed to load template config for '%s': %w", id, err)
+	}
+	if pc.Provisional {
+		return nil, &notReadyError{id: id}
+	}
+	if pc.Checksum != 0 {
+		if got := crc32.ChecksumIEEE(pc.RawData); got != pc.Checksum {
+			return nil, &corruptError{id: id, want: pc.Checksum, got: got}
+		}
+	}
+	return pc.RawData, nil
+}
+
+// loadWithContext runs store.Load(ctx, id) in a goroutine and returns as soon as
+// either it completes or ctx is done, so a hung or slow registry read can't
+// block a caller past its deadline. store.Load has no cancellation hook, so
+// its goroutine keeps running to completion even after a ctx-driven early
+// return; the result channel is buffered so that goroutine never blocks
+// trying to deliver it, and so it doesn't leak waiting to send.
+func loadWithContext(ctx context.Context, id string) (*persistedUVMConfig, error) {
+	type result struct {
+		pc  *persistedUVMConfig
+		err error
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	ch := make(chan result, 1)
+	go func() {
+		pc, err := store.Load(ctx, id)
+		ch <- result{pc, err}
+	}()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case r := <-ch:
+		return r.pc, r.err
+	}
+}
+
+// TemplateExists reports whether a config, provisional or not, is currently
+// persisted under `id`, without decoding it the way FetchTemplateConfig
+// does. Use this when a caller only needs to decide whether to create a
+// template under `id`, not read it.
+func TemplateExists(ctx context.Context, id string) (bool, error) {
+	_, err := loadWithContext(ctx, id)
+	if err != nil {
+		if err == ctx.Err() {
+			return false, err
+		}
+		if regstate.IsNotFoundError(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to check for existing template config for '%s': %w", id, err)
+	}
+	return true, nil
+}
+
+// RemoveSavedTemplateConfig removes the config persisted under `id`. If none
+// exists it returns an error matching errors.Is(err, ErrTemplateNotFound). If
+// the template still has clones referencing it (see IncrementCloneRef) it
+// refuses to remove it, returning an error matching errors.Is(err,
+// ErrTemplateInUse); use RemoveSavedTemplateConfigForce to override.
+//
+// It waits for any FetchTemplateConfig already in flight for `id` to finish
+// before checking the reference count and removing (see templateIDLocks),
+// and holds refCountMu across its own check-then-delete so a RecordCloneCreated
+// racing in can't slip a new reference in between the check and the delete.
+func RemoveSavedTemplateConfig(ctx context.Context, id string) error {
+	templateIDLocks.Lock(id)
+	defer templateIDLocks.Unlock(id)
+
+	refCountMu.Lock()
+	defer refCountMu.Unlock()
+
+	pc, err := store.Load(ctx, id)
+	if err != nil {
+		if regstate.IsNotFoundError(err) {
+			return &notFoundError{id: id, err: err}
+		}
+		return fmt.Errorf("failed to load template config for '%s': %w", id, err)
+	}
+	if pc.CloneRefCount > 0 {
+		return &inUseError{id: id, count: pc.CloneRefCount}
+	}
+	return removeSavedTemplateConfig(ctx, id)
+}
+
+// RemoveSavedTemplateConfigForce is RemoveSavedTemplateConfig without the
+// clone reference count check, for callers tearing down a template and its
+// clones together. It still waits for any in-flight FetchTemplateConfig to
+// finish first, same as RemoveSavedTemplateConfig.
+func RemoveSavedTemplateConfigForce(ctx context.Context, id string) error {
+	templateIDLocks.Lock(id)
+	defer templateIDLocks.Unlock(id)
+
+	return removeSavedTemplateConfig(ctx, id)
+}
+
+// RemoveSavedTemplateConfigIfExists is RemoveSavedTemplateConfig, except a
+// missing config is not treated as an error: it returns removed=false
+// instead of an error matching errors.Is(err, ErrTemplateNotFound). This
+// suits refcount/GC callers that need to know whether they actually deleted
+// something, without having to unwrap ErrTemplateNotFound out of the common
+// case where there's simply nothing left to clean up.
+func RemoveSavedTemplateConfigIfExists(ctx context.Context, id string) (removed bool, err error) {
+	if err := RemoveSavedTemplateConfig(ctx, id); err != nil {
+		if errors.Is(err, ErrTemplateNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func removeSavedTemplateConfig(ctx context.Context, id string) error {
+	if err := store.Remove(ctx, id); err != nil {
+		if regstate.IsNotFoundError(err) {
+			return &notFoundError{id: id, err: err}
+		}
+		return fmt.Errorf("failed to remove template config for '%s': %w", id, err)
+	}
+	return nil
+}
+
+// ListTemplates returns the IDs of every currently persisted template.
+func ListTemplates(ctx context.Context) ([]string, error) {
+	return store.List()
+}
+
+// ClonesFromTemplate returns the UVM IDs of the clones recorded against the
+// template persisted under `id` via RecordCloneCreated. Clones removed with
+// RecordCloneRemoved no longer appear. If none exists it returns an error
+// matching errors.Is(err, ErrTemplateNotFound).
+func ClonesFromTemplate(ctx context.Context, id string) ([]string, error) {
+	pc, err := store.Load(ctx, id)
+	if err != nil {
+		if regstate.IsNotFoundError(err) {
+			return nil, &notFoundError{id: id, err: err}
+		}
+		return nil, fmt.Errorf("failed to load template config for '%s': %w", id, err)
+	}
+	return pc.ClonedIDs, nil
+}
@@ -0,0 +1,228 @@
+package clone
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/Microsoft/hcsshim/internal/log"
+	"github.com/Microsoft/hcsshim/internal/logfields"
+	"github.com/Microsoft/hcsshim/internal/regstate"
+)
+
+// TemplateStore persists persistedUVMConfig values keyed by template ID. The
+// package defaults to a registry-backed store; NewInMemoryTemplateStore
+// provides an implementation for tests and hosts with no Windows registry to
+// persist to. Load/Store/Remove take ctx so an implementation can log with
+// the request-scoped logger the rest of the codebase uses via log.G(ctx); see
+// registryTemplateStore for the store that actually does.
+type TemplateStore interface {
+	// Load returns the config stored under `id`. If none exists it returns
+	// an error matching regstate.IsNotFoundError.
+	Load(ctx context.Context, id string) (*persistedUVMConfig, error)
+	// Store persists `pc` under `id`. If `overwrite` is false and a config
+	// already exists under `id`, it returns an implementation-defined error;
+	// callers that need to distinguish "already exists" call Load first, as
+	// the package-level SaveTemplateConfig does.
+	Store(ctx context.Context, id string, pc *persistedUVMConfig, overwrite bool) error
+	// Remove deletes the config stored under `id`. If none exists it
+	// returns an error matching regstate.IsNotFoundError.
+	Remove(ctx context.Context, id string) error
+	// List returns the IDs of every currently stored config.
+	List() ([]string, error)
+}
+
+// store is the TemplateStore every package-level function persists through.
+// It defaults to the registry, but tests can redirect it with
+// SetTemplateStore to avoid touching the real Windows registry.
+var store TemplateStore = &registryTemplateStore{}
+
+// SetTemplateStore replaces the store package-level functions persist
+// through and returns the previous one, so callers (typically tests) can
+// restore it afterwards:
+//
+//	defer clone.SetTemplateStore(clone.SetTemplateStore(clone.NewInMemoryTemplateStore()))
+func SetTemplateStore(s TemplateStore) TemplateStore {
+	old := store
+	store = s
+	return old
+}
+
+// WithStore runs fn with the package-level store every SaveTemplateConfig,
+// FetchTemplateConfig, RemoveSavedTemplateConfig, etc. call temporarily
+// replaced by `s`, restoring whatever store was in effect before returning.
+// This is the scoped alternative to a bare SetTemplateStore/defer pair for a
+// caller (typically a test) that only needs the swap for the duration of
+// `fn`, e.g. to run a whole table-driven test against a fresh in-memory
+// store per case without threading it through every call:
+//
+//	clone.WithStore(clone.NewInMemoryTemplateStore(), func() {
+//	    clone.SaveTemplateConfig(ctx, id, data)
+//	    ...
+//	})
+func WithStore(s TemplateStore, fn func()) {
+	old := SetTemplateStore(s)
+	defer SetTemplateStore(old)
+	fn()
+}
+
+// registryTemplateStore is the default TemplateStore, backed by the Windows
+// registry via internal/regstate.
+//
+// Each of Load/Store/Remove independently opens and closes the registry key,
+// so two goroutines operating on the same ID could otherwise race between
+// their own open/read-or-write/close sequences. idLocks serializes access
+// per ID (different IDs still proceed in parallel) to close that window.
+type registryTemplateStore struct {
+	idLocks keyedMutex
+}
+
+func (s *registryTemplateStore) Load(ctx context.Context, id string) (*persistedUVMConfig, error) {
+	s.idLocks.Lock(id)
+	defer s.idLocks.Unlock(id)
+
+	l := log.G(ctx).WithField(logfields.UVMID, id)
+	l.Debug("opening template registry key")
+	k, err := openTemplateKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open template store: %w", err)
+	}
+	defer k.Close()
+
+	l.Debug("getting template registry value")
+	var pc persistedUVMConfig
+	if err := k.Get(id, templateConfigValue, &pc); err != nil {
+		return nil, err
+	}
+	return &pc, nil
+}
+
+func (s *registryTemplateStore) Store(ctx context.Context, id string, pc *persistedUVMConfig, overwrite bool) error {
+	s.idLocks.Lock(id)
+	defer s.idLocks.Unlock(id)
+
+	l := log.G(ctx).WithField(logfields.UVMID, id)
+	l.Debug("opening template registry key")
+	k, err := openTemplateKey()
+	if err != nil {
+		return fmt.Errorf("failed to open template store: %w", err)
+	}
+	defer k.Close()
+
+	l.WithField("overwrite", overwrite).Debug("setting template registry value")
+	if overwrite {
+		return k.Set(id, templateConfigValue, pc)
+	}
+	return k.Create(id, templateConfigValue, pc)
+}
+
+func (s *registryTemplateStore) Remove(ctx context.Context, id string) error {
+	s.idLocks.Lock(id)
+	defer s.idLocks.Unlock(id)
+
+	l := log.G(ctx).WithField(logfields.UVMID, id)
+	l.Debug("opening template registry key")
+	k, err := openTemplateKey()
+	if err != nil {
+		return fmt.Errorf("failed to open template store: %w", err)
+	}
+	defer k.Close()
+
+	l.Debug("removing template registry value")
+	return k.Remove(id)
+}
+
+func (*registryTemplateStore) List() ([]string, error) {
+	k, err := openTemplateKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open template store: %w", err)
+	}
+	defer k.Close()
+	return k.Enumerate()
+}
+
+// keyedMutex serializes operations that share a key while letting operations
+// on different keys proceed in parallel. The zero value is ready to use.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+func (m *keyedMutex) Lock(key string) {
+	m.mu.Lock()
+	if m.locks == nil {
+		m.locks = make(map[string]*sync.Mutex)
+	}
+	l, ok := m.locks[key]
+	if !ok {
+		l = &sync.Mutex{}
+		m.locks[key] = l
+	}
+	m.mu.Unlock()
+	l.Lock()
+}
+
+func (m *keyedMutex) Unlock(key string) {
+	m.mu.Lock()
+	l := m.locks[key]
+	m.mu.Unlock()
+	l.Unlock()
+}
+
+// inMemoryTemplateStore is a TemplateStore backed by a plain map, for tests
+// and hosts with no Windows registry to persist to. Its Load/Remove
+// not-found errors match regstate.IsNotFoundError so callers don't need to
+// know which store they're talking to.
+type inMemoryTemplateStore struct {
+	mu   sync.Mutex
+	byID map[string]persistedUVMConfig
+}
+
+// NewInMemoryTemplateStore returns a TemplateStore that keeps every config in
+// memory rather than persisting it, for use with SetTemplateStore in tests.
+func NewInMemoryTemplateStore() TemplateStore {
+	return &inMemoryTemplateStore{byID: make(map[string]persistedUVMConfig)}
+}
+
+func (s *inMemoryTemplateStore) Load(ctx context.Context, id string) (*persistedUVMConfig, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	log.G(ctx).WithField(logfields.UVMID, id).Debug("loading template store entry")
+	pc, ok := s.byID[id]
+	if !ok {
+		return nil, &regstate.NotFoundError{Id: id}
+	}
+	return &pc, nil
+}
+
+func (s *inMemoryTemplateStore) Store(ctx context.Context, id string, pc *persistedUVMConfig, overwrite bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	log.G(ctx).WithField(logfields.UVMID, id).WithField("overwrite", overwrite).Debug("storing template store entry")
+	if _, ok := s.byID[id]; ok && !overwrite {
+		return fmt.Errorf("template config for '%s' already exists", id)
+	}
+	s.byID[id] = *pc
+	return nil
+}
+
+func (s *inMemoryTemplateStore) Remove(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	log.G(ctx).WithField(logfields.UVMID, id).Debug("removing template store entry")
+	if _, ok := s.byID[id]; !ok {
+		return &regstate.NotFoundError{Id: id}
+	}
+	delete(s.byID, id)
+	return nil
+}
+
+func (s *inMemoryTemplateStore) List() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make([]string, 0, len(s.byID))
+	for id := range s.byID {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
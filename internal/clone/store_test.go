@@ -0,0 +1,118 @@
+package clone
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestInMemoryTemplateStore_ThroughPublicAPI(t *testing.T) {
+	old := SetTemplateStore(NewInMemoryTemplateStore())
+	defer SetTemplateStore(old)
+
+	ctx := context.Background()
+	id := "template-in-memory"
+
+	if err := SaveTemplateConfig(ctx, id, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveTemplateConfig(ctx, id, []byte("data")); !errors.Is(err, ErrTemplateExists) {
+		t.Fatalf("expected ErrTemplateExists, got %v", err)
+	}
+
+	got, err := FetchTemplateConfig(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "data" {
+		t.Fatalf("got %q, want %q", got, "data")
+	}
+
+	ids, err := ListTemplates(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0] != id {
+		t.Fatalf("got ids %v, want [%s]", ids, id)
+	}
+
+	if err := RemoveSavedTemplateConfig(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := FetchTemplateConfig(ctx, id); !errors.Is(err, ErrTemplateNotFound) {
+		t.Fatalf("expected ErrTemplateNotFound, got %v", err)
+	}
+}
+
+func TestWithStore_ScopesAndRestoresPreviousStore(t *testing.T) {
+	outer := NewInMemoryTemplateStore()
+	old := SetTemplateStore(outer)
+	defer SetTemplateStore(old)
+
+	ctx := context.Background()
+	inner := NewInMemoryTemplateStore()
+	WithStore(inner, func() {
+		if err := SaveTemplateConfig(ctx, "scoped", []byte("data")); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	if store != outer {
+		t.Fatal("expected WithStore to restore the previous store after fn returns")
+	}
+	if _, err := FetchTemplateConfig(ctx, "scoped"); !errors.Is(err, ErrTemplateNotFound) {
+		t.Fatalf("expected the outer store to be untouched by fn, got err %v", err)
+	}
+	if _, err := inner.Load(ctx, "scoped"); err != nil {
+		t.Fatalf("expected the inner store to have received the save, got err %v", err)
+	}
+}
+
+// TestKeyedMutex_SerializesSameKey hammers Lock/Unlock for the same key from
+// many goroutines and asserts the critical section is never entered
+// concurrently (run with `go test -race` to also catch a broken
+// implementation directly).
+func TestKeyedMutex_SerializesSameKey(t *testing.T) {
+	var m keyedMutex
+	var inCriticalSection int32
+	var wg sync.WaitGroup
+
+	const goroutines = 50
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.Lock("same-id")
+			defer m.Unlock("same-id")
+			if inCriticalSection != 0 {
+				t.Errorf("critical section entered concurrently")
+			}
+			inCriticalSection++
+			inCriticalSection--
+		}()
+	}
+	wg.Wait()
+}
+
+// TestKeyedMutex_DifferentKeysDoNotBlock asserts that two different keys can
+// be held at the same time.
+func TestKeyedMutex_DifferentKeysDoNotBlock(t *testing.T) {
+	var m keyedMutex
+	m.Lock("id-1")
+	defer m.Unlock("id-1")
+
+	done := make(chan struct{})
+	go func() {
+		m.Lock("id-2")
+		defer m.Unlock("id-2")
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("locking a different key blocked on an unrelated key's lock")
+	}
+}
@@ -2,6 +2,10 @@ package hcsoci
 
 import (
 	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
 
 	"github.com/Microsoft/hcsshim/internal/hns"
 	"github.com/Microsoft/hcsshim/internal/log"
@@ -9,8 +13,100 @@ import (
 	"github.com/Microsoft/hcsshim/internal/resources"
 	"github.com/Microsoft/hcsshim/internal/uvm"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
 )
 
+// defaultEndpointFetchConcurrency is the default number of concurrent
+// hns.GetHNSEndpointByID lookups issued by GetNamespaceEndpoints.
+const defaultEndpointFetchConcurrency = 4
+
+// defaultMaxNamespaceEndpoints is the default value of maxNamespaceEndpoints.
+const defaultMaxNamespaceEndpoints = 50
+
+// maxNamespaceEndpoints is the most endpoints createNetworkNamespace will add
+// to a single network namespace. It exists to protect the node from a
+// misconfigured CNI plugin handing back an unreasonably large endpoint list,
+// which would otherwise exhaust HNS resources and potentially hang. Override
+// with SetMaxNamespaceEndpoints.
+var maxNamespaceEndpoints = defaultMaxNamespaceEndpoints
+
+// SetMaxNamespaceEndpoints overrides maxNamespaceEndpoints and returns the
+// previous value, so a caller (typically a test, or a host that knows its
+// CNI plugins legitimately need more) can restore or raise it.
+func SetMaxNamespaceEndpoints(max int) (old int) {
+	old = maxNamespaceEndpoints
+	maxNamespaceEndpoints = max
+	return old
+}
+
+// createNamespace creates an HNS namespace and returns its ID. It's a
+// package-level var, rather than a direct hns.CreateNamespace call, so a test
+// can substitute a fake HNS without a real HNS service; see
+// SetNamespaceCreator.
+var createNamespace = hns.CreateNamespace
+
+// SetNamespaceCreator overrides the function createNetworkNamespace calls to
+// create an HNS namespace, and returns the previous value, so a test can
+// stand in a fake HNS that fails a set number of times before succeeding.
+func SetNamespaceCreator(fn func() (string, error)) (old func() (string, error)) {
+	old = createNamespace
+	createNamespace = fn
+	return old
+}
+
+// endpointReservationsMu guards endpointReservations.
+var endpointReservationsMu sync.Mutex
+
+// endpointReservations holds the endpoint IDs currently claimed by an
+// in-flight createNetworkNamespace call, closing the race window between
+// hns.CreateNamespace and the endpoint adds that follow it. HNS itself hands
+// back the namespace ID from CreateNamespace rather than taking one from the
+// caller, so there's no ID of our own to pre-reserve before that call; the
+// endpoints a caller wants attached are the one thing we know up front and
+// can stake a claim on.
+var endpointReservations = make(map[string]bool)
+
+// reserveEndpoints atomically claims every ID in `ids` for the caller's
+// exclusive use, or fails without claiming any of them if one is already
+// claimed by another in-flight createNetworkNamespace call - the collision
+// this exists to prevent. The returned release function must be called
+// (typically via defer) once the caller is done with the endpoints, whether
+// namespace setup went on to succeed or fail.
+func reserveEndpoints(ids []string) (release func(), err error) {
+	endpointReservationsMu.Lock()
+	defer endpointReservationsMu.Unlock()
+
+	for _, id := range ids {
+		if endpointReservations[id] {
+			return nil, fmt.Errorf("endpoint '%s' is already claimed by a concurrent network namespace setup", id)
+		}
+	}
+	for _, id := range ids {
+		endpointReservations[id] = true
+	}
+	return func() {
+		endpointReservationsMu.Lock()
+		defer endpointReservationsMu.Unlock()
+		for _, id := range ids {
+			delete(endpointReservations, id)
+		}
+	}, nil
+}
+
+// createNetworkNamespace creates a network namespace and attaches
+// dedupedEndpointIDs to it. The initial hns.CreateNamespace call is retried
+// with backoff and jitter by retryCreateNamespace before this gives up on a
+// transient failure; see namespaceCreateRetryPolicy. Its own partial-failure
+// window (a namespace created but not every endpoint attached) is unwound
+// locally by cleanupOnCreateNamespaceFailure before this returns an error.
+//
+// Once createNetworkNamespace itself returns nil, r.Add(&uvm.NetworkEndpoints{...})
+// below is what protects against a later caller in the chain failing: it's
+// the same ResourceCloser tracking every other container resource uses, so
+// ReleaseResources's *uvm.NetworkEndpoints case (or Resources.ReleaseNetworkNamespace
+// for a narrower teardown) removes the namespace and its endpoints via
+// NetworkEndpoints.Release without createNetworkNamespace's caller needing a
+// separate rollback path of its own.
 func createNetworkNamespace(ctx context.Context, coi *createOptionsInternal, r *resources.Resources) error {
 	op := "hcsoci::createNetworkNamespace"
 	l := log.G(ctx).WithField(logfields.ContainerID, coi.ID)
@@ -19,7 +115,18 @@ func createNetworkNamespace(ctx context.Context, coi *createOptionsInternal, r *
 		l.Debug(op + " - End")
 	}()
 
-	netID, err := hns.CreateNamespace()
+	dedupedEndpointIDs := dedupeEndpointIDs(ctx, coi.Spec.Windows.Network.EndpointList)
+	if len(dedupedEndpointIDs) > maxNamespaceEndpoints {
+		return fmt.Errorf("cannot create network namespace for container '%s': %d endpoints requested, which exceeds the limit of %d", coi.ID, len(dedupedEndpointIDs), maxNamespaceEndpoints)
+	}
+
+	release, err := reserveEndpoints(dedupedEndpointIDs)
+	if err != nil {
+		return fmt.Errorf("cannot create network namespace for container '%s': %w", coi.ID, err)
+	}
+	defer release()
+
+	netID, err := retryCreateNamespace(ctx)
 	if err != nil {
 		return err
 	}
@@ -30,21 +137,165 @@ func createNetworkNamespace(ctx context.Context, coi *createOptionsInternal, r *
 	r.SetNetNS(netID)
 	r.SetCreatedNetNS(true)
 	endpoints := make([]string, 0)
-	for _, endpointID := range coi.Spec.Windows.Network.EndpointList {
+	for _, endpointID := range dedupedEndpointIDs {
 		err = hns.AddNamespaceEndpoint(netID, endpointID)
 		if err != nil {
-			return err
+			if hns.ClassifyError(err) != hns.ErrorCategoryConflict {
+				cleanupOnCreateNamespaceFailure(ctx, netID, endpoints)
+				return err
+			}
+			log.G(ctx).WithFields(logrus.Fields{
+				"netID":      netID,
+				"endpointID": endpointID,
+			}).Debug("endpoint already in namespace, continuing")
+		} else {
+			log.G(ctx).WithFields(logrus.Fields{
+				"netID":      netID,
+				"endpointID": endpointID,
+			}).Info("added network endpoint to namespace")
 		}
-		log.G(ctx).WithFields(logrus.Fields{
-			"netID":      netID,
-			"endpointID": endpointID,
-		}).Info("added network endpoint to namespace")
 		endpoints = append(endpoints, endpointID)
 	}
 	r.Add(&uvm.NetworkEndpoints{EndpointIDs: endpoints, Namespace: netID})
 	return nil
 }
 
+// dedupeEndpointIDs returns `ids` with duplicates removed, keeping each ID's
+// first occurrence and dropping the rest, since some CNI plugins list the
+// same endpoint twice and a repeat hns.AddNamespaceEndpoint call for it
+// fails or leaves the namespace in an inconsistent state.
+func dedupeEndpointIDs(ctx context.Context, ids []string) []string {
+	seen := make(map[string]bool, len(ids))
+	deduped := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if seen[id] {
+			log.G(ctx).WithField("endpointID", id).Debug("dropping duplicate network endpoint")
+			continue
+		}
+		seen[id] = true
+		deduped = append(deduped, id)
+	}
+	return deduped
+}
+
+// cleanupOnCreateNamespaceFailure unwinds the partial state left behind when
+// createNetworkNamespace fails partway through adding `addedEndpoints` to
+// `netID`: it removes each endpoint that was successfully added and then
+// deletes the namespace itself. Failures during cleanup are logged at warn
+// rather than returned, since the caller is already propagating the original
+// error.
+func cleanupOnCreateNamespaceFailure(ctx context.Context, netID string, addedEndpoints []string) {
+	for _, endpointID := range addedEndpoints {
+		if err := hns.RemoveNamespaceEndpoint(netID, endpointID); err != nil {
+			log.G(ctx).WithFields(logrus.Fields{
+				"netID":      netID,
+				"endpointID": endpointID,
+			}).WithError(err).Warn("failed to remove network endpoint from namespace during cleanup")
+		}
+	}
+	if err := hns.RemoveNamespace(netID); err != nil {
+		log.G(ctx).WithField("netID", netID).WithError(err).Warn("failed to remove network namespace during cleanup")
+	}
+}
+
+// RemoveNamespaceEndpoint hot-removes a single endpoint from a live network
+// namespace in `hostingSystem`, without tearing down the rest of the
+// namespace, and updates `r`'s tracked NetworkEndpoints resource so a later
+// cleanup pass doesn't try to remove the same endpoint again.
+//
+// It's safe to call for an endpoint that's already gone from HNS entirely;
+// this returns nil. An endpoint that still exists in HNS but isn't actually
+// attached to `nsid` is not treated the same way: it returns a descriptive
+// error instead, since silently succeeding there would hide a caller bug
+// (removing the wrong namespace's endpoint, or one already removed by a
+// previous call) rather than the expected already-gone case.
+func RemoveNamespaceEndpoint(ctx context.Context, hostingSystem *uvm.UtilityVM, r *resources.Resources, nsid string, endpointID string) error {
+	endpoint, err := hns.GetHNSEndpointByID(endpointID)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if err := hostingSystem.RemoveEndpointsFromNS(ctx, nsid, []*hns.HNSEndpoint{endpoint}); err != nil {
+		return err
+	}
+	r.RemoveNetworkEndpoint(endpointID)
+	log.G(ctx).WithFields(logrus.Fields{
+		"netID":      nsid,
+		"endpointID": endpointID,
+	}).Info("removed network endpoint from namespace")
+	return nil
+}
+
+// RemoveNamespaceEndpoints is the bulk form of RemoveNamespaceEndpoint: it
+// removes every endpoint in `endpointIDs` from `nsid`, continuing past
+// per-endpoint failures rather than stopping at the first one, and returns a
+// single combined error naming every endpoint that failed to remove. As with
+// RemoveNamespaceEndpoint, an already-absent endpoint counts as removed.
+func RemoveNamespaceEndpoints(ctx context.Context, hostingSystem *uvm.UtilityVM, r *resources.Resources, nsid string, endpointIDs []string) error {
+	var problems []string
+	for _, endpointID := range endpointIDs {
+		if err := RemoveNamespaceEndpoint(ctx, hostingSystem, r, nsid, endpointID); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", endpointID, err))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("failed to remove %d endpoint(s) from namespace '%s': %s", len(problems), nsid, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// EndpointHealth reports CheckNamespaceEndpointsHealth's findings for one
+// endpoint tracked in a namespace.
+type EndpointHealth struct {
+	EndpointID string
+	// Present is true if HNS still has an endpoint by this ID at all.
+	Present bool
+	// Attached is true if HNS reports the endpoint as attached to a
+	// namespace. Present but not Attached means the endpoint still exists in
+	// HNS but has been detached out from under the pod.
+	Attached bool
+	// Err is set if querying the endpoint failed for a reason other than
+	// "it doesn't exist" (which just yields Present: false); a monitor
+	// should treat a non-nil Err the same as unhealthy.
+	Err error
+}
+
+// CheckNamespaceEndpointsHealth queries HNS for each endpoint currently in
+// namespace `netNS` and reports whether it's still present and attached, so
+// a monitor watching a long-running pod can detect an endpoint that vanished
+// underneath it without tearing the pod down to find out. Unlike
+// GetNamespaceEndpoints, a failure querying one endpoint doesn't abort the
+// whole call - it's recorded on that endpoint's EndpointHealth.Err and every
+// other endpoint is still checked.
+func CheckNamespaceEndpointsHealth(ctx context.Context, netNS string) ([]EndpointHealth, error) {
+	ids, err := GetNamespaceEndpointIDs(ctx, netNS)
+	if err != nil {
+		return nil, err
+	}
+
+	health := make([]EndpointHealth, len(ids))
+	for i, id := range ids {
+		health[i].EndpointID = id
+		endpoint, err := hns.GetHNSEndpointByID(id)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			health[i].Err = err
+			log.G(ctx).WithFields(logrus.Fields{
+				"netID":      netNS,
+				"endpointID": id,
+			}).WithError(err).Warn("failed to query network endpoint health")
+			continue
+		}
+		health[i].Present = true
+		health[i].Attached = endpoint.Namespace != nil
+	}
+	return health, nil
+}
+
 // GetNamespaceEndpoints gets all endpoints in `netNS`
 func GetNamespaceEndpoints(ctx context.Context, netNS string) ([]*hns.HNSEndpoint, error) {
 	op := "hcsoci::GetNamespaceEndpoints"
@@ -54,17 +305,80 @@ func GetNamespaceEndpoints(ctx context.Context, netNS string) ([]*hns.HNSEndpoin
 		l.Debug(op + " - End")
 	}()
 
-	ids, err := hns.GetNamespaceEndpoints(netNS)
+	ids, err := GetNamespaceEndpointIDs(ctx, netNS)
 	if err != nil {
 		return nil, err
 	}
-	var endpoints []*hns.HNSEndpoint
-	for _, id := range ids {
-		endpoint, err := hns.GetHNSEndpointByID(id)
+	return getEndpointsByID(ctx, ids, defaultEndpointFetchConcurrency)
+}
+
+// GetAllUVMEndpoints enumerates every network namespace hot-added to
+// `hostingSystem` and returns the union of their endpoints, deduplicated by
+// endpoint ID. This supports a "list networking state for this pod" command
+// that doesn't already know which namespace ID(s) are attached.
+func GetAllUVMEndpoints(ctx context.Context, hostingSystem *uvm.UtilityVM) ([]*hns.HNSEndpoint, error) {
+	seen := make(map[string]bool)
+	var all []*hns.HNSEndpoint
+	for _, nsid := range hostingSystem.NetNSIDs() {
+		endpoints, err := GetNamespaceEndpoints(ctx, nsid)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("failed to get endpoints for namespace '%s': %w", nsid, err)
+		}
+		for _, endpoint := range endpoints {
+			if !seen[endpoint.Id] {
+				seen[endpoint.Id] = true
+				all = append(all, endpoint)
+			}
 		}
-		endpoints = append(endpoints, endpoint)
+	}
+	return all, nil
+}
+
+// GetNamespaceEndpointIDs returns the IDs of the endpoints in `netNS`,
+// without hydrating each one via hns.GetHNSEndpointByID. Use this instead of
+// GetNamespaceEndpoints when only the count or the IDs themselves are needed,
+// e.g. for cheap monitoring polls.
+func GetNamespaceEndpointIDs(ctx context.Context, netNS string) ([]string, error) {
+	return hns.GetNamespaceEndpoints(netNS)
+}
+
+// getEndpointsByID fetches each endpoint in `ids`, `concurrency` at a time.
+// The returned slice is in the same order as `ids`. On the first error
+// encountered it stops handing out new work and returns that error once the
+// in-flight lookups drain.
+func getEndpointsByID(ctx context.Context, ids []string, concurrency int) ([]*hns.HNSEndpoint, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	if concurrency <= 0 {
+		concurrency = defaultEndpointFetchConcurrency
+	}
+
+	g, gctx := errgroup.WithContext(ctx)
+	sem := make(chan struct{}, concurrency)
+	endpoints := make([]*hns.HNSEndpoint, len(ids))
+	for i, id := range ids {
+		i, id := i, id
+		select {
+		case sem <- struct{}{}:
+		case <-gctx.Done():
+			if err := g.Wait(); err != nil {
+				return nil, err
+			}
+			return nil, ctx.Err()
+		}
+		g.Go(func() error {
+			defer func() { <-sem }()
+			endpoint, err := hns.GetHNSEndpointByID(id)
+			if err != nil {
+				return err
+			}
+			endpoints[i] = endpoint
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
 	}
 	return endpoints, nil
 }
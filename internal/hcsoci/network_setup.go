@@ -0,0 +1,469 @@
+package hcsoci
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/Microsoft/hcsshim/internal/hns"
+	"github.com/Microsoft/hcsshim/internal/log"
+	"github.com/Microsoft/hcsshim/internal/uvm"
+)
+
+// CLONING_DEFAULT_NETWORK_NAMESPACE_ID is the network namespace ID recorded
+// inside a template UVM (and reused, verbatim, by every clone spawned from
+// it) in place of the real HNS namespace ID. Baking in a single well-known ID
+// lets the GCS bridge state captured in the template stay valid for any
+// clone, at the cost of every clone showing the same NSID when debugging
+// inside the guest.
+//
+// This is the uvm package's constant of the same name; it's re-exported here
+// because it predates uvm.NetNSIDInsideUVM and existing callers reference it
+// through this package.
+const CLONING_DEFAULT_NETWORK_NAMESPACE_ID = uvm.CLONING_DEFAULT_NETWORK_NAMESPACE_ID
+
+// SetCloningNamespaceID overrides the shared network namespace ID
+// SetupNetworkNamespace uses for SharedCloneNamespaceID template/clone UVMs
+// on this process, e.g. so two shim processes on the same host don't collide
+// if their templates' GCS bridge state is ever compared. It returns the
+// previous value. See uvm.SetCloningNamespaceID, which this delegates to.
+func SetCloningNamespaceID(id string) (old string) {
+	return uvm.SetCloningNamespaceID(id)
+}
+
+// CloneNamespaceIDMode selects how SetupNetworkNamespace picks the in-UVM
+// NSID for a template/clone UVM. It's an alias for uvm.CloneNamespaceIDMode,
+// which owns the derivation logic since it needs UtilityVM's private state.
+type CloneNamespaceIDMode = uvm.CloneNamespaceIDMode
+
+const (
+	// SharedCloneNamespaceID (the default) gives every template and clone the
+	// same CLONING_DEFAULT_NETWORK_NAMESPACE_ID inside the UVM. This keeps a
+	// template's GCS bridge state reusable across hosts, but makes clones
+	// indistinguishable from inside the guest when debugging.
+	SharedCloneNamespaceID = uvm.SharedCloneNamespaceID
+	// UniqueCloneNamespaceID derives a deterministic, clone-specific NSID
+	// from the hosting UVM's ID instead of the shared constant, trading the
+	// cross-clone GCS bridge state reuse for easier debugging.
+	UniqueCloneNamespaceID = uvm.UniqueCloneNamespaceID
+)
+
+// ErrTemplateNamespaceMissing is returned by SetupNetworkNamespace and its
+// variants when `hostingSystem` is a clone and the network namespace it
+// should have inherited from its template isn't actually present in the
+// UVM - e.g. because the template's saved state never had it hot-added in
+// the first place. A clone can't create its own namespace the way a normal
+// UVM does; surfacing this up front avoids the confusing AddEndpointsToNS
+// failure that would otherwise follow.
+var ErrTemplateNamespaceMissing = errors.New("clone's UVM is missing the network namespace inherited from its template")
+
+// EndpointRetryPolicy configures how setupNetworkNamespace retries a
+// transient AddEndpointsToNS failure before giving up and falling back to the
+// RemoveNetNS cleanup path.
+type EndpointRetryPolicy struct {
+	// MaxAttempts is the total number of calls to AddEndpointsToNS,
+	// including the first. Values <= 1 disable retries.
+	MaxAttempts int
+	// InitialBackoff is the delay before the first retry. Each subsequent
+	// retry doubles the previous delay.
+	InitialBackoff time.Duration
+}
+
+// defaultEndpointRetryPolicy is used by SetupNetworkNamespace and
+// SetupNetworkNamespaceWithMode.
+var defaultEndpointRetryPolicy = EndpointRetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: 200 * time.Millisecond,
+}
+
+// NamespaceCreateRetryPolicy configures how createNetworkNamespace retries a
+// transient hns.CreateNamespace failure before giving up and failing the
+// container, mirroring EndpointRetryPolicy's shape for the namespace-creation
+// call that precedes it. Unlike EndpointRetryPolicy, each backoff is jittered
+// by JitterFraction, since a busy node retrying many containers' namespace
+// creation at once is exactly the case this exists to help.
+type NamespaceCreateRetryPolicy struct {
+	// MaxAttempts is the total number of calls to hns.CreateNamespace,
+	// including the first. Values <= 1 disable retries.
+	MaxAttempts int
+	// InitialBackoff is the base delay before the first retry, before
+	// jitter is applied. Each subsequent retry doubles the previous base
+	// delay.
+	InitialBackoff time.Duration
+	// JitterFraction randomizes each backoff by up to this fraction in
+	// either direction (e.g. 0.5 spans 0.5x-1.5x of the base delay).
+	// Values <= 0 disable jitter.
+	JitterFraction float64
+}
+
+// defaultNamespaceCreateRetryPolicy is used by createNetworkNamespace.
+// Override with SetNamespaceCreateRetryPolicy.
+var defaultNamespaceCreateRetryPolicy = NamespaceCreateRetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: 100 * time.Millisecond,
+	JitterFraction: 0.5,
+}
+
+// namespaceCreateRetryPolicy is the policy actually in effect; it starts as
+// defaultNamespaceCreateRetryPolicy and is swapped by SetNamespaceCreateRetryPolicy.
+var namespaceCreateRetryPolicy = defaultNamespaceCreateRetryPolicy
+
+// SetNamespaceCreateRetryPolicy overrides the policy createNetworkNamespace
+// uses around hns.CreateNamespace and returns the previous value, so a test
+// (or a host that knows it needs a different policy) can tighten, loosen, or
+// disable it.
+func SetNamespaceCreateRetryPolicy(policy NamespaceCreateRetryPolicy) (old NamespaceCreateRetryPolicy) {
+	old = namespaceCreateRetryPolicy
+	namespaceCreateRetryPolicy = policy
+	return old
+}
+
+// retryCreateNamespace calls createNamespace, retrying with exponential
+// backoff and jitter per namespaceCreateRetryPolicy, but only for errors
+// isTransientNetworkError classifies as transient - anything else, including
+// an unclassified error, is returned immediately rather than delaying a
+// permanent failure.
+func retryCreateNamespace(ctx context.Context) (string, error) {
+	policy := namespaceCreateRetryPolicy
+	attempts := policy.MaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	backoff := policy.InitialBackoff
+	var netID string
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		netID, err = createNamespace()
+		if err == nil {
+			return netID, nil
+		}
+		if attempt == attempts || !isTransientNetworkError(err) {
+			return "", err
+		}
+		log.G(ctx).WithError(err).WithField("attempt", attempt).Warn("transient error creating network namespace, retrying")
+		select {
+		case <-time.After(jitter(backoff, policy.JitterFraction)):
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+		backoff *= 2
+	}
+	return "", err
+}
+
+// jitter randomizes `d` by up to +/-`fraction` (e.g. fraction=0.5 spans
+// 0.5x-1.5x of d), so multiple containers retrying namespace creation at once
+// don't all wake up and hit HNS in lockstep. fraction <= 0 disables jitter
+// and returns d unchanged.
+func jitter(d time.Duration, fraction float64) time.Duration {
+	if fraction <= 0 {
+		return d
+	}
+	delta := (rand.Float64()*2 - 1) * fraction
+	return time.Duration(float64(d) * (1 + delta))
+}
+
+// SetupNetworkNamespace hot-adds network namespace `nsid`, and its endpoints,
+// to `hostingSystem`.
+//
+// If `hostingSystem` is a template or a clone, `nsid` is remapped before
+// being added so the guest-visible namespace ID matches what's baked into the
+// template's GCS bridge state; see CloneNamespaceIDMode. A clone is expected
+// to already have that namespace hot-added, inherited from its template's
+// saved state; if it doesn't, this returns ErrTemplateNamespaceMissing rather
+// than trying to add one itself.
+//
+// `hostingSystem` may be nil for a process-isolated (non-Hyper-V) container,
+// which runs directly on the host with no UVM to hot-add a namespace into;
+// see setupNetworkNamespaceHost. The template/clone NSID remapping above
+// doesn't apply in that case, since there's no UVM's GCS bridge state for it
+// to matter to.
+func SetupNetworkNamespace(ctx context.Context, hostingSystem *uvm.UtilityVM, nsid string) error {
+	return SetupNetworkNamespaceWithMode(ctx, hostingSystem, nsid, SharedCloneNamespaceID)
+}
+
+// SetupNetworkNamespaceWithMode is SetupNetworkNamespace with an explicit
+// CloneNamespaceIDMode for a template/clone hosting system.
+func SetupNetworkNamespaceWithMode(ctx context.Context, hostingSystem *uvm.UtilityVM, nsid string, mode CloneNamespaceIDMode) error {
+	_, err := setupNetworkNamespace(ctx, hostingSystem, nsid, mode, defaultEndpointRetryPolicy, false)
+	return err
+}
+
+// SetupNetworkNamespaceWithRetryPolicy is SetupNetworkNamespaceWithMode with
+// an explicit EndpointRetryPolicy, for callers on nodes busy enough that the
+// default policy isn't aggressive enough.
+func SetupNetworkNamespaceWithRetryPolicy(ctx context.Context, hostingSystem *uvm.UtilityVM, nsid string, mode CloneNamespaceIDMode, policy EndpointRetryPolicy) error {
+	_, err := setupNetworkNamespace(ctx, hostingSystem, nsid, mode, policy, false)
+	return err
+}
+
+// SetupNetworkNamespaceWithVerification is SetupNetworkNamespaceWithMode
+// that, once AddEndpointsToNS reports success, also confirms every endpoint
+// it added is actually recorded as attached before returning - see
+// verifyEndpointsAttached. This costs an extra round trip through the UVM's
+// namespace bookkeeping on every call, so it's opt-in rather than the
+// default; callers that have seen AddEndpointsToNS return success without
+// the endpoint actually taking should set verifyAttachment to true.
+func SetupNetworkNamespaceWithVerification(ctx context.Context, hostingSystem *uvm.UtilityVM, nsid string, mode CloneNamespaceIDMode, verifyAttachment bool) error {
+	_, err := setupNetworkNamespace(ctx, hostingSystem, nsid, mode, defaultEndpointRetryPolicy, verifyAttachment)
+	return err
+}
+
+// NetworkNamespaceSetupResult holds SetupNetworkNamespace's outputs beyond a
+// plain error, for callers that need more than "it worked".
+type NetworkNamespaceSetupResult struct {
+	// NSIDInsideUVM is the namespace ID actually hot-added inside the UVM:
+	// `nsid` itself for a normal UVM, or the remapped template/clone ID
+	// hostingSystem.NetNSIDInsideUVM computed for a template or clone. Zero
+	// value ("") when hostingSystem is nil, since there's no UVM to hot-add
+	// a namespace into.
+	NSIDInsideUVM string
+	// OriginalNamespaceIDs records the real HNS namespace ID each endpoint
+	// reported itself bound to (endpoint.Namespace.ID) before setup ran,
+	// keyed by endpoint ID. Setup itself never rewrites that field - the
+	// template/clone remapping only affects NSIDInsideUVM - but callers have
+	// no other way to see the real per-endpoint binding to reconcile against
+	// it.
+	OriginalNamespaceIDs map[string]string
+	// EndpointNamespaceIDs records, for each endpoint hot-added by this call,
+	// the namespace ID it actually ended up placed in: NSIDInsideUVM for a
+	// normal UVM, the remapped CLONING_DEFAULT_NETWORK_NAMESPACE_ID (or its
+	// UniqueCloneNamespaceID equivalent) for a template/clone, or `nsid`
+	// itself for a process-isolated container with no hosting UVM. A caller
+	// persisting network state for later reattach or debugging should use
+	// this instead of assuming every endpoint shares NSIDInsideUVM verbatim.
+	EndpointNamespaceIDs map[string]string
+}
+
+// SetupNetworkNamespaceWithResult is SetupNetworkNamespaceWithMode, but also
+// returns a NetworkNamespaceSetupResult so a caller - typically the shim,
+// persisting state for a clone - can record which in-UVM NSID a namespace
+// ended up hot-added under, which real HNS namespace each endpoint came
+// from, and which namespace ID each endpoint actually ended up placed in
+// (EndpointNamespaceIDs, reflecting the template/clone remapping), without
+// having to recompute any of it after the fact.
+func SetupNetworkNamespaceWithResult(ctx context.Context, hostingSystem *uvm.UtilityVM, nsid string, mode CloneNamespaceIDMode) (*NetworkNamespaceSetupResult, error) {
+	return setupNetworkNamespace(ctx, hostingSystem, nsid, mode, defaultEndpointRetryPolicy, false)
+}
+
+// SetupNetworkNamespaces hot-adds every namespace in `nsids` to
+// `hostingSystem`, one at a time, sharing the per-namespace work with
+// SetupNetworkNamespace.
+//
+// In SharedCloneNamespaceID mode a template/clone UVM always remaps its
+// namespace ID to the shared CLONING_DEFAULT_NETWORK_NAMESPACE_ID, so setting
+// up more than one namespace on such a UVM would silently collide them into
+// one; that's rejected up front instead. UniqueCloneNamespaceID mode has no
+// such collision since each namespace derives its own in-UVM NSID.
+func SetupNetworkNamespaces(ctx context.Context, hostingSystem *uvm.UtilityVM, nsids []string) error {
+	return setupNetworkNamespaces(ctx, hostingSystem, nsids, SharedCloneNamespaceID)
+}
+
+func setupNetworkNamespaces(ctx context.Context, hostingSystem *uvm.UtilityVM, nsids []string, mode CloneNamespaceIDMode) error {
+	if len(nsids) > 1 && mode == SharedCloneNamespaceID && hostingSystem != nil && (hostingSystem.IsTemplate() || hostingSystem.IsClone()) {
+		return fmt.Errorf("cannot set up %d network namespaces on a template/clone UVM: they would all collide on %s", len(nsids), uvm.CloningNamespaceID())
+	}
+	for _, nsid := range nsids {
+		if _, err := setupNetworkNamespace(ctx, hostingSystem, nsid, mode, defaultEndpointRetryPolicy, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func setupNetworkNamespace(ctx context.Context, hostingSystem *uvm.UtilityVM, nsid string, mode CloneNamespaceIDMode, policy EndpointRetryPolicy, verifyAttachment bool) (*NetworkNamespaceSetupResult, error) {
+	op := "hcsoci::setupNetworkNamespace"
+	l := log.G(ctx).WithField("nsid", nsid)
+	l.Debug(op + " - Begin")
+	defer func() {
+		l.Debug(op + " - End")
+	}()
+
+	if hostingSystem != nil && !hostingSystem.IsTemplate() && !hostingSystem.IsClone() && nsid == uvm.CloningNamespaceID() {
+		return nil, fmt.Errorf("cannot set up network namespace '%s' on a non-template, non-clone UVM: this ID is reserved for template/clone remapping", nsid)
+	}
+
+	endpoints, err := GetNamespaceEndpoints(ctx, nsid)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &NetworkNamespaceSetupResult{OriginalNamespaceIDs: make(map[string]string, len(endpoints))}
+	for _, endpoint := range endpoints {
+		if endpoint.Namespace != nil {
+			result.OriginalNamespaceIDs[endpoint.Id] = endpoint.Namespace.ID
+		}
+	}
+
+	if hostingSystem == nil {
+		result.EndpointNamespaceIDs = make(map[string]string, len(endpoints))
+		for _, endpoint := range endpoints {
+			result.EndpointNamespaceIDs[endpoint.Id] = nsid
+		}
+		return result, setupNetworkNamespaceHost(endpoints)
+	}
+
+	nsidInsideUVM, err := hostingSystem.NetNSIDInsideUVM(nsid, mode)
+	if err != nil {
+		return nil, err
+	}
+	result.NSIDInsideUVM = nsidInsideUVM
+	result.EndpointNamespaceIDs = make(map[string]string, len(endpoints))
+	for _, endpoint := range endpoints {
+		result.EndpointNamespaceIDs[endpoint.Id] = nsidInsideUVM
+	}
+
+	// In a reattach/recovery scenario the namespace may already be present
+	// in the UVM (e.g. from before a shim restart). Check explicitly with
+	// HasNetNS rather than adding and swallowing whatever error comes back,
+	// so a namespace that's missing for a real reason still surfaces one.
+	//
+	// A clone never creates its own namespace: it's expected to already have
+	// inherited nsidInsideUVM from its template's saved state, so a missing
+	// namespace here means that inheritance didn't happen, not that this
+	// clone needs a fresh one hot-added.
+	namespaceCreatedHere := !hostingSystem.HasNetNS(nsidInsideUVM)
+	if namespaceCreatedHere {
+		if hostingSystem.IsClone() {
+			return nil, fmt.Errorf("clone's UVM does not have network namespace '%s': %w", nsidInsideUVM, ErrTemplateNamespaceMissing)
+		}
+		if err := hostingSystem.AddNetNS(ctx, nsidInsideUVM); err != nil {
+			return nil, err
+		}
+	}
+	if len(endpoints) == 0 {
+		// Some HNS versions error confusingly when handed an empty endpoint
+		// slice. There's nothing to add either way, so skip straight past
+		// AddEndpointsToNS - the namespace hot-add above already happened.
+		l.Debug("network namespace has no endpoints, skipping AddEndpointsToNS")
+		return result, nil
+	}
+
+	// rollback undoes only what this call added: the whole namespace if this
+	// call is the one that created it, or just these endpoints if the
+	// namespace - and whatever else was already attached to it - predates
+	// this call (e.g. a reattach after a shim restart). Removing the whole
+	// namespace in that second case would tear down unrelated, already-healthy
+	// endpoints along with the ones this call just tried to add.
+	rollback := func(cause string) {
+		if namespaceCreatedHere {
+			if rerr := hostingSystem.RemoveNetNS(ctx, nsidInsideUVM); rerr != nil {
+				log.G(ctx).WithError(rerr).Warnf("failed to remove network namespace after %s", cause)
+			}
+			return
+		}
+		if rerr := hostingSystem.RemoveEndpointsFromNS(ctx, nsidInsideUVM, endpoints); rerr != nil {
+			log.G(ctx).WithError(rerr).Warnf("failed to remove endpoints from pre-existing network namespace after %s", cause)
+		}
+	}
+
+	addEndpoints := func() error {
+		return hostingSystem.AddEndpointsToNS(ctx, nsidInsideUVM, endpoints)
+	}
+	if err := retryTransient(ctx, policy, addEndpoints); err != nil {
+		rollback("endpoint add failure")
+		return nil, err
+	}
+
+	if verifyAttachment {
+		if err := verifyEndpointsAttached(hostingSystem, nsidInsideUVM, endpoints); err != nil {
+			rollback("attachment verification failure")
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// verifyEndpointsAttached checks that every one of `endpoints` is recorded as
+// attached in `hostingSystem`'s namespace `nsidInsideUVM` after AddEndpointsToNS
+// reports success, returning a descriptive error naming whichever ones aren't.
+// See uvm.UtilityVM.NamespaceEndpointIDs for the scope of what this can and
+// can't catch.
+func verifyEndpointsAttached(hostingSystem *uvm.UtilityVM, nsidInsideUVM string, endpoints []*hns.HNSEndpoint) error {
+	attached, found := hostingSystem.NamespaceEndpointIDs(nsidInsideUVM)
+	if !found {
+		return fmt.Errorf("cannot verify endpoint attachment: network namespace '%s' not found in UVM", nsidInsideUVM)
+	}
+	attachedSet := make(map[string]bool, len(attached))
+	for _, id := range attached {
+		attachedSet[id] = true
+	}
+	var missing []string
+	for _, endpoint := range endpoints {
+		if !attachedSet[endpoint.Id] {
+			missing = append(missing, endpoint.Id)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("endpoint(s) %v reported as added to network namespace '%s' but not found attached", missing, nsidInsideUVM)
+	}
+	return nil
+}
+
+// setupNetworkNamespaceHost wires `endpoints` directly to the host via HNS,
+// for a process-isolated container that has no hosting UVM to hot-add a
+// namespace into.
+func setupNetworkNamespaceHost(endpoints []*hns.HNSEndpoint) error {
+	for _, endpoint := range endpoints {
+		if err := endpoint.HostAttach(0); err != nil {
+			return fmt.Errorf("failed to attach endpoint '%s' to host: %w", endpoint.Id, err)
+		}
+	}
+	return nil
+}
+
+// retryTransient calls `fn` up to `policy.MaxAttempts` times, doubling
+// `policy.InitialBackoff` between attempts, stopping as soon as `fn`
+// succeeds or returns an error isTransientNetworkError classifies as
+// permanent.
+func retryTransient(ctx context.Context, policy EndpointRetryPolicy, fn func() error) error {
+	attempts := policy.MaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	backoff := policy.InitialBackoff
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		err = fn()
+		if err == nil {
+			return nil
+		}
+		if attempt == attempts || !isTransientNetworkError(err) {
+			return err
+		}
+		log.G(ctx).WithError(err).WithField("attempt", attempt).Warn("transient error adding endpoints to network namespace, retrying")
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+	return err
+}
+
+// isTransientNetworkError reports whether `err` is likely to succeed if
+// retried rather than fail the same way again. Context errors and the
+// package's own namespace-state sentinels are always treated as permanent;
+// anything else is transient if hns.ClassifyError categorizes the
+// underlying HNS error as such, or, failing that, if it implements the
+// standard `Temporary() bool` convention (as syscall.Errno, and therefore
+// most HNS/HCS errors not classified by hns.ClassifyError, does).
+func isTransientNetworkError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if errors.Is(err, uvm.ErrNetNSNotFound) || errors.Is(err, uvm.ErrNetNSAlreadyAttached) {
+		return false
+	}
+	if hns.ClassifyError(err) == hns.ErrorCategoryTransient {
+		return true
+	}
+	var t interface{ Temporary() bool }
+	if errors.As(err, &t) {
+		return t.Temporary()
+	}
+	return false
+}
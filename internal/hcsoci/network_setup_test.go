@@ -0,0 +1,19 @@
+package hcsoci
+
+import (
+	"context"
+	"testing"
+)
+
+// TestSetupNetworkNamespaces_NilHostingSystemDoesNotPanic exercises the
+// SharedCloneNamespaceID collision check in setupNetworkNamespaces with a nil
+// hostingSystem and more than one nsid. hostingSystem.IsTemplate()/IsClone()
+// would panic on a nil receiver if called unguarded, so this only asserts
+// that setupNetworkNamespaces returns an error from the (real, HNS-backed)
+// per-namespace setup below instead of panicking.
+func TestSetupNetworkNamespaces_NilHostingSystemDoesNotPanic(t *testing.T) {
+	err := setupNetworkNamespaces(context.Background(), nil, []string{"ns1", "ns2"}, SharedCloneNamespaceID)
+	if err == nil {
+		t.Fatal("expected an error looking up nonexistent namespaces, got nil")
+	}
+}
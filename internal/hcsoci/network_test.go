@@ -0,0 +1,33 @@
+package hcsoci
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/Microsoft/hcsshim/internal/hns"
+	"github.com/Microsoft/hcsshim/internal/uvm"
+)
+
+// TestRemoveNamespaceEndpoint_NotAttachedReturnsDescriptiveError exercises
+// RemoveNamespaceEndpoint's underlying uvm.RemoveEndpointsFromNS call against
+// a fake UtilityVM that has the target namespace but never attached the
+// requested endpoint to it. RemoveNamespaceEndpoint itself first looks the
+// endpoint up in HNS, which this test can't fake without a real HNS backend,
+// so it drives the same not-attached path RemoveNamespaceEndpoint hits once
+// that lookup succeeds.
+func TestRemoveNamespaceEndpoint_NotAttachedReturnsDescriptiveError(t *testing.T) {
+	ctx := context.Background()
+	vm := &uvm.UtilityVM{}
+	if err := vm.AddNetNS(ctx, "ns-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	err := vm.RemoveEndpointsFromNS(ctx, "ns-1", []*hns.HNSEndpoint{{Id: "endpoint-not-attached"}})
+	if err == nil {
+		t.Fatal("expected a descriptive error for an endpoint not attached to the namespace")
+	}
+	if !strings.Contains(err.Error(), "endpoint-not-attached") || !strings.Contains(err.Error(), "ns-1") {
+		t.Fatalf("expected the error to name the endpoint and namespace, got %v", err)
+	}
+}
@@ -0,0 +1,77 @@
+package hns
+
+import (
+	"errors"
+
+	"github.com/Microsoft/hcsshim/internal/hcserror"
+)
+
+// ErrorCategory is a coarse classification of an error returned by an HNS
+// call, so a caller like createNetworkNamespace or SetupNetworkNamespace can
+// decide whether to retry, treat it as already-done, or give up, without
+// threading Win32 error codes through itself.
+type ErrorCategory int
+
+const (
+	// ErrorCategoryUnknown is returned for a nil error, and for an error
+	// ClassifyError doesn't recognize; treat the latter as a permanent
+	// failure.
+	ErrorCategoryUnknown ErrorCategory = iota
+	// ErrorCategoryNotFound means the object the call referenced (endpoint,
+	// network, or namespace) doesn't exist.
+	ErrorCategoryNotFound
+	// ErrorCategoryTransient means the call is likely to succeed if
+	// retried, e.g. the underlying resource was momentarily busy.
+	ErrorCategoryTransient
+	// ErrorCategoryConflict means the call failed because the object or
+	// state it would have created already exists.
+	ErrorCategoryConflict
+	// ErrorCategoryPermission means the call failed because the caller
+	// lacks the rights to perform it.
+	ErrorCategoryPermission
+)
+
+// Well-known Win32 error codes ClassifyError recognizes underneath an HNS
+// call's *hcserror.HcsError, named the same way hcn.ErrorCode's constants
+// are.
+const (
+	errorFileNotFound  = 0x2
+	errorPathNotFound  = 0x3
+	errorAccessDenied  = 0x5
+	errorBusy          = 0xAA
+	errorAlreadyExists = 0xB7
+	errorRetry         = 0x459
+	errorNotFound      = 0x490
+)
+
+// ClassifyError maps an error returned by an HNS call (CreateNamespace,
+// AddNamespaceEndpoint, GetHNSEndpointByID, AddEndpointsToNS, and similar) to
+// a coarse ErrorCategory. It recognizes this package's own typed not-found
+// errors and sentinels directly, and otherwise falls back to the Win32 error
+// code carried by the *hcserror.HcsError an HNS call failure is normally
+// wrapped in.
+func ClassifyError(err error) ErrorCategory {
+	if err == nil {
+		return ErrorCategoryUnknown
+	}
+
+	switch err.(type) {
+	case EndpointNotFoundError, NetworkNotFoundError:
+		return ErrorCategoryNotFound
+	}
+	if errors.Is(err, ErrEndpointAlreadyInNamespace) {
+		return ErrorCategoryConflict
+	}
+
+	switch hcserror.Win32FromError(err) {
+	case errorFileNotFound, errorPathNotFound, errorNotFound:
+		return ErrorCategoryNotFound
+	case errorAlreadyExists:
+		return ErrorCategoryConflict
+	case errorAccessDenied:
+		return ErrorCategoryPermission
+	case errorBusy, errorRetry:
+		return ErrorCategoryTransient
+	}
+	return ErrorCategoryUnknown
+}
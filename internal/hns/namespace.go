@@ -2,12 +2,19 @@ package hns
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path"
 	"strings"
 )
 
+// ErrEndpointAlreadyInNamespace is returned by AddNamespaceEndpoint when the
+// endpoint is already present in the namespace - common on retry after a
+// partial createNetworkNamespace failure - so a caller can treat it as
+// success rather than a hard error. Matchable with errors.Is.
+var ErrEndpointAlreadyInNamespace = errors.New("endpoint already in namespace")
+
 type namespaceRequest struct {
 	IsDefault bool `json:",omitempty"`
 }
@@ -91,12 +98,18 @@ func GetNamespaceEndpoints(id string) ([]string, error) {
 	return endpoints, nil
 }
 
+// AddNamespaceEndpoint adds an endpoint to a namespace. If the endpoint is
+// already in the namespace this returns ErrEndpointAlreadyInNamespace rather
+// than treating it as a hard failure.
 func AddNamespaceEndpoint(id string, endpointID string) error {
 	resource := namespaceResourceRequest{
 		Type: "Endpoint",
 		Data: namespaceEndpointRequest{endpointID},
 	}
 	_, err := issueNamespaceRequest(&id, "POST", "addresource", &resource)
+	if err != nil && strings.Contains(err.Error(), "already exists") {
+		return ErrEndpointAlreadyInNamespace
+	}
 	return err
 }
 
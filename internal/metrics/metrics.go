@@ -0,0 +1,30 @@
+// Package metrics provides a minimal, pluggable hook for recording operation
+// durations without wiring every caller to a specific metrics backend.
+package metrics
+
+import "time"
+
+// Hook records that `op` (e.g. "GenerateTemplateConfig") took `duration` for
+// the UVM identified by `uvmID`.
+type Hook func(op string, uvmID string, duration time.Duration)
+
+// hook is the installed Hook, or nil when none has been set.
+var hook Hook
+
+// SetHook installs `h` as the Hook every Record call is delivered to, and
+// returns the previously installed one so callers (typically tests) can
+// restore it afterwards. Passing nil uninstalls the hook.
+func SetHook(h Hook) Hook {
+	old := hook
+	hook = h
+	return old
+}
+
+// Record delivers (op, uvmID, duration) to the installed Hook. It's a no-op
+// when no hook is installed, so instrumented call sites pay no cost beyond
+// the time.Since they'd want to log anyway.
+func Record(op string, uvmID string, duration time.Duration) {
+	if hook != nil {
+		hook(op, uvmID, duration)
+	}
+}
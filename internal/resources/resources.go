@@ -53,6 +53,60 @@ func (r *Resources) Add(newResources ...ResourceCloser) {
 	r.resources = append(r.resources, newResources...)
 }
 
+// RemoveNetworkEndpoint removes `endpointID` from the tracked
+// NetworkEndpoints resource, if one is present, so a later ReleaseResources
+// call won't try to remove it again.
+func (r *Resources) RemoveNetworkEndpoint(endpointID string) {
+	for _, res := range r.resources {
+		ne, ok := res.(*uvm.NetworkEndpoints)
+		if !ok {
+			continue
+		}
+		for i, id := range ne.EndpointIDs {
+			if id == endpointID {
+				ne.EndpointIDs = append(ne.EndpointIDs[:i], ne.EndpointIDs[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// ReleaseNetworkNamespace releases just the network namespace resource
+// tracked by r: hot-removing the namespace from `vm` if it was ever added
+// there, releasing and removing its tracked NetworkEndpoints entry from
+// r.resources, and clearing r.netNS. It's the symmetric counterpart to
+// createNetworkNamespace's r.Add(&uvm.NetworkEndpoints{...}), for a partial
+// teardown that needs to release the namespace without releasing everything
+// else ReleaseResources would.
+//
+// It's idempotent: called again with nothing left to do (no NetworkEndpoints
+// tracked, or the namespace never added to `vm`) it's a no-op.
+func (r *Resources) ReleaseNetworkNamespace(ctx context.Context, vm *uvm.UtilityVM) error {
+	if vm != nil && r.addedNetNSToVM {
+		if err := vm.RemoveNetNS(ctx, r.netNS); err != nil {
+			return err
+		}
+		r.addedNetNSToVM = false
+	}
+
+	for i, res := range r.resources {
+		if _, ok := res.(*uvm.NetworkEndpoints); !ok {
+			continue
+		}
+		if r.createdNetNS {
+			if err := res.Release(ctx); err != nil {
+				return err
+			}
+			r.createdNetNS = false
+		}
+		r.resources = append(r.resources[:i], r.resources[i+1:]...)
+		break
+	}
+
+	r.netNS = ""
+	return nil
+}
+
 // Resources is the structure returned as part of creating a container. It holds
 // nothing useful to clients, hence everything is lowercased. A client would use
 // it in a call to ReleaseResources to ensure everything is cleaned up when a
@@ -0,0 +1,32 @@
+package resources
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Microsoft/hcsshim/internal/uvm"
+)
+
+// TestReleaseNetworkNamespace_RemovesTrackedNetworkEndpoints creates a
+// namespace's tracked NetworkEndpoints resource and then releases it,
+// asserting the tracked slice no longer contains that entry. createdNetNS is
+// left false so Release doesn't attempt a real HNS call, and vm is nil so
+// there's no UVM to hot-remove the namespace from - this only exercises
+// ReleaseNetworkNamespace's own bookkeeping.
+func TestReleaseNetworkNamespace_RemovesTrackedNetworkEndpoints(t *testing.T) {
+	r := &Resources{netNS: "ns-1"}
+	r.Add(&uvm.NetworkEndpoints{EndpointIDs: []string{"endpoint-1"}, Namespace: "ns-1"})
+
+	if err := r.ReleaseNetworkNamespace(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if r.NetNS() != "" {
+		t.Fatalf("expected NetNS to be cleared, got %q", r.NetNS())
+	}
+	for _, res := range r.resources {
+		if _, ok := res.(*uvm.NetworkEndpoints); ok {
+			t.Fatalf("expected the NetworkEndpoints entry to be removed, got %+v", r.resources)
+		}
+	}
+}
@@ -44,6 +44,10 @@ var (
 
 	// TestDRetryLoop is the timeout for testd retry loop when onlining a SCSI disk in LCOW
 	TestDRetryLoop = defaultTimeoutTestdRetry
+
+	// CloneContainer is the timeout for cloning a container inside a clone
+	// UVM by replaying its settings against the external GCS connection.
+	CloneContainer time.Duration = defaultTimeout
 )
 
 func init() {
@@ -56,6 +60,7 @@ func init() {
 	ExternalCommandToStart = durationFromEnvironment("HCSSHIM_TIMEOUT_EXTERNALCOMMANDSTART", ExternalCommandToStart)
 	ExternalCommandToComplete = durationFromEnvironment("HCSSHIM_TIMEOUT_EXTERNALCOMMANDCOMPLETE", ExternalCommandToComplete)
 	TestDRetryLoop = durationFromEnvironment("HCSSHIM_TIMEOUT_TESTDRETRYLOOP", TestDRetryLoop)
+	CloneContainer = durationFromEnvironment("HCSSHIM_TIMEOUT_CLONECONTAINER", CloneContainer)
 }
 
 func durationFromEnvironment(env string, defaultValue time.Duration) time.Duration {
@@ -0,0 +1,1721 @@
+package uvm
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Microsoft/go-winio/pkg/guid"
+	"github.com/Microsoft/hcsshim/internal/clone"
+	"github.com/Microsoft/hcsshim/internal/cow"
+	"github.com/Microsoft/hcsshim/internal/log"
+	"github.com/Microsoft/hcsshim/internal/metrics"
+	hcsschema "github.com/Microsoft/hcsshim/internal/schema2"
+	"github.com/Microsoft/hcsshim/internal/timeout"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrNoGCSConnection is returned by CloneContainer, and any other method that
+// requires an external GCS connection, when the UVM doesn't have one. Unlike
+// CreateContainer, CloneContainer has no HCS fallback: late-cloning a
+// container is only meaningful against the forked GCS bridge state a clone
+// UVM is created with.
+var ErrNoGCSConnection = errors.New("no external GCS connection")
+
+// ErrAlreadyTemplate is returned by SaveAsTemplate if vm has already been
+// saved as a template. Saving twice would pause an already-paused UVM and
+// hit HCS with a confusing error, so this is checked up front instead.
+var ErrAlreadyTemplate = errors.New("uvm has already been saved as a template")
+
+// ErrCloneProtocolMismatch is returned (wrapped) by CloneContainer when the
+// GCS protocol version negotiated with the guest, at vm.protocol, is older
+// than minCloneContainerProtocol, so this host can't tell whether the guest
+// supports late-cloning a container into it. Match with errors.Is; the
+// concrete error also carries both versions, for diagnosing guest/host skew
+// during a rolling upgrade.
+var ErrCloneProtocolMismatch = errors.New("guest GCS protocol version does not support cloning")
+
+// minCloneContainerProtocol is the oldest negotiated GCS protocol version
+// CloneContainer accepts. Overridable with SetMinCloneContainerProtocol,
+// e.g. by a test standing in for a guest reporting an incompatible version.
+var minCloneContainerProtocol uint32 = 4
+
+// SetMinCloneContainerProtocol overrides minCloneContainerProtocol and
+// returns the previous value, so a caller (typically a test) can restore it
+// afterwards.
+func SetMinCloneContainerProtocol(version uint32) (old uint32) {
+	old = minCloneContainerProtocol
+	minCloneContainerProtocol = version
+	return old
+}
+
+// protocolMismatchError wraps ErrCloneProtocolMismatch with both protocol
+// versions involved.
+type protocolMismatchError struct {
+	required, guest uint32
+}
+
+func (e *protocolMismatchError) Error() string {
+	return fmt.Sprintf("guest GCS protocol version %d does not support cloning (requires at least %d)", e.guest, e.required)
+}
+
+func (e *protocolMismatchError) Is(target error) bool {
+	return target == ErrCloneProtocolMismatch
+}
+
+// CLONING_DEFAULT_NETWORK_NAMESPACE_ID is the default network namespace ID
+// recorded inside a template UVM (and reused, verbatim, by every clone
+// spawned from it) in place of the real HNS namespace ID. Baking in a single
+// well-known ID lets the GCS bridge state captured in the template stay
+// valid for any clone, at the cost of every clone showing the same NSID when
+// debugging inside the guest.
+//
+// Two shim processes on the same host both creating templates would collide
+// on this ID; see SetCloningNamespaceID to give one of them a distinct one.
+const CLONING_DEFAULT_NETWORK_NAMESPACE_ID = "165b1a3c-1524-4b70-b7c8-3f2d6e6b3ac1"
+
+// cloningNamespaceID is the network namespace ID NetNSIDInsideUVM returns in
+// SharedCloneNamespaceID mode. It defaults to
+// CLONING_DEFAULT_NETWORK_NAMESPACE_ID and can be overridden with
+// SetCloningNamespaceID.
+var cloningNamespaceID = CLONING_DEFAULT_NETWORK_NAMESPACE_ID
+
+// CloningNamespaceID returns the network namespace ID currently used for
+// SharedCloneNamespaceID template/clone UVMs on this process: either
+// CLONING_DEFAULT_NETWORK_NAMESPACE_ID or whatever SetCloningNamespaceID last
+// set it to.
+func CloningNamespaceID() string {
+	return cloningNamespaceID
+}
+
+// SetCloningNamespaceID overrides the network namespace ID used for
+// SharedCloneNamespaceID template/clone UVMs on this process, e.g. so two
+// shim processes on the same host don't collide if their templates' GCS
+// bridge state is ever compared. It returns the previous value so a caller
+// can restore it later (e.g. in a test).
+//
+// This only affects namespaces set up from the point it's called onward; a
+// template captured under the old value keeps working, since what matters is
+// that NetNSIDInsideUVM returns the same ID consistently for a given
+// template and its clones, not that the ID matches any particular constant.
+func SetCloningNamespaceID(id string) (old string) {
+	old = cloningNamespaceID
+	cloningNamespaceID = id
+	return old
+}
+
+// cloningNamespaceIDNamespace is the fixed GUID namespace used to derive a
+// per-clone in-UVM NSID with guid.NewV5, so the derivation is deterministic
+// given a UVMID.
+var cloningNamespaceIDNamespace = guid.GUID{Data1: 0x1e2f3a4b, Data2: 0x5c6d, Data3: 0x4e7f, Data4: [8]byte{0x8a, 0x9b, 0xac, 0xbd, 0xce, 0xdf, 0xe0, 0xf1}}
+
+// CloneNamespaceIDMode selects how a template/clone UVM picks the in-UVM
+// NSID for a network namespace.
+type CloneNamespaceIDMode int
+
+const (
+	// SharedCloneNamespaceID (the default) gives every template and clone
+	// the same CLONING_DEFAULT_NETWORK_NAMESPACE_ID inside the UVM. This
+	// keeps a template's GCS bridge state reusable across hosts, but makes
+	// clones indistinguishable from inside the guest when debugging.
+	SharedCloneNamespaceID CloneNamespaceIDMode = iota
+	// UniqueCloneNamespaceID derives a deterministic, clone-specific NSID
+	// from the hosting UVM's ID instead of the shared constant, trading the
+	// cross-clone GCS bridge state reuse for easier debugging.
+	UniqueCloneNamespaceID
+)
+
+// NetNSIDInsideUVM returns the network namespace ID that should be used
+// inside `vm` in place of `nsid`. For a non-template, non-clone UVM this is
+// `nsid` itself; for a template or clone it's remapped according to `mode`
+// so the guest-visible namespace ID matches what's baked into the template's
+// GCS bridge state.
+func (vm *UtilityVM) NetNSIDInsideUVM(nsid string, mode CloneNamespaceIDMode) (string, error) {
+	if !vm.IsTemplate() && !vm.IsClone() {
+		return nsid, nil
+	}
+	if mode == UniqueCloneNamespaceID {
+		derived, err := guid.NewV5(cloningNamespaceIDNamespace, []byte(vm.ID()))
+		if err != nil {
+			return "", fmt.Errorf("failed to derive unique namespace ID for %s: %w", vm.ID(), err)
+		}
+		return derived.String(), nil
+	}
+	return cloningNamespaceID, nil
+}
+
+func init() {
+	// UVMTemplateConfig.Resources is a slice of the Cloneable interface, so
+	// gob needs every concrete implementation registered up front to encode
+	// and decode it.
+	gob.Register(&vsmbShareTemplate{})
+	gob.Register(&scsiMountTemplate{})
+	gob.Register(&vpmemTemplate{})
+	gob.Register(&layerFoldersTemplate{})
+	gob.Register(&NetworkEndpoints{})
+	gob.Register(&vpciDeviceTemplate{})
+	gob.Register(&ramScratchTemplate{})
+	gob.Register(&cimLayerTemplate{})
+}
+
+// Cloneable is implemented by any UVM resource that can be captured into a
+// template config and reproduced on a freshly created clone UVM.
+type Cloneable interface {
+	// Clone recreates the resource inside `vm`, which is a newly created
+	// clone UVM, using `cd` for state that's specific to this particular
+	// clone rather than shared by the whole template.
+	Clone(ctx context.Context, vm *UtilityVM, cd *CloneData) error
+}
+
+// Closer is an optional capability a Cloneable resource can implement to
+// release handles or temporary artifacts it's holding after being collected
+// into a template config - e.g. an open file backing a scratch copy taken for
+// the template. It's asserted for, not required by Cloneable, since most
+// resources (VSMB shares, SCSI mounts, ...) hold nothing beyond what the UVM
+// itself already owns and have nothing to release. saveAsTemplate asserts for
+// it to clean up if a save is aborted partway through.
+type Closer interface {
+	Close(ctx context.Context) error
+}
+
+// ScratchDiskCloneStrategy selects how scsiMountTemplate.Clone reproduces a
+// template's writable scratch disk (a SCSI mount with IsLayer false) on a
+// clone.
+type ScratchDiskCloneStrategy int
+
+const (
+	// FullCopyScratchDisk (the default) attaches the clone's scratch disk at
+	// cd.RemapPath's result unchanged - today's behavior, where the caller
+	// wiring up CloneData is responsible for making sure a full, independent
+	// copy of the template's scratch VHD already exists at that path if one
+	// is needed.
+	FullCopyScratchDisk ScratchDiskCloneStrategy = iota
+	// DifferencingScratchDisk creates a differencing VHD parented on the
+	// template's scratch disk instead, so the clone only stores the blocks
+	// it writes itself rather than a full duplicate of the template's disk.
+	// This requires a differencing-disk creator to be registered with
+	// SetDifferencingDiskCreator; see that function's doc comment.
+	DifferencingScratchDisk
+)
+
+// createDifferencingDisk creates the differencing VHD requested by
+// DifferencingScratchDisk mode. Nil by default: this package has no VHD
+// creation code of its own (that lives with the callers that already depend
+// on a VHD library, e.g. internal/lcow), so a host wanting
+// DifferencingScratchDisk must call SetDifferencingDiskCreator first.
+var createDifferencingDisk func(parentPath, childPath string) error
+
+// SetDifferencingDiskCreator registers the function scsiMountTemplate.Clone
+// calls to create a differencing VHD at childPath parented on parentPath
+// when a CloneData built with DifferencingScratchDisk clones a scratch disk.
+// It returns the previous value so a caller (typically a test) can restore
+// it afterwards.
+func SetDifferencingDiskCreator(fn func(parentPath, childPath string) error) (old func(parentPath, childPath string) error) {
+	old = createDifferencingDisk
+	createDifferencingDisk = fn
+	return old
+}
+
+// createRAMScratch allocates a RAM-backed scratch of `sizeInBytes` inside
+// `vm`, requested by ramScratchTemplate.Clone. Nil by default: this package
+// has no RAM-backed scratch allocation code of its own (that lives with
+// whatever host component knows how to set one up), so a host wanting to
+// clone one must call SetRAMScratchCreator first.
+var createRAMScratch func(ctx context.Context, vm *UtilityVM, sizeInBytes int64) error
+
+// SetRAMScratchCreator registers the function ramScratchTemplate.Clone calls
+// to allocate a clone's RAM-backed scratch. It returns the previous value so
+// a caller (typically a test) can restore it afterwards.
+func SetRAMScratchCreator(fn func(ctx context.Context, vm *UtilityVM, sizeInBytes int64) error) (old func(ctx context.Context, vm *UtilityVM, sizeInBytes int64) error) {
+	old = createRAMScratch
+	createRAMScratch = fn
+	return old
+}
+
+// CloneData carries the state a Cloneable resource needs at clone time that
+// isn't captured by the template itself because it's specific to the clone
+// being created rather than shared by every clone.
+//
+// Aside from ApplyTemplateConfig, this package has no late-clone loop that
+// drives Cloneable.Clone over a template's resources: an out-of-package
+// orchestrator (e.g. the shim) builds a CloneData, typically via
+// NewCloneData, and calls each resource's Clone itself.
+type CloneData struct {
+	// doc is the compute system document used to create the clone.
+	doc *hcsschema.ComputeSystem
+	// scratchFolder is the clone's own scratch space folder on the host.
+	scratchFolder string
+	// uvmID is the ID of the clone UVM being created.
+	uvmID string
+	// remapPath is consulted by RemapPath for a host path a Cloneable
+	// implementation is about to use, e.g. because the clone is being
+	// created on a different host than the template was captured on and the
+	// template's captured host paths (VSMB host paths, scratch folders)
+	// don't apply as-is there. Nil if the clone doesn't need remapping.
+	remapPath func(resourceType, oldPath string) string
+	// scratchDiskStrategy selects how a scratch SCSI mount is reproduced on
+	// the clone; see ScratchDiskCloneStrategy.
+	scratchDiskStrategy ScratchDiskCloneStrategy
+	// progress, if non-nil, is called by a copy-heavy Cloneable
+	// implementation (e.g. scsiMountTemplate.Clone's DifferencingScratchDisk
+	// path) to report how far it's gotten cloning its resource. Resources
+	// that clone instantly are free to ignore it. Nil if the caller
+	// constructing this CloneData didn't ask for progress reporting.
+	progress ProgressReporter
+	// vsmbWritePolicy selects how vsmbShareTemplate.Clone handles a writable
+	// VSMB share; see WritableVSMBClonePolicy.
+	vsmbWritePolicy WritableVSMBClonePolicy
+	// postClone, if non-nil, is called by ReportCloneResult once a
+	// Cloneable resource's Clone has returned, e.g. so a late-clone
+	// orchestrator can register the cloned resource with an external
+	// inventory. Nil if the caller constructing this CloneData didn't ask
+	// for post-clone callbacks.
+	postClone PostCloneCallback
+	// resourceCloneTimeout bounds how long a single Cloneable.Clone call may
+	// run before runBounded aborts it with ErrResourceCloneTimeout. Zero (the
+	// default) means unbounded, matching every Clone implementation's
+	// behavior before NewCloneDataWithResourceTimeout was added.
+	resourceCloneTimeout time.Duration
+}
+
+// PostCloneCallback is invoked by CloneData.ReportCloneResult after a
+// Cloneable resource's Clone method returns. Aside from ApplyTemplateConfig,
+// there's no late-clone loop inside this package to call it automatically
+// (see CloneData's doc comment), so an out-of-package orchestrator driving
+// Cloneable.Clone directly is expected to call ReportCloneResult itself once
+// each Clone call returns. `result` is whatever the orchestrator considers
+// that resource's clone result (nil if it has none); `err` is Clone's own
+// return value.
+type PostCloneCallback func(resource Cloneable, result interface{}, err error)
+
+// WritableVSMBClonePolicy selects how vsmbShareTemplate.Clone handles a VSMB
+// share that was writable on the template: re-adding it unchanged would let
+// multiple clones write through the same host directory, silently
+// corrupting whichever one loses a race.
+type WritableVSMBClonePolicy int
+
+const (
+	// RefuseWritableVSMBShare (the default) fails Clone outright when the
+	// captured share is writable, rather than risk two clones sharing
+	// writable host state.
+	RefuseWritableVSMBShare WritableVSMBClonePolicy = iota
+	// DowngradeWritableVSMBShareToReadOnly re-adds the share read-only
+	// instead of refusing, for a caller that knows its clones only read
+	// through the share (e.g. it was writable on the template only to let
+	// setup scripts populate it) and would rather not fail Clone over it.
+	DowngradeWritableVSMBShareToReadOnly
+)
+
+// ProgressReporter is called by a Cloneable.Clone implementation to report
+// its progress cloning a single resource: `resourceType` is a
+// resourceTypeLabel value (e.g. "scsi-mount") and `fraction` is in [0, 1].
+// The only implementation in this package that reports is
+// scsiMountTemplate.Clone's DifferencingScratchDisk path, which clones in one
+// shot and reports 0 immediately before starting and 1 immediately after
+// finishing, rather than smooth intermediate values; the others don't report
+// at all.
+type ProgressReporter func(resourceType string, fraction float64)
+
+// CloneScratchFolder returns the canonical host scratch folder path for the
+// clone identified by uvmID, for orchestration code that doesn't already have
+// one of its own to pass to NewCloneData - e.g.:
+//
+//	scratchFolder, err := uvm.CloneScratchFolder(uvmID)
+//	cloneData := uvm.NewCloneData(doc, scratchFolder, uvmID)
+//
+// There's no scratch-folder-from-UVMID logic elsewhere in this package to
+// share this with: the non-clone path (create_wcow.go) always takes its
+// scratch folder from the caller-supplied LayerFolders instead of deriving
+// one. This gives clone orchestrators, which have no such folder to begin
+// with, a sensible default rather than requiring them to invent their own
+// layout.
+func CloneScratchFolder(uvmID string) (string, error) {
+	if uvmID == "" {
+		return "", errors.New("uvmID must not be empty")
+	}
+	return filepath.Join(os.TempDir(), "hcsshim", "clones", uvmID), nil
+}
+
+// NewCloneData returns a CloneData ready to be passed to Cloneable.Clone,
+// with no path remapping and FullCopyScratchDisk. It's the only supported
+// way to construct one without a remapper, keeping the struct's fields
+// immutable once built while still letting out-of-package late-cloning
+// orchestrators (e.g. the shim) drive Clone directly.
+func NewCloneData(doc *hcsschema.ComputeSystem, scratchFolder, uvmID string) *CloneData {
+	return NewCloneDataWithRemapper(doc, scratchFolder, uvmID, nil)
+}
+
+// NewCloneDataWithRemapper is NewCloneData with an explicit path-remapping
+// hook: a Cloneable resource that uses a host path (e.g.
+// vsmbShareTemplate.Clone, scsiMountTemplate.Clone) calls CloneData.RemapPath
+// before using it, giving
+// `remapPath` a chance to translate a path captured on the template's host
+// into its equivalent on the clone's host. `remapPath` may be nil, in which
+// case RemapPath returns paths unchanged, same as NewCloneData.
+func NewCloneDataWithRemapper(doc *hcsschema.ComputeSystem, scratchFolder, uvmID string, remapPath func(resourceType, oldPath string) string) *CloneData {
+	return NewCloneDataWithStrategy(doc, scratchFolder, uvmID, remapPath, FullCopyScratchDisk)
+}
+
+// NewCloneDataWithStrategy is NewCloneDataWithRemapper with an explicit
+// ScratchDiskCloneStrategy for how scsiMountTemplate.Clone reproduces a
+// scratch disk, and no progress reporting.
+func NewCloneDataWithStrategy(doc *hcsschema.ComputeSystem, scratchFolder, uvmID string, remapPath func(resourceType, oldPath string) string, strategy ScratchDiskCloneStrategy) *CloneData {
+	return NewCloneDataWithProgress(doc, scratchFolder, uvmID, remapPath, strategy, nil)
+}
+
+// NewCloneDataWithProgress is NewCloneDataWithStrategy with an explicit
+// ProgressReporter that copy-heavy Cloneable implementations invoke as they
+// work. `progress` may be nil, in which case Clone implementations skip
+// reporting entirely, same as NewCloneDataWithStrategy. It defaults to
+// RefuseWritableVSMBShare for how vsmbShareTemplate.Clone handles a writable
+// VSMB share; use NewCloneDataWithVSMBWritePolicy for an explicit choice.
+func NewCloneDataWithProgress(doc *hcsschema.ComputeSystem, scratchFolder, uvmID string, remapPath func(resourceType, oldPath string) string, strategy ScratchDiskCloneStrategy, progress ProgressReporter) *CloneData {
+	return NewCloneDataWithVSMBWritePolicy(doc, scratchFolder, uvmID, remapPath, strategy, progress, RefuseWritableVSMBShare)
+}
+
+// NewCloneDataWithVSMBWritePolicy is NewCloneDataWithProgress with an
+// explicit WritableVSMBClonePolicy for how vsmbShareTemplate.Clone handles a
+// writable VSMB share captured in a template. It defaults to no
+// PostCloneCallback; use NewCloneDataWithPostCloneCallback for one.
+func NewCloneDataWithVSMBWritePolicy(doc *hcsschema.ComputeSystem, scratchFolder, uvmID string, remapPath func(resourceType, oldPath string) string, strategy ScratchDiskCloneStrategy, progress ProgressReporter, vsmbWritePolicy WritableVSMBClonePolicy) *CloneData {
+	return NewCloneDataWithPostCloneCallback(doc, scratchFolder, uvmID, remapPath, strategy, progress, vsmbWritePolicy, nil)
+}
+
+// NewCloneDataWithPostCloneCallback is NewCloneDataWithVSMBWritePolicy with
+// an explicit PostCloneCallback for ReportCloneResult to invoke. `postClone`
+// may be nil, in which case ReportCloneResult is a no-op, same as
+// NewCloneDataWithVSMBWritePolicy. It defaults to no per-resource clone
+// timeout; use NewCloneDataWithResourceTimeout for one.
+func NewCloneDataWithPostCloneCallback(doc *hcsschema.ComputeSystem, scratchFolder, uvmID string, remapPath func(resourceType, oldPath string) string, strategy ScratchDiskCloneStrategy, progress ProgressReporter, vsmbWritePolicy WritableVSMBClonePolicy, postClone PostCloneCallback) *CloneData {
+	return NewCloneDataWithResourceTimeout(doc, scratchFolder, uvmID, remapPath, strategy, progress, vsmbWritePolicy, postClone, 0)
+}
+
+// NewCloneDataWithResourceTimeout is NewCloneDataWithPostCloneCallback with an
+// explicit per-resource clone timeout: every Cloneable.Clone implementation
+// in this package bounds its own work with it via runBounded, so a single
+// slow resource (e.g. a stuck VHD copy) aborts with ErrResourceCloneTimeout
+// instead of blocking the whole clone indefinitely. `resourceTimeout` <= 0
+// means unbounded, same as NewCloneDataWithPostCloneCallback.
+func NewCloneDataWithResourceTimeout(doc *hcsschema.ComputeSystem, scratchFolder, uvmID string, remapPath func(resourceType, oldPath string) string, strategy ScratchDiskCloneStrategy, progress ProgressReporter, vsmbWritePolicy WritableVSMBClonePolicy, postClone PostCloneCallback, resourceTimeout time.Duration) *CloneData {
+	return &CloneData{
+		doc:                  doc,
+		scratchFolder:        scratchFolder,
+		uvmID:                uvmID,
+		remapPath:            remapPath,
+		scratchDiskStrategy:  strategy,
+		progress:             progress,
+		vsmbWritePolicy:      vsmbWritePolicy,
+		postClone:            postClone,
+		resourceCloneTimeout: resourceTimeout,
+	}
+}
+
+// Doc returns the compute system document used to create the clone.
+func (cd *CloneData) Doc() *hcsschema.ComputeSystem {
+	return cd.doc
+}
+
+// ScratchFolder returns the clone's own scratch space folder on the host.
+func (cd *CloneData) ScratchFolder() string {
+	return cd.scratchFolder
+}
+
+// UVMID returns the ID of the clone UVM being created.
+func (cd *CloneData) UVMID() string {
+	return cd.uvmID
+}
+
+// ScratchDiskStrategy returns how a scratch SCSI mount should be reproduced
+// on the clone; see ScratchDiskCloneStrategy.
+func (cd *CloneData) ScratchDiskStrategy() ScratchDiskCloneStrategy {
+	return cd.scratchDiskStrategy
+}
+
+// VSMBWritePolicy returns how vsmbShareTemplate.Clone should handle a
+// writable VSMB share; see WritableVSMBClonePolicy.
+func (cd *CloneData) VSMBWritePolicy() WritableVSMBClonePolicy {
+	return cd.vsmbWritePolicy
+}
+
+// ReportProgress calls cd's ProgressReporter, if one was supplied via
+// NewCloneDataWithProgress, with `resourceType` and `fraction`. It's a no-op
+// if cd has no reporter, so a Cloneable implementation can call it
+// unconditionally rather than checking for nil itself.
+func (cd *CloneData) ReportProgress(resourceType string, fraction float64) {
+	if cd.progress != nil {
+		cd.progress(resourceType, fraction)
+	}
+}
+
+// ResourceCloneTimeout returns the per-resource clone timeout runBounded
+// enforces, or zero if cd has none; see NewCloneDataWithResourceTimeout.
+func (cd *CloneData) ResourceCloneTimeout() time.Duration {
+	return cd.resourceCloneTimeout
+}
+
+// ErrResourceCloneTimeout is returned (wrapped, naming the resource type) by
+// runBounded when a Cloneable resource's Clone call doesn't finish before
+// cd.resourceCloneTimeout, e.g. a stuck VHD copy, rather than letting it
+// block the whole clone indefinitely.
+var ErrResourceCloneTimeout = errors.New("timed out cloning resource")
+
+// runBounded runs fn bounded by cd.resourceCloneTimeout, so a Cloneable.Clone
+// implementation can call it around its own work without checking for a
+// configured timeout itself. If cd has none (the default, zero value), fn
+// runs unbounded exactly as it always has. Otherwise, if fn hasn't returned
+// by the timeout, runBounded returns a wrapped ErrResourceCloneTimeout naming
+// `resourceType` (a resourceTypeLabel value); fn's eventual result is still
+// delivered to the buffered result channel so its goroutine doesn't leak,
+// it's just never read.
+func (cd *CloneData) runBounded(ctx context.Context, resourceType string, fn func(ctx context.Context) error) error {
+	if cd.resourceCloneTimeout <= 0 {
+		return fn(ctx)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cd.resourceCloneTimeout)
+	defer cancel()
+
+	resultCh := make(chan error, 1)
+	go func() {
+		resultCh <- fn(ctx)
+	}()
+
+	select {
+	case err := <-resultCh:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("%s: %w", resourceType, ErrResourceCloneTimeout)
+	}
+}
+
+// ReportCloneResult calls cd's PostCloneCallback, if one was supplied via
+// NewCloneDataWithPostCloneCallback, with `resource`, `result` and `err`.
+// It's a no-op if cd has none, so an out-of-package late-clone orchestrator
+// (see CloneData's doc comment) can call it unconditionally after every
+// Cloneable.Clone call rather than checking for nil itself.
+func (cd *CloneData) ReportCloneResult(resource Cloneable, result interface{}, err error) {
+	if cd.postClone != nil {
+		cd.postClone(resource, result, err)
+	}
+}
+
+// RemapPath translates `oldPath`, a host path captured for a resource of
+// `resourceType` (a resourceTypeLabel value, e.g. "vsmb-share"), into the
+// path that should be used on the clone's host instead, via the remapper
+// NewCloneDataWithRemapper was given. If cd has no remapper, or the
+// remapper is nil, it returns `oldPath` unchanged.
+func (cd *CloneData) RemapPath(resourceType, oldPath string) string {
+	if cd.remapPath == nil {
+		return oldPath
+	}
+	return cd.remapPath(resourceType, oldPath)
+}
+
+// Validate checks that cd has everything a Cloneable.Clone implementation
+// needs - doc, scratchFolder and uvmID must all be populated - returning an
+// error naming what's missing rather than letting Clone fail later with a
+// cryptic nil-pointer or path error. Aside from ApplyTemplateConfig, there's
+// no late-clone loop inside this package that drives Cloneable.Clone (see
+// NewCloneData's doc comment: that's owned by an out-of-package orchestrator
+// such as the shim), so it's on whichever caller builds a CloneData to call
+// this before handing it to Clone.
+func (cd *CloneData) Validate() error {
+	var problems []string
+	if cd.doc == nil {
+		problems = append(problems, "doc is nil")
+	}
+	if cd.scratchFolder == "" {
+		problems = append(problems, "scratchFolder is empty")
+	}
+	if cd.uvmID == "" {
+		problems = append(problems, "uvmID is empty")
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid clone data: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// ReconstructTemplateConfig is a disaster-recovery tool for when the
+// clone-package registry entry for a template has been lost (e.g. a deleted
+// regstate key) but its saved-as-template UVM, vm, is still live and
+// attached: it regenerates the config via GenerateTemplateConfig and
+// re-persists it under templateID via clone.SaveTemplateConfig, exactly as
+// SaveAsTemplate would have. Unlike SaveAsTemplate it doesn't pause or
+// otherwise touch vm - just reads its current resources.
+//
+// Unless overwrite is true, it refuses if a config already exists for
+// templateID, returning an error matching errors.Is(err,
+// clone.ErrTemplateExists), so it can't be used to accidentally clobber an
+// intact config. With overwrite true, the existing config is removed (via
+// clone.RemoveSavedTemplateConfigForce, bypassing the clone-reference-count
+// check) before the reconstructed one is saved.
+func ReconstructTemplateConfig(ctx context.Context, vm *UtilityVM, templateID string, overwrite bool) (*UVMTemplateConfig, error) {
+	exists, err := clone.TemplateExists(ctx, templateID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check for an existing template config for '%s': %w", templateID, err)
+	}
+	if exists && !overwrite {
+		return nil, fmt.Errorf("refusing to reconstruct template config for '%s': %w", templateID, clone.ErrTemplateExists)
+	}
+
+	cfg, err := GenerateTemplateConfig(ctx, vm)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate template config for uvm '%s': %w", vm.id, err)
+	}
+
+	data, err := EncodeTemplateConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode template config for uvm '%s': %w", vm.id, err)
+	}
+
+	if exists {
+		if err := clone.RemoveSavedTemplateConfigForce(ctx, templateID); err != nil {
+			return nil, fmt.Errorf("failed to remove existing template config for '%s' before reconstruction: %w", templateID, err)
+		}
+		invalidateTemplateConfigCache(templateID)
+	}
+	if err := clone.SaveTemplateConfig(ctx, templateID, data); err != nil {
+		return nil, fmt.Errorf("failed to save reconstructed template config for '%s': %w", templateID, err)
+	}
+	invalidateTemplateConfigCache(templateID)
+	return cfg, nil
+}
+
+// MarkAsClone records that vm was created by cloning the template persisted
+// under templateID: it calls clone.RecordCloneCreated so the clone
+// package's own child-tracking (ClonesFromTemplate) agrees with vm on the
+// same template/clone pairing, then, only once that succeeds, sets
+// vm.isClone and vm.templateSourceID so IsClone and TemplateSourceID report
+// it. The out-of-package orchestrator that drives Cloneable.Clone against
+// vm (see NewCloneData) is expected to call this once cloning has
+// succeeded.
+func (vm *UtilityVM) MarkAsClone(ctx context.Context, templateID string) error {
+	if _, err := clone.RecordCloneCreated(ctx, templateID, vm.id); err != nil {
+		return fmt.Errorf("failed to record uvm '%s' as a clone of template '%s': %w", vm.id, templateID, err)
+	}
+	vm.isClone = true
+	vm.templateSourceID = templateID
+	return nil
+}
+
+// UVMTemplateConfig is the persisted, cloneable snapshot of a template UVM's
+// resources. It's produced by GenerateTemplateConfig and later consumed to
+// reproduce those resources on a clone.
+type UVMTemplateConfig struct {
+	// UVMID is the ID of the UVM this config was generated from.
+	UVMID string
+	// Resources holds every resource collected from the template UVM that
+	// knows how to reproduce itself on a clone.
+	Resources []Cloneable
+	// Layers holds the host paths of the container image layers that were
+	// mounted into the template UVM at the time it was captured, so a clone
+	// can reconstitute its read-only layers without the caller tracking them
+	// separately. Configs saved before this field existed decode with a nil
+	// Layers, which callers must treat as "unknown" rather than "no layers".
+	Layers []string
+	// SkippedResources records human-readable descriptions of resources
+	// GenerateTemplateConfigWithMode(..., LenientTemplateGeneration) found
+	// attached to the UVM but couldn't capture because they don't implement
+	// Cloneable. Always empty in StrictTemplateGeneration mode (the
+	// GenerateTemplateConfig default), since that mode never looks at those
+	// resource kinds in the first place.
+	SkippedResources []string
+	// NICs records the NICs SaveAsTemplate hot-removed from the UVM before
+	// saving it (HCS requires a saved compute system to have none attached),
+	// so a caller resuming the template outside of cloning can hot-add
+	// equivalent NICs back. Clones don't use this - NetworkEndpoints.Clone
+	// recreates their NICs from scratch. Nil for configs generated directly
+	// by GenerateTemplateConfig rather than through SaveAsTemplate.
+	NICs []NICSnapshot
+}
+
+// DeepCopy returns a UVMTemplateConfig independent of cfg: mutating the
+// copy's Resources, or any resource inside them, never affects cfg (or vice
+// versa). This lets a caller fetch a template config once and use it to
+// spawn many clones without one clone's Cloneable.Clone mutating shared
+// state out from under another.
+//
+// It works by round-tripping cfg through gob using the same registrations
+// GenerateTemplateConfig's resource types are already registered under, so
+// individual Cloneable implementations don't need their own copy method.
+func (cfg *UVMTemplateConfig) DeepCopy() (*UVMTemplateConfig, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(cfg); err != nil {
+		return nil, fmt.Errorf("failed to deep copy template config: %w", err)
+	}
+	var copied UVMTemplateConfig
+	if err := gob.NewDecoder(&buf).Decode(&copied); err != nil {
+		return nil, fmt.Errorf("failed to deep copy template config: %w", err)
+	}
+	return &copied, nil
+}
+
+// Equal reports whether cfg and other have the same UVMID and the same set
+// of resources, compared by their exported fields and independent of order.
+// It's meant for reconstruction/migration tests asserting a UVMTemplateConfig
+// came back the way it went in, not for detecting every incidental
+// difference - Layers, SkippedResources and NICs aren't compared.
+func (cfg *UVMTemplateConfig) Equal(other *UVMTemplateConfig) bool {
+	if cfg == nil || other == nil {
+		return cfg == other
+	}
+	if cfg.UVMID != other.UVMID {
+		return false
+	}
+	return sameResourceSet(cfg.Resources, other.Resources)
+}
+
+// sameResourceSet reports whether a and b contain the same resources,
+// ignoring order.
+func sameResourceSet(a, b []Cloneable) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	tagsA := make([]string, len(a))
+	for i, r := range a {
+		tagsA[i] = resourceEqualityTag(r)
+	}
+	tagsB := make([]string, len(b))
+	for i, r := range b {
+		tagsB[i] = resourceEqualityTag(r)
+	}
+	sort.Strings(tagsA)
+	sort.Strings(tagsB)
+	for i := range tagsA {
+		if tagsA[i] != tagsB[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// resourceEqualityTag renders r's concrete type and exported fields as a
+// single comparable string, for sameResourceSet's order-independent
+// comparison. It deliberately doesn't go through the
+// resourceTypeLabel/jsonResource wire format MarshalJSON uses, since Equal
+// needs to compare resources MarshalJSON would reject as unrecognized (e.g.
+// an "other" resource from LenientTemplateGeneration) too.
+func resourceEqualityTag(r Cloneable) string {
+	if r == nil {
+		return "<nil>"
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		// Not every Cloneable's fields are guaranteed JSON-marshalable;
+		// %#v still distinguishes distinct field values for those.
+		return fmt.Sprintf("%T:%#v", r, r)
+	}
+	return fmt.Sprintf("%T:%s", r, data)
+}
+
+// FindEquivalentTemplate scans every template persisted via clone.ListTemplates
+// for one that's Equal to cfg, returning its ID, so a caller about to save a
+// new template can skip the save if an equivalent one already exists under a
+// different ID. It returns ("", false, nil) if none matches.
+//
+// The request that prompted this named it clone.FindEquivalentTemplate, but
+// it lives here instead: a persisted template's config is stored as the
+// opaque, undecoded bytes clone.FetchTemplateConfig returns, and only this
+// package - which owns DecodeTemplateConfig, UVMTemplateConfig, and Equal -
+// can turn that back into something comparable. Moving the comparison into
+// package clone would require it to import package uvm, which already
+// imports clone for the template registry this scans.
+//
+// A template whose config fails to decode is skipped rather than treated as
+// an error, on the assumption that a de-dup check shouldn't itself be broken
+// by one unrelated undecodable entry. A template whose config can't be
+// fetched at all (e.g. clone.FetchTemplateConfig reports it corrupt or not
+// yet ready) fails the whole scan with that error.
+func FindEquivalentTemplate(ctx context.Context, cfg *UVMTemplateConfig) (string, bool, error) {
+	ids, err := clone.ListTemplates(ctx)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to list templates: %w", err)
+	}
+	for _, id := range ids {
+		data, err := clone.FetchTemplateConfig(ctx, id)
+		if err != nil {
+			return "", false, fmt.Errorf("failed to fetch template config for '%s': %w", id, err)
+		}
+		other, err := DecodeTemplateConfig(data)
+		if err != nil {
+			continue
+		}
+		if cfg.Equal(other) {
+			return id, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// jsonTemplateConfig is UVMTemplateConfig's JSON wire shape. Resources is
+// replaced with jsonResource so each entry keeps its concrete type tag -
+// naive json.Marshal/Unmarshal on the Cloneable interface would drop it, the
+// same problem DeepCopy avoids for gob by using gob's own type registry.
+type jsonTemplateConfig struct {
+	UVMID            string
+	Resources        []jsonResource
+	Layers           []string
+	SkippedResources []string
+	NICs             []NICSnapshot
+}
+
+// jsonResource pairs a resource's ResourceTypeCounts/ByResourceType label
+// with its JSON-encoded concrete value, so UnmarshalJSON knows which
+// concrete type to decode Data into.
+type jsonResource struct {
+	Type string
+	Data json.RawMessage
+}
+
+// MarshalJSON renders cfg as human-readable JSON, tagging each resource with
+// its resourceTypeLabel so the dump is self-describing. Useful directly for
+// debugging clone issues, and it's also what JSONCodec uses if registered
+// and selected via SetDefaultTemplateCodec for real persistence instead of
+// the gob default. UnmarshalJSON can decode it back into an equivalent
+// UVMTemplateConfig for every resource type resourceTypeLabel recognizes by
+// name (an "other" resource from LenientTemplateGeneration can't round-trip,
+// since its concrete type isn't known here).
+func (cfg *UVMTemplateConfig) MarshalJSON() ([]byte, error) {
+	jc := jsonTemplateConfig{
+		UVMID:            cfg.UVMID,
+		Layers:           cfg.Layers,
+		SkippedResources: cfg.SkippedResources,
+		NICs:             cfg.NICs,
+	}
+	for _, r := range cfg.Resources {
+		if r == nil {
+			continue
+		}
+		label := resourceTypeLabel(r)
+		if label == "other" {
+			return nil, fmt.Errorf("cannot marshal template config to JSON: resource of unrecognized type %T", r)
+		}
+		data, err := json.Marshal(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal %s resource to JSON: %w", label, err)
+		}
+		jc.Resources = append(jc.Resources, jsonResource{Type: label, Data: data})
+	}
+	return json.Marshal(jc)
+}
+
+// UnmarshalJSON decodes JSON produced by MarshalJSON back into cfg,
+// reconstructing each resource's concrete type from its type tag.
+func (cfg *UVMTemplateConfig) UnmarshalJSON(data []byte) error {
+	var jc jsonTemplateConfig
+	if err := json.Unmarshal(data, &jc); err != nil {
+		return err
+	}
+	resources := make([]Cloneable, 0, len(jc.Resources))
+	for _, jr := range jc.Resources {
+		r, err := unmarshalResourceJSON(jr.Type, jr.Data)
+		if err != nil {
+			return err
+		}
+		resources = append(resources, r)
+	}
+	cfg.UVMID = jc.UVMID
+	cfg.Resources = resources
+	cfg.Layers = jc.Layers
+	cfg.SkippedResources = jc.SkippedResources
+	cfg.NICs = jc.NICs
+	return nil
+}
+
+// unmarshalResourceJSON decodes `data` into the concrete Cloneable type named
+// by `resourceType` (a resourceTypeLabel value).
+func unmarshalResourceJSON(resourceType string, data json.RawMessage) (Cloneable, error) {
+	switch resourceType {
+	case "vsmb-share":
+		var t vsmbShareTemplate
+		if err := json.Unmarshal(data, &t); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal vsmb-share resource: %w", err)
+		}
+		return &t, nil
+	case "scsi-mount":
+		var t scsiMountTemplate
+		if err := json.Unmarshal(data, &t); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal scsi-mount resource: %w", err)
+		}
+		return &t, nil
+	case "vpmem":
+		var t vpmemTemplate
+		if err := json.Unmarshal(data, &t); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal vpmem resource: %w", err)
+		}
+		return &t, nil
+	case "layers":
+		var t layerFoldersTemplate
+		if err := json.Unmarshal(data, &t); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal layers resource: %w", err)
+		}
+		return &t, nil
+	case "network-endpoints":
+		var t NetworkEndpoints
+		if err := json.Unmarshal(data, &t); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal network-endpoints resource: %w", err)
+		}
+		return &t, nil
+	case "vpci-device":
+		var t vpciDeviceTemplate
+		if err := json.Unmarshal(data, &t); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal vpci-device resource: %w", err)
+		}
+		return &t, nil
+	case "cim-layer":
+		var t cimLayerTemplate
+		if err := json.Unmarshal(data, &t); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal cim-layer resource: %w", err)
+		}
+		return &t, nil
+	case "ram-scratch":
+		var t ramScratchTemplate
+		if err := json.Unmarshal(data, &t); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal ram-scratch resource: %w", err)
+		}
+		return &t, nil
+	default:
+		return nil, fmt.Errorf("cannot unmarshal template config from JSON: unrecognized resource type %q", resourceType)
+	}
+}
+
+// layerFoldersTemplate is the Cloneable representation of UVMTemplateConfig's
+// Layers: on Clone it re-attaches each layer folder to the clone UVM the same
+// way it was originally attached to the template (VSMB on Windows, VPMem on
+// Linux).
+type layerFoldersTemplate struct {
+	Folders []string
+}
+
+// Clone re-attaches every captured layer folder as a read-only resource on
+// the clone UVM `vm`.
+func (t *layerFoldersTemplate) Clone(ctx context.Context, vm *UtilityVM, cd *CloneData) error {
+	return cd.runBounded(ctx, "layers", func(ctx context.Context) error {
+		for _, folder := range t.Folders {
+			var err error
+			if vm.operatingSystem == "windows" {
+				_, err = vm.AddVSMB(ctx, folder, vm.DefaultVSMBOptions(true))
+			} else {
+				_, err = vm.AddVPMEM(ctx, folder)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to clone layer folder '%s': %w", folder, err)
+			}
+		}
+		return nil
+	})
+}
+
+// mountCimLayer mounts the CimFS combined-layer CIM at `cimPath` read-only
+// into `vm`. It's a package-level var, rather than a direct call into a
+// CimFS mount API, because this tree vendors no CimFS bindings at all (no
+// mount API, no CIM-related types, on any platform) - see cimLayerTemplate's
+// doc comment. It's nil by default, so cimLayerTemplate.Clone fails clearly
+// until a caller with real CimFS support supplies one via SetCimLayerMounter.
+var mountCimLayer func(ctx context.Context, vm *UtilityVM, cimPath string) error
+
+// SetCimLayerMounter overrides the function cimLayerTemplate.Clone calls to
+// re-mount a CimFS combined-layer CIM on a clone, and returns the previous
+// value, so a caller that vendors real CimFS bindings - or a test with a
+// fake one - can supply an implementation.
+func SetCimLayerMounter(fn func(ctx context.Context, vm *UtilityVM, cimPath string) error) (old func(ctx context.Context, vm *UtilityVM, cimPath string) error) {
+	old = mountCimLayer
+	mountCimLayer = fn
+	return old
+}
+
+// cimLayerTemplate is the Cloneable representation of a CimFS combined-layer
+// CIM mounted into a UVM: on Clone it re-mounts the same CIM, read-only, into
+// the clone. It's the CimFS analog of layerFoldersTemplate, for newer UVMs
+// that back their container image layers with a single mounted CIM instead
+// of individually-attached VHD folders.
+//
+// This vendored snapshot has no CimFS mount API of its own (no CIM-related
+// types or bindings anywhere in the tree), so Clone defers to the
+// package-level mountCimLayer var rather than calling one directly; see
+// SetCimLayerMounter. A template saved before this field existed simply has
+// no cimLayerTemplate in its Resources, and decodes/JSON-unmarshal cleanly
+// without one, the same way any other resource type absent from an older
+// config does.
+type cimLayerTemplate struct {
+	CimPath string
+}
+
+// Clone re-mounts t's CIM, read-only, into the clone UVM `vm`.
+func (t *cimLayerTemplate) Clone(ctx context.Context, vm *UtilityVM, cd *CloneData) error {
+	return cd.runBounded(ctx, "cim-layer", func(ctx context.Context) error {
+		if mountCimLayer == nil {
+			return fmt.Errorf("failed to clone CIM layer '%s': no CimFS layer mounter configured, see SetCimLayerMounter", t.CimPath)
+		}
+		if err := mountCimLayer(ctx, vm, t.CimPath); err != nil {
+			return fmt.Errorf("failed to clone CIM layer '%s': %w", t.CimPath, err)
+		}
+		return nil
+	})
+}
+
+// vsmbShareTemplate is the plain-data, gob-friendly representation of a
+// VSMBShare used inside a UVMTemplateConfig. It intentionally excludes the
+// live VSMBShare's *UtilityVM back-reference.
+type vsmbShareTemplate struct {
+	HostPath     string
+	Name         string
+	AllowedFiles []string
+	GuestPath    string
+	ReadOnly     bool
+}
+
+func newVSMBShareTemplate(share *VSMBShare) *vsmbShareTemplate {
+	return &vsmbShareTemplate{
+		HostPath:     share.HostPath,
+		Name:         share.name,
+		AllowedFiles: share.allowedFiles,
+		GuestPath:    share.guestPath,
+		ReadOnly:     share.readOnly,
+	}
+}
+
+// Clone recreates the VSMB share inside the clone UVM `vm`, remapping
+// HostPath via cd.RemapPath first for a clone being created on a different
+// host than the template was captured on.
+//
+// A read-only share is always re-added as-is. A writable share is handled
+// per cd.VSMBWritePolicy instead of being re-added writable unchanged: doing
+// so would let this clone and every other clone from the same template
+// write through the same host directory, silently corrupting whichever one
+// loses a race. See WritableVSMBClonePolicy.
+func (t *vsmbShareTemplate) Clone(ctx context.Context, vm *UtilityVM, cd *CloneData) error {
+	return cd.runBounded(ctx, "vsmb-share", func(ctx context.Context) error {
+		readOnly := t.ReadOnly
+		if !readOnly {
+			switch cd.VSMBWritePolicy() {
+			case DowngradeWritableVSMBShareToReadOnly:
+				log.G(ctx).WithField("hostPath", t.HostPath).Warn("downgrading writable VSMB share to read-only for clone")
+				readOnly = true
+			default:
+				return fmt.Errorf("cannot clone writable VSMB share '%s': sharing it writable across clones risks data corruption, see WritableVSMBClonePolicy", t.HostPath)
+			}
+		}
+		_, err := vm.AddVSMB(ctx, cd.RemapPath("vsmb-share", t.HostPath), vm.DefaultVSMBOptions(readOnly))
+		return err
+	})
+}
+
+// ResourceID returns the share's host path, for ByResourceID.
+func (t *vsmbShareTemplate) ResourceID() string {
+	return t.HostPath
+}
+
+// scsiMountTemplate is the plain-data, gob-friendly representation of a
+// SCSIMount used inside a UVMTemplateConfig.
+type scsiMountTemplate struct {
+	HostPath   string
+	UVMPath    string
+	Controller int
+	LUN        int32
+	IsLayer    bool
+}
+
+func newSCSIMountTemplate(mount *SCSIMount) *scsiMountTemplate {
+	return &scsiMountTemplate{
+		HostPath:   mount.HostPath,
+		UVMPath:    mount.UVMPath,
+		Controller: mount.Controller,
+		LUN:        mount.LUN,
+		IsLayer:    mount.isLayer,
+	}
+}
+
+// Clone recreates the SCSI mount inside the clone UVM `vm`, resolving the
+// host path relative to the clone's own scratch folder for anything that
+// lived under the template's scratch folder, and remapping it via
+// cd.RemapPath for a clone being created on a different host than the
+// template was captured on.
+//
+// If t is a writable scratch disk (IsLayer false) and cd was built with
+// DifferencingScratchDisk, the clone attaches a differencing VHD parented on
+// the template's disk instead of attaching cd.RemapPath's path directly, so
+// the clone only stores the blocks it writes itself. See
+// ScratchDiskCloneStrategy.
+func (t *scsiMountTemplate) Clone(ctx context.Context, vm *UtilityVM, cd *CloneData) error {
+	return cd.runBounded(ctx, "scsi-mount", func(ctx context.Context) error {
+		hostPath := cd.RemapPath("scsi-mount", t.HostPath)
+		if !t.IsLayer && cd.ScratchDiskStrategy() == DifferencingScratchDisk {
+			diffPath, err := t.cloneDifferencingScratchDisk(cd, hostPath)
+			if err != nil {
+				return err
+			}
+			hostPath = diffPath
+		}
+		_, err := vm.AddSCSI(ctx, hostPath, t.UVMPath, false, VMAccessTypeIndividual)
+		return err
+	})
+}
+
+// cloneDifferencingScratchDisk creates, via the createDifferencingDisk hook
+// registered with SetDifferencingDiskCreator, a differencing VHD in cd's
+// scratch folder parented on parentPath, and returns its path.
+func (t *scsiMountTemplate) cloneDifferencingScratchDisk(cd *CloneData, parentPath string) (string, error) {
+	if createDifferencingDisk == nil {
+		return "", fmt.Errorf("cannot clone scratch disk '%s' with DifferencingScratchDisk: no differencing disk creator registered, see SetDifferencingDiskCreator", parentPath)
+	}
+	childPath := filepath.Join(cd.ScratchFolder(), filepath.Base(parentPath))
+	cd.ReportProgress("scsi-mount", 0)
+	if err := createDifferencingDisk(parentPath, childPath); err != nil {
+		return "", fmt.Errorf("failed to create differencing disk for scratch disk '%s': %w", parentPath, err)
+	}
+	cd.ReportProgress("scsi-mount", 1)
+	return childPath, nil
+}
+
+// ResourceID returns the mount's host path, for ByResourceID.
+func (t *scsiMountTemplate) ResourceID() string {
+	return t.HostPath
+}
+
+// vpmemTemplate is the plain-data, gob-friendly representation of a VPMem
+// device used inside a UVMTemplateConfig. It intentionally excludes the live
+// vpmemInfo's refCount, which is only meaningful for the template UVM's own
+// device slot, not a clone's.
+type vpmemTemplate struct {
+	HostPath string
+}
+
+func newVPMemTemplate(dev *vpmemInfo) *vpmemTemplate {
+	return &vpmemTemplate{HostPath: dev.hostPath}
+}
+
+// Clone recreates the VPMem device inside the clone UVM `vm`.
+func (t *vpmemTemplate) Clone(ctx context.Context, vm *UtilityVM, cd *CloneData) error {
+	return cd.runBounded(ctx, "vpmem", func(ctx context.Context) error {
+		_, err := vm.AddVPMEM(ctx, t.HostPath)
+		return err
+	})
+}
+
+// ResourceID returns the device's host path, for ByResourceID.
+func (t *vpmemTemplate) ResourceID() string {
+	return t.HostPath
+}
+
+// vpciDeviceTemplate is the plain-data, gob-friendly representation of a
+// VPCIDevice used inside a UVMTemplateConfig. Hardware passthrough can't
+// literally be copied onto a clone - the clone needs its own equivalent
+// device assigned to it - so unlike vsmbShareTemplate or scsiMountTemplate
+// this only records enough to ask for that assignment again, not to
+// reproduce the original device's state.
+type vpciDeviceTemplate struct {
+	DeviceInstanceID string
+}
+
+func newVPCIDeviceTemplate(dev *VPCIDevice) *vpciDeviceTemplate {
+	return &vpciDeviceTemplate{DeviceInstanceID: dev.deviceInstanceID}
+}
+
+// Clone re-requests an equivalent VPCI device assignment on the clone UVM
+// `vm` via AssignDevice, using the same device instance ID the template had
+// assigned. This only succeeds if a device with that instance ID is
+// available to the clone's host; if none is, the error from AssignDevice is
+// wrapped to name the device the template needed, rather than surfacing an
+// unqualified HCS error.
+func (t *vpciDeviceTemplate) Clone(ctx context.Context, vm *UtilityVM, cd *CloneData) error {
+	return cd.runBounded(ctx, "vpci-device", func(ctx context.Context) error {
+		if _, err := vm.AssignDevice(ctx, t.DeviceInstanceID); err != nil {
+			return fmt.Errorf("failed to assign vpci device '%s' to clone: %w", t.DeviceInstanceID, err)
+		}
+		return nil
+	})
+}
+
+// ResourceID returns the device's instance ID, for ByResourceID.
+func (t *vpciDeviceTemplate) ResourceID() string {
+	return t.DeviceInstanceID
+}
+
+// ramScratchTemplate is the plain-data, gob-friendly representation of a
+// RAM-backed scratch used inside a UVMTemplateConfig. It only records the
+// size: a RAM-backed scratch has no host state to copy, so unlike
+// scsiMountTemplate the clone just needs to allocate an equivalent one of
+// its own.
+type ramScratchTemplate struct {
+	SizeInBytes int64
+}
+
+// Clone allocates a RAM-backed scratch of t.SizeInBytes inside the clone UVM
+// `vm`, via the function registered with SetRAMScratchCreator. If none is
+// registered this returns a descriptive error rather than silently skipping
+// the scratch, the same as scsiMountTemplate.Clone's DifferencingScratchDisk
+// path when no differencing disk creator is registered.
+func (t *ramScratchTemplate) Clone(ctx context.Context, vm *UtilityVM, cd *CloneData) error {
+	return cd.runBounded(ctx, "ram-scratch", func(ctx context.Context) error {
+		if createRAMScratch == nil {
+			return fmt.Errorf("cannot clone RAM-backed scratch of %d bytes: no RAM scratch creator registered, see SetRAMScratchCreator", t.SizeInBytes)
+		}
+		if err := createRAMScratch(ctx, vm, t.SizeInBytes); err != nil {
+			return fmt.Errorf("failed to clone RAM-backed scratch of %d bytes: %w", t.SizeInBytes, err)
+		}
+		vm.SetRAMScratchSize(t.SizeInBytes)
+		return nil
+	})
+}
+
+// CloneReattachCallback is invoked by CloneContainer once a clone's
+// container has finished reattaching, with the container's ID and the
+// result of the reattach (nil on success). See
+// UtilityVM.SetCloneReattachCallback.
+type CloneReattachCallback func(id string, err error)
+
+// SetCloneReattachCallback registers `fn` to be called by CloneContainer
+// with the container ID and result of every reattach on `vm`, e.g. so an
+// orchestrator can log reattach completion or warm caches on clone
+// readiness. It returns the previous callback so a caller (typically a
+// test) can restore it. A nil callback (the default) means CloneContainer
+// doesn't call anything.
+func (vm *UtilityVM) SetCloneReattachCallback(fn CloneReattachCallback) (old CloneReattachCallback) {
+	old = vm.cloneReattachCallback
+	vm.cloneReattachCallback = fn
+	return old
+}
+
+// CloneContainer creates a container inside a clone UVM by replaying
+// `settings` against the UVM's external GCS connection, which is expected to
+// already be forked from the template's bridge state.
+//
+// If `vm` has no external GCS connection this returns ErrNoGCSConnection
+// (matchable with errors.Is) rather than attempting an HCS fallback, since
+// late-cloning only makes sense against a forked GCS bridge.
+//
+// If the GCS protocol version negotiated with the guest is older than
+// minCloneContainerProtocol this returns ErrCloneProtocolMismatch
+// (matchable with errors.Is) instead of forwarding the request, since an
+// older guest may not support the container state a clone replays onto it;
+// see SetMinCloneContainerProtocol.
+//
+// If a callback was registered with SetCloneReattachCallback, it's invoked
+// with `id` and the result of the reattach before CloneContainer returns.
+//
+// The GCS call is bounded by timeout.CloneContainer (overridable via
+// HCSSHIM_TIMEOUT_CLONECONTAINER): if it hasn't returned by then, or ctx is
+// otherwise done first, CloneContainer returns a wrapped ctx.Err() rather
+// than blocking forever on a wedged bridge, via runWithTimeout.
+func (vm *UtilityVM) CloneContainer(ctx context.Context, id string, settings interface{}) (_ cow.Container, err error) {
+	start := time.Now()
+	defer func() { metrics.Record("CloneContainer", vm.id, time.Since(start)) }()
+	defer func() {
+		if vm.cloneReattachCallback != nil {
+			vm.cloneReattachCallback(id, err)
+		}
+	}()
+
+	if vm.gc == nil {
+		return nil, fmt.Errorf("failed to clone container %s: %w", id, ErrNoGCSConnection)
+	}
+	if vm.protocol < minCloneContainerProtocol {
+		return nil, fmt.Errorf("failed to clone container %s: %w", id, &protocolMismatchError{required: minCloneContainerProtocol, guest: vm.protocol})
+	}
+
+	c, err := runWithTimeout(ctx, timeout.CloneContainer, func(ctx context.Context) (cow.Container, error) {
+		return vm.gc.CreateContainer(ctx, id, settings)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to clone container %s: %w", id, err)
+	}
+	return c, nil
+}
+
+// containerResult is runWithTimeout's channel payload.
+type containerResult struct {
+	c   cow.Container
+	err error
+}
+
+// runWithTimeout runs fn, bounded by ctx as narrowed by `d`, in its own
+// goroutine, so a fn that ignores ctx cancellation internally still can't
+// block the caller past the deadline. If fn hasn't returned by then,
+// runWithTimeout returns ctx.Err() immediately; fn's eventual result is
+// still delivered to the buffered result channel so its goroutine doesn't
+// leak, it's just never read.
+func runWithTimeout(ctx context.Context, d time.Duration, fn func(ctx context.Context) (cow.Container, error)) (cow.Container, error) {
+	ctx, cancel := context.WithTimeout(ctx, d)
+	defer cancel()
+
+	resultCh := make(chan containerResult, 1)
+	go func() {
+		c, err := fn(ctx)
+		resultCh <- containerResult{c, err}
+	}()
+
+	select {
+	case res := <-resultCh:
+		return res.c, res.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// TemplateGenerationMode controls how GenerateTemplateConfigWithMode handles
+// resource kinds it doesn't already know are cloneable.
+type TemplateGenerationMode int
+
+const (
+	// StrictTemplateGeneration (the GenerateTemplateConfig default) only
+	// collects the resource kinds known to always implement Cloneable
+	// (VSMB, SCSI, VPMem, layers, VPCI devices, RAM-backed scratch, CimFS
+	// layers); every other resource kind
+	// attached to the UVM is left uncollected.
+	StrictTemplateGeneration TemplateGenerationMode = iota
+	// LenientTemplateGeneration additionally attempts every other resource
+	// kind attached to the UVM. A resource that doesn't implement Cloneable
+	// is logged and recorded in the resulting config's SkippedResources
+	// instead of failing the whole capture, so callers can decide for
+	// themselves whether the degraded template is acceptable. There are no
+	// such resource kinds today - every kind this package tracks on a UVM
+	// implements Cloneable one way or another - so this currently behaves
+	// the same as StrictTemplateGeneration.
+	LenientTemplateGeneration
+)
+
+// GenerateTemplateConfig is GenerateTemplateConfigWithMode with
+// StrictTemplateGeneration.
+func GenerateTemplateConfig(ctx context.Context, vm *UtilityVM) (*UVMTemplateConfig, error) {
+	return GenerateTemplateConfigWithMode(ctx, vm, StrictTemplateGeneration)
+}
+
+// GenerateTemplateConfigWithMode is GenerateTemplateConfigWithOptions with no
+// resource-type filtering: every resource kind GenerateTemplateConfigOptions
+// could restrict is included.
+func GenerateTemplateConfigWithMode(ctx context.Context, vm *UtilityVM, mode TemplateGenerationMode) (*UVMTemplateConfig, error) {
+	return GenerateTemplateConfigWithOptions(ctx, vm, GenerateTemplateConfigOptions{Mode: mode})
+}
+
+// GenerateTemplateConfigOptions controls GenerateTemplateConfigWithOptions.
+type GenerateTemplateConfigOptions struct {
+	Mode TemplateGenerationMode
+	// IncludeResourceTypes, if non-empty, restricts the returned config to
+	// only these resourceTypeLabel categories (e.g. "scsi-mount",
+	// "vsmb-share") - every other category attached to the UVM is left
+	// uncollected. A nil or empty slice includes every category, the
+	// default behavior of GenerateTemplateConfig/GenerateTemplateConfigWithMode.
+	IncludeResourceTypes []string
+	// ExcludeResourceTypes drops these resourceTypeLabel categories even if
+	// IncludeResourceTypes would otherwise select them, or if
+	// IncludeResourceTypes is empty and everything would otherwise be
+	// included. Useful for e.g. templating a UVM's SCSI mounts while
+	// deliberately excluding VSMB shares that are remapped differently at
+	// clone time.
+	ExcludeResourceTypes []string
+}
+
+// wantResourceType reports whether opts selects `label` for inclusion in the
+// generated config, applying ExcludeResourceTypes after IncludeResourceTypes
+// so an overlapping exclude always wins.
+func (opts GenerateTemplateConfigOptions) wantResourceType(label string) bool {
+	if len(opts.IncludeResourceTypes) > 0 && !containsString(opts.IncludeResourceTypes, label) {
+		return false
+	}
+	return !containsString(opts.ExcludeResourceTypes, label)
+}
+
+func containsString(haystack []string, needle string) bool {
+	for _, s := range haystack {
+		if s == needle {
+			return true
+		}
+	}
+	return false
+}
+
+// GenerateTemplateConfigWithOptions walks `vm`'s VSMB, SCSI, VPMem, layer
+// folder, VPCI device, CimFS layer and RAM-backed scratch resources, and, in
+// LenientTemplateGeneration
+// mode, every
+// other resource kind attached to it, and returns a UVMTemplateConfig that
+// can later be used
+// to reproduce them on a clone. opts.IncludeResourceTypes/ExcludeResourceTypes
+// narrow which resource categories are collected; see
+// GenerateTemplateConfigOptions.
+// The collection loops run under vm.m, the same lock every resource-map
+// mutator (AddVSMB, AddSCSI, and their removal counterparts) takes, so
+// the returned config is a consistent point-in-time snapshot even against a
+// live VM with hot-add/hot-remove in flight.
+func GenerateTemplateConfigWithOptions(ctx context.Context, vm *UtilityVM, opts GenerateTemplateConfigOptions) (*UVMTemplateConfig, error) {
+	op := "uvm::GenerateTemplateConfig"
+	start := time.Now()
+	l := log.G(ctx).WithField("uvm-id", vm.id)
+	l.Debug(op + " - Begin")
+	defer func() {
+		l.Debug(op + " - End")
+	}()
+
+	vm.m.Lock()
+	defer vm.m.Unlock()
+
+	cfg := &UVMTemplateConfig{UVMID: vm.id}
+	if opts.wantResourceType("vsmb-share") {
+		for _, share := range vm.vsmbDirShares {
+			cfg.Resources = append(cfg.Resources, newVSMBShareTemplate(share))
+		}
+		for _, share := range vm.vsmbFileShares {
+			cfg.Resources = append(cfg.Resources, newVSMBShareTemplate(share))
+		}
+	}
+	if opts.wantResourceType("scsi-mount") {
+		for _, controller := range vm.scsiLocations {
+			for _, mount := range controller {
+				if mount != nil {
+					cfg.Resources = append(cfg.Resources, newSCSIMountTemplate(mount))
+				}
+			}
+		}
+	}
+	if opts.wantResourceType("vpmem") {
+		for _, dev := range vm.vpmemDevices {
+			if dev != nil {
+				cfg.Resources = append(cfg.Resources, newVPMemTemplate(dev))
+			}
+		}
+	}
+	if opts.wantResourceType("layers") && len(vm.layerFolders) > 0 {
+		cfg.Layers = append([]string(nil), vm.layerFolders...)
+		cfg.Resources = append(cfg.Resources, &layerFoldersTemplate{Folders: cfg.Layers})
+	}
+	if opts.wantResourceType("vpci-device") {
+		for _, dev := range vm.vpciDevices {
+			if dev != nil {
+				cfg.Resources = append(cfg.Resources, newVPCIDeviceTemplate(dev))
+			}
+		}
+	}
+	if opts.wantResourceType("ram-scratch") && vm.ramScratchSizeInBytes > 0 {
+		cfg.Resources = append(cfg.Resources, &ramScratchTemplate{SizeInBytes: vm.ramScratchSizeInBytes})
+	}
+	if opts.wantResourceType("cim-layer") {
+		for _, cim := range vm.cimLayers {
+			cfg.Resources = append(cfg.Resources, &cimLayerTemplate{CimPath: cim})
+		}
+	}
+	elapsed := time.Since(start)
+	l.WithFields(logrus.Fields{
+		"resource-count":       len(cfg.Resources),
+		"resource-type-counts": cfg.ResourceTypeCounts(),
+		"skipped-count":        len(cfg.SkippedResources),
+		"duration":             elapsed,
+	}).Info("generated template config")
+	metrics.Record("GenerateTemplateConfig", vm.id, elapsed)
+	return cfg, nil
+}
+
+// ResourceTypeCounts summarizes cfg.Resources by resource-type label (see
+// resourceTypeLabel, e.g. "vsmb-share", "scsi-mount", "vpmem", "layers") to
+// count, for operators who want visibility
+// into what a template captured without decoding the opaque config. Like the
+// collection loops in GenerateTemplateConfig, it only counts non-nil entries.
+func (cfg *UVMTemplateConfig) ResourceTypeCounts() map[string]int {
+	counts := make(map[string]int)
+	for _, r := range cfg.Resources {
+		if r == nil {
+			continue
+		}
+		counts[resourceTypeLabel(r)]++
+	}
+	return counts
+}
+
+// resourceTypeLabel returns the ResourceTypeCounts/ByResourceType label for
+// r's concrete type.
+func resourceTypeLabel(r Cloneable) string {
+	switch r.(type) {
+	case *vsmbShareTemplate:
+		return "vsmb-share"
+	case *scsiMountTemplate:
+		return "scsi-mount"
+	case *vpmemTemplate:
+		return "vpmem"
+	case *layerFoldersTemplate:
+		return "layers"
+	case *NetworkEndpoints:
+		return "network-endpoints"
+	case *vpciDeviceTemplate:
+		return "vpci-device"
+	case *ramScratchTemplate:
+		return "ram-scratch"
+	case *cimLayerTemplate:
+		return "cim-layer"
+	default:
+		return "other"
+	}
+}
+
+// identifiableResource is implemented by Cloneable resources that expose a
+// human-meaningful identifier (e.g. a host path) for selecting individual
+// resources with ByResourceID. Optional, the same way Temporary() bool is an
+// optional convention elsewhere in this codebase: a Cloneable that doesn't
+// implement it just can't be selected by ID, only by type.
+type identifiableResource interface {
+	ResourceID() string
+}
+
+// SelectResources returns the subset of cfg.Resources for which `keep`
+// returns true, preserving their original relative order.
+//
+// Order is preserved, not just for cosmetics: a caller applying the result
+// to a clone via Cloneable.Clone must still supply full CloneData (Doc,
+// ScratchFolder, UVMID), and while none of the resource kinds defined in
+// this package depend on another resource in the same UVMTemplateConfig
+// having already been cloned, filtering down to a subset must not be the
+// thing that introduces such a dependency's ordering bug later - so
+// SelectResources itself never reorders.
+func (cfg *UVMTemplateConfig) SelectResources(keep func(Cloneable) bool) []Cloneable {
+	var selected []Cloneable
+	for _, r := range cfg.Resources {
+		if r != nil && keep(r) {
+			selected = append(selected, r)
+		}
+	}
+	return selected
+}
+
+// ByResourceType returns a SelectResources predicate matching resources whose
+// ResourceTypeCounts label is one of `kinds`, e.g. ByResourceType("vsmb-share").
+func ByResourceType(kinds ...string) func(Cloneable) bool {
+	want := make(map[string]bool, len(kinds))
+	for _, k := range kinds {
+		want[k] = true
+	}
+	return func(r Cloneable) bool {
+		return want[resourceTypeLabel(r)]
+	}
+}
+
+// ByResourceID returns a SelectResources predicate matching resources that
+// implement identifiableResource and whose ResourceID() is one of `ids`.
+// Resources that don't implement identifiableResource never match.
+func ByResourceID(ids ...string) func(Cloneable) bool {
+	want := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		want[id] = true
+	}
+	return func(r Cloneable) bool {
+		idr, ok := r.(identifiableResource)
+		return ok && want[idr.ResourceID()]
+	}
+}
+
+// prioritizedResource is implemented by a Cloneable resource whose Clone must
+// run before or after other resources', e.g. because it depends on state a
+// differently-ordered resource's own Clone sets up. Lower Priority() values
+// clone first. This is deliberately not part of Cloneable itself: none of
+// the resource kinds in this package need it today (see SelectResources'
+// doc comment), so adding it there would force every implementation to
+// carry a method it doesn't use.
+type prioritizedResource interface {
+	Priority() int
+}
+
+// PriorityDefault is the clone-ordering priority OrderedResources assigns a
+// resource that doesn't implement prioritizedResource.
+const PriorityDefault = 0
+
+// OrderedResources returns cfg.Resources sorted by ascending Priority()
+// (resources that don't implement prioritizedResource are treated as
+// PriorityDefault), stable so resources sharing a priority keep their
+// relative order from cfg.Resources. A late-clone orchestrator driving
+// Cloneable.Clone directly (see CloneData's doc comment) should iterate this
+// instead of cfg.Resources whenever a future resource kind's Clone depends
+// on another resource in the same config having already run.
+func (cfg *UVMTemplateConfig) OrderedResources() []Cloneable {
+	ordered := append([]Cloneable(nil), cfg.Resources...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return resourcePriority(ordered[i]) < resourcePriority(ordered[j])
+	})
+	return ordered
+}
+
+// ApplyTemplateConfig is a convenience implementation of the late-clone loop
+// CloneData's doc comment otherwise leaves to an out-of-package orchestrator:
+// it calls Clone, in OrderedResources order, for every resource in cfg
+// against the already-existing UVM `vm`, reporting each result via
+// cd.ReportCloneResult the same way a hand-rolled orchestrator loop would.
+// This suits a caller layering a template's shares and mounts onto a
+// custom-built VM it assembled some other way, rather than one
+// GenerateTemplateConfig captured.
+//
+// Like any Clone caller, it only ever calls resource.Clone(ctx, vm, cd) -
+// it never reads or mutates vm's own state itself, since a Cloneable's Clone
+// implementation is solely responsible for both applying its resource to vm
+// and recording whatever vm-side state that requires (e.g.
+// ramScratchTemplate.Clone's SetRAMScratchSize).
+//
+// It stops at the first error, wrapped with the failing resource's type
+// label, leaving vm with whichever earlier resources already cloned
+// successfully still applied.
+func ApplyTemplateConfig(ctx context.Context, cfg *UVMTemplateConfig, vm *UtilityVM, cd *CloneData) error {
+	for _, r := range cfg.OrderedResources() {
+		err := r.Clone(ctx, vm, cd)
+		cd.ReportCloneResult(r, nil, err)
+		if err != nil {
+			return fmt.Errorf("failed to apply %s resource from template: %w", resourceTypeLabel(r), err)
+		}
+	}
+	return nil
+}
+
+func resourcePriority(r Cloneable) int {
+	if p, ok := r.(prioritizedResource); ok {
+		return p.Priority()
+	}
+	return PriorityDefault
+}
+
+// ValidateTemplateResources returns an aggregated error naming every
+// resource attached to `vm` that GenerateTemplateConfig wouldn't be able to
+// capture into a Cloneable template resource. This lets a save-as-template
+// flow fail fast instead of producing a template that later turns out to be
+// only partially cloneable.
+//
+// Every resource kind GenerateTemplateConfig collects today - VSMB, SCSI,
+// VPMem, layers, VPCI, RAM-backed scratch, CimFS layers - is always
+// convertible, so this currently always
+// returns nil; it exists as a fail-fast check for whatever future resource
+// kind might not be. Plan9 shares aren't tracked on the UVM itself (callers
+// own the returned Plan9Share), so they can't be validated here.
+func ValidateTemplateResources(ctx context.Context, vm *UtilityVM) error {
+	return nil
+}
+
+// pauseResumer is the subset of *hcs.System that SaveAsTemplate needs.
+// Tests substitute a fake to exercise the Resume-on-failure path without a
+// real HCS system to pause.
+type pauseResumer interface {
+	Pause(ctx context.Context) error
+	Resume(ctx context.Context) error
+}
+
+// closeTemplateResources releases every resource in cfg that implements
+// Closer, best-effort: a Close failure is only logged, not returned, since
+// the caller is already unwinding a failed save and has no better error to
+// report than the one it already has.
+func closeTemplateResources(ctx context.Context, cfg *UVMTemplateConfig) {
+	for _, resource := range cfg.Resources {
+		closer, ok := resource.(Closer)
+		if !ok {
+			continue
+		}
+		if err := closer.Close(ctx); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to close template resource during aborted save")
+		}
+	}
+}
+
+// SaveAsTemplate pauses vm, captures its template config, and persists it
+// under templateID via clone.SaveTemplateConfigWithAnnotations, leaving vm
+// paused on success (a paused UVM can't be used again; the caller owns
+// tearing it down). If it fails after the pause - whether generating the
+// template config or persisting it - it reattaches any NICs RemoveAllNICs
+// already removed (see ReattachNICs) and then attempts to resume vm so the
+// caller can retry or keep running it, wrapping any resume failure together
+// with the original error rather than losing it. If the NICs themselves
+// can't be reattached, vm is left paused and half-dismantled rather than
+// resumed with no network connectivity - the caller should call
+// DiscardTemplate rather than retry.
+//
+// Calling SaveAsTemplate again on a vm that was already saved returns
+// ErrAlreadyTemplate without touching sys; see IsTemplate.
+func (vm *UtilityVM) SaveAsTemplate(ctx context.Context, templateID string, annotations map[string]string) error {
+	return saveAsTemplate(ctx, vm, vm.hcsSystem, templateID, annotations)
+}
+
+func saveAsTemplate(ctx context.Context, vm *UtilityVM, sys pauseResumer, templateID string, annotations map[string]string) (err error) {
+	if vm.IsTemplate() {
+		return ErrAlreadyTemplate
+	}
+
+	if err := sys.Pause(ctx); err != nil {
+		return fmt.Errorf("failed to pause uvm '%s' for save-as-template: %w", vm.id, err)
+	}
+	var cfg *UVMTemplateConfig
+	var nics []NICSnapshot
+	defer func() {
+		if err != nil {
+			if cfg != nil {
+				closeTemplateResources(ctx, cfg)
+			}
+			if len(nics) > 0 {
+				if rerr := vm.ReattachNICs(ctx, nics); rerr != nil {
+					err = fmt.Errorf("%w (and failed to reattach nics to uvm '%s' after the failed save, leaving it paused rather than resuming with no network connectivity - see DiscardTemplate: %s)", err, vm.id, rerr)
+					return
+				}
+			}
+			if rerr := sys.Resume(ctx); rerr != nil {
+				err = fmt.Errorf("%w (and failed to resume uvm '%s' after the failed save: %s)", err, vm.id, rerr)
+			}
+		}
+	}()
+
+	nics, err = vm.RemoveAllNICs(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to remove nics from uvm '%s' for save-as-template: %w", vm.id, err)
+	}
+
+	cfg, err = GenerateTemplateConfig(ctx, vm)
+	if err != nil {
+		return fmt.Errorf("failed to generate template config for uvm '%s': %w", vm.id, err)
+	}
+	cfg.NICs = nics
+
+	data, err := EncodeTemplateConfig(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to encode template config for uvm '%s': %w", vm.id, err)
+	}
+
+	if err := clone.SaveTemplateConfigWithAnnotations(ctx, templateID, data, annotations); err != nil {
+		return fmt.Errorf("failed to save template config for uvm '%s': %w", vm.id, err)
+	}
+	invalidateTemplateConfigCache(templateID)
+	vm.isTemplate = true
+	return nil
+}
+
+// terminator is the subset of *hcs.System that DiscardTemplate needs. Tests
+// substitute a fake to exercise it without a real HCS system to terminate.
+type terminator interface {
+	Terminate(ctx context.Context) error
+}
+
+// DiscardTemplate is the error-recovery counterpart to SaveAsTemplate for a
+// vm that a failed save has left half-dismantled - e.g. RemoveAllNICs
+// already ran but SaveTemplateConfigWithAnnotations never completed. Since
+// there's no way to tell from the half-dismantled state alone whether such a
+// vm is still safely resumable, DiscardTemplate force-terminates it rather
+// than trying to recover it, and removes any config that did make it to the
+// store under templateID before the failure, via
+// clone.RemoveSavedTemplateConfigIfExists. It runs both steps regardless of
+// whether the other fails, combining their errors rather than either one
+// short-circuiting the other.
+func (vm *UtilityVM) DiscardTemplate(ctx context.Context, templateID string) error {
+	return discardTemplate(ctx, vm.hcsSystem, templateID)
+}
+
+func discardTemplate(ctx context.Context, sys terminator, templateID string) error {
+	var errs []string
+	if err := sys.Terminate(ctx); err != nil {
+		errs = append(errs, fmt.Sprintf("failed to terminate uvm: %s", err))
+	}
+	if _, err := clone.RemoveSavedTemplateConfigIfExists(ctx, templateID); err != nil {
+		errs = append(errs, fmt.Sprintf("failed to remove template config for '%s': %s", templateID, err))
+	}
+	invalidateTemplateConfigCache(templateID)
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to discard template: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
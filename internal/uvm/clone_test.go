@@ -0,0 +1,2377 @@
+package uvm
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Microsoft/go-winio/pkg/guid"
+	"github.com/Microsoft/hcsshim/internal/clone"
+	"github.com/Microsoft/hcsshim/internal/cow"
+	"github.com/Microsoft/hcsshim/internal/hns"
+	"github.com/Microsoft/hcsshim/internal/metrics"
+	hcsschema "github.com/Microsoft/hcsshim/internal/schema2"
+)
+
+func TestUVMTemplateConfig_LayersRoundTrip(t *testing.T) {
+	cfg := &UVMTemplateConfig{
+		UVMID:  "template-1",
+		Layers: []string{`C:\layers\1`, `C:\layers\2`},
+		Resources: []Cloneable{
+			&layerFoldersTemplate{Folders: []string{`C:\layers\1`, `C:\layers\2`}},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded UVMTemplateConfig
+	if err := gob.NewDecoder(&buf).Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded.UVMID != cfg.UVMID {
+		t.Fatalf("got UVMID %q, want %q", decoded.UVMID, cfg.UVMID)
+	}
+	if len(decoded.Layers) != len(cfg.Layers) {
+		t.Fatalf("got %d layers, want %d", len(decoded.Layers), len(cfg.Layers))
+	}
+	for i := range cfg.Layers {
+		if decoded.Layers[i] != cfg.Layers[i] {
+			t.Fatalf("layer %d: got %q, want %q", i, decoded.Layers[i], cfg.Layers[i])
+		}
+	}
+}
+
+func TestUVMTemplateConfig_OldConfigWithoutLayersDecodesToNil(t *testing.T) {
+	// Simulates a config encoded before the Layers field existed: encode a
+	// struct with only the fields that predate it, then decode into the
+	// current UVMTemplateConfig and confirm Layers comes back nil rather than
+	// erroring.
+	type oldUVMTemplateConfig struct {
+		UVMID     string
+		Resources []Cloneable
+	}
+
+	old := &oldUVMTemplateConfig{UVMID: "template-old"}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(old); err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded UVMTemplateConfig
+	if err := gob.NewDecoder(&buf).Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.UVMID != old.UVMID {
+		t.Fatalf("got UVMID %q, want %q", decoded.UVMID, old.UVMID)
+	}
+	if decoded.Layers != nil {
+		t.Fatalf("expected nil Layers for an old config, got %v", decoded.Layers)
+	}
+}
+
+func TestUVMTemplateConfig_JSONRoundTrip(t *testing.T) {
+	cfg := &UVMTemplateConfig{
+		UVMID: "template-json",
+		Resources: []Cloneable{
+			&vsmbShareTemplate{
+				HostPath:     `C:\shares\1`,
+				Name:         "share1",
+				AllowedFiles: []string{"a.txt", "b.txt"},
+				GuestPath:    `C:\guest\1`,
+				ReadOnly:     true,
+			},
+			&scsiMountTemplate{
+				HostPath:   `C:\scratch\scsi.vhdx`,
+				UVMPath:    `C:\guest\scsi`,
+				Controller: 0,
+				LUN:        1,
+				IsLayer:    false,
+			},
+		},
+	}
+
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded UVMTemplateConfig
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded.UVMID != cfg.UVMID {
+		t.Fatalf("got UVMID %q, want %q", decoded.UVMID, cfg.UVMID)
+	}
+	if len(decoded.Resources) != len(cfg.Resources) {
+		t.Fatalf("got %d resources, want %d", len(decoded.Resources), len(cfg.Resources))
+	}
+	share, ok := decoded.Resources[0].(*vsmbShareTemplate)
+	if !ok {
+		t.Fatalf("got %T, want *vsmbShareTemplate", decoded.Resources[0])
+	}
+	if !reflect.DeepEqual(share, cfg.Resources[0]) {
+		t.Fatalf("got %+v, want %+v", share, cfg.Resources[0])
+	}
+	mount, ok := decoded.Resources[1].(*scsiMountTemplate)
+	if !ok {
+		t.Fatalf("got %T, want *scsiMountTemplate", decoded.Resources[1])
+	}
+	if *mount != *cfg.Resources[1].(*scsiMountTemplate) {
+		t.Fatalf("got %+v, want %+v", mount, cfg.Resources[1])
+	}
+}
+
+func TestUVMTemplateConfig_MarshalJSONRejectsUnrecognizedResourceType(t *testing.T) {
+	cfg := &UVMTemplateConfig{
+		Resources: []Cloneable{&fakeCloneable{}},
+	}
+
+	if _, err := json.Marshal(cfg); err == nil {
+		t.Fatal("expected an error marshaling an unrecognized resource type")
+	}
+}
+
+func TestUVMTemplateConfig_UnmarshalJSONRejectsUnrecognizedResourceType(t *testing.T) {
+	var decoded UVMTemplateConfig
+	err := json.Unmarshal([]byte(`{"Resources":[{"Type":"made-up","Data":{}}]}`), &decoded)
+	if err == nil {
+		t.Fatal("expected an error unmarshaling an unrecognized resource type")
+	}
+}
+
+type fakeCloneable struct {
+	sawDoc           bool
+	sawScratchFolder string
+	sawUVMID         string
+}
+
+func (f *fakeCloneable) Clone(ctx context.Context, vm *UtilityVM, cd *CloneData) error {
+	f.sawDoc = cd.Doc() != nil
+	f.sawScratchFolder = cd.ScratchFolder()
+	f.sawUVMID = cd.UVMID()
+	return nil
+}
+
+func TestNewCloneData(t *testing.T) {
+	doc := &hcsschema.ComputeSystem{}
+	cd := NewCloneData(doc, `C:\scratch\clone-1`, "clone-1")
+
+	f := &fakeCloneable{}
+	if err := f.Clone(context.Background(), nil, cd); err != nil {
+		t.Fatal(err)
+	}
+	if !f.sawDoc {
+		t.Fatal("expected Doc() to return the constructor's doc")
+	}
+	if f.sawScratchFolder != `C:\scratch\clone-1` {
+		t.Fatalf("got scratch folder %q", f.sawScratchFolder)
+	}
+	if f.sawUVMID != "clone-1" {
+		t.Fatalf("got uvmID %q", f.sawUVMID)
+	}
+}
+
+func TestCloneData_ReportCloneResultInvokesPostCloneCallback(t *testing.T) {
+	doc := &hcsschema.ComputeSystem{}
+	f := &fakeCloneable{}
+	wantResult := "some-clone-result"
+	wantErr := errors.New("some clone error")
+
+	var gotResource Cloneable
+	var gotResult interface{}
+	var gotErr error
+	cd := NewCloneDataWithPostCloneCallback(doc, `C:\scratch\clone-1`, "clone-1", nil, FullCopyScratchDisk, nil, RefuseWritableVSMBShare,
+		func(resource Cloneable, result interface{}, err error) {
+			gotResource, gotResult, gotErr = resource, result, err
+		})
+
+	cd.ReportCloneResult(f, wantResult, wantErr)
+
+	if gotResource != Cloneable(f) {
+		t.Fatalf("got resource %v, want %v", gotResource, f)
+	}
+	if gotResult != wantResult {
+		t.Fatalf("got result %v, want %v", gotResult, wantResult)
+	}
+	if !errors.Is(gotErr, wantErr) {
+		t.Fatalf("got err %v, want %v", gotErr, wantErr)
+	}
+}
+
+func TestCloneData_ReportCloneResultIsNoopWithoutCallback(t *testing.T) {
+	doc := &hcsschema.ComputeSystem{}
+	cd := NewCloneData(doc, `C:\scratch\clone-1`, "clone-1")
+
+	// Must not panic with no PostCloneCallback registered.
+	cd.ReportCloneResult(&fakeCloneable{}, nil, nil)
+}
+
+// fakeBlockingCloneable is a Cloneable whose Clone blocks until `unblock` is
+// closed, wrapped in cd.runBounded the same way every real Cloneable
+// implementation in this package wraps its own work - so it exercises
+// NewCloneDataWithResourceTimeout end-to-end rather than calling runBounded
+// directly.
+type fakeBlockingCloneable struct {
+	resourceType string
+	unblock      chan struct{}
+}
+
+func (f *fakeBlockingCloneable) Clone(ctx context.Context, vm *UtilityVM, cd *CloneData) error {
+	return cd.runBounded(ctx, f.resourceType, func(ctx context.Context) error {
+		select {
+		case <-f.unblock:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+}
+
+func TestCloneData_ResourceCloneTimeoutNamesTheStuckResource(t *testing.T) {
+	doc := &hcsschema.ComputeSystem{}
+	cd := NewCloneDataWithResourceTimeout(doc, `C:\scratch\clone-1`, "clone-1", nil, FullCopyScratchDisk, nil, RefuseWritableVSMBShare, nil, 10*time.Millisecond)
+
+	f := &fakeBlockingCloneable{resourceType: "scsi-mount", unblock: make(chan struct{})}
+	defer close(f.unblock)
+
+	err := f.Clone(context.Background(), nil, cd)
+	if !errors.Is(err, ErrResourceCloneTimeout) {
+		t.Fatalf("expected ErrResourceCloneTimeout, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "scsi-mount") {
+		t.Fatalf("expected the error to name the stuck resource type, got %v", err)
+	}
+}
+
+func TestCloneData_ResourceCloneTimeoutDoesNotAffectFastResources(t *testing.T) {
+	doc := &hcsschema.ComputeSystem{}
+	cd := NewCloneDataWithResourceTimeout(doc, `C:\scratch\clone-1`, "clone-1", nil, FullCopyScratchDisk, nil, RefuseWritableVSMBShare, nil, time.Minute)
+
+	f := &fakeBlockingCloneable{resourceType: "scsi-mount", unblock: make(chan struct{})}
+	close(f.unblock)
+
+	if err := f.Clone(context.Background(), nil, cd); err != nil {
+		t.Fatalf("expected a resource that finishes fast to be unaffected, got %v", err)
+	}
+}
+
+func TestCloneData_NoResourceCloneTimeoutIsUnbounded(t *testing.T) {
+	doc := &hcsschema.ComputeSystem{}
+	cd := NewCloneData(doc, `C:\scratch\clone-1`, "clone-1")
+
+	if cd.ResourceCloneTimeout() != 0 {
+		t.Fatalf("expected no timeout by default, got %v", cd.ResourceCloneTimeout())
+	}
+
+	f := &fakeBlockingCloneable{resourceType: "scsi-mount", unblock: make(chan struct{})}
+	close(f.unblock)
+
+	if err := f.Clone(context.Background(), nil, cd); err != nil {
+		t.Fatalf("expected no timeout to leave Clone unbounded, got %v", err)
+	}
+}
+
+func TestCloneScratchFolder_PathShape(t *testing.T) {
+	path, err := CloneScratchFolder("clone-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(path, filepath.Join("hcsshim", "clones", "clone-1")) {
+		t.Fatalf("got %q, want a path ending in hcsshim/clones/clone-1", path)
+	}
+}
+
+func TestCloneScratchFolder_RejectsEmptyUVMID(t *testing.T) {
+	if _, err := CloneScratchFolder(""); err == nil {
+		t.Fatal("expected an error for an empty uvmID")
+	}
+}
+
+func TestSetCloningNamespaceID(t *testing.T) {
+	old := SetCloningNamespaceID("custom-namespace-id")
+	defer SetCloningNamespaceID(old)
+
+	if got := CloningNamespaceID(); got != "custom-namespace-id" {
+		t.Fatalf("got %q, want custom-namespace-id", got)
+	}
+
+	vm := &UtilityVM{isTemplate: true}
+	nsid, err := vm.NetNSIDInsideUVM("real-nsid", SharedCloneNamespaceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nsid != "custom-namespace-id" {
+		t.Fatalf("got %q, want the overridden namespace ID", nsid)
+	}
+}
+
+func TestSetCloningNamespaceID_RestoresDefault(t *testing.T) {
+	old := SetCloningNamespaceID("custom-namespace-id")
+	SetCloningNamespaceID(old)
+
+	if got := CloningNamespaceID(); got != CLONING_DEFAULT_NETWORK_NAMESPACE_ID {
+		t.Fatalf("got %q, want the default restored", got)
+	}
+}
+
+func TestCloneData_RemapPath(t *testing.T) {
+	doc := &hcsschema.ComputeSystem{}
+
+	t.Run("no remapper leaves paths unchanged", func(t *testing.T) {
+		cd := NewCloneData(doc, `C:\scratch\clone-1`, "clone-1")
+		if got := cd.RemapPath("vsmb-share", `C:\host\share`); got != `C:\host\share` {
+			t.Fatalf("got %q, want unchanged path", got)
+		}
+	})
+
+	t.Run("remapper is applied with resource type and old path", func(t *testing.T) {
+		var gotType, gotOld string
+		remap := func(resourceType, oldPath string) string {
+			gotType, gotOld = resourceType, oldPath
+			return `D:\remapped\share`
+		}
+		cd := NewCloneDataWithRemapper(doc, `C:\scratch\clone-1`, "clone-1", remap)
+
+		got := cd.RemapPath("vsmb-share", `C:\host\share`)
+		if got != `D:\remapped\share` {
+			t.Fatalf("got %q, want the remapped path", got)
+		}
+		if gotType != "vsmb-share" {
+			t.Fatalf("got resourceType %q, want vsmb-share", gotType)
+		}
+		if gotOld != `C:\host\share` {
+			t.Fatalf("got oldPath %q, want C:\\host\\share", gotOld)
+		}
+	})
+
+	t.Run("nil remapper on CloneData leaves paths unchanged", func(t *testing.T) {
+		cd := NewCloneDataWithRemapper(doc, `C:\scratch\clone-1`, "clone-1", nil)
+		if got := cd.RemapPath("scsi-mount", `C:\host\mount`); got != `C:\host\mount` {
+			t.Fatalf("got %q, want unchanged path", got)
+		}
+	})
+}
+
+func TestVSMBShareTemplate_CloneAppliesRemapping(t *testing.T) {
+	// vsmbShareTemplate.Clone drives vm.AddVSMB, which needs a real UVM to
+	// exercise end-to-end; assert the narrower contract instead - that
+	// Clone consults cd.RemapPath for the resource's HostPath - by giving it
+	// a remapper that fails the test if it's never called.
+	called := false
+	remap := func(resourceType, oldPath string) string {
+		called = true
+		if resourceType != "vsmb-share" {
+			t.Fatalf("got resourceType %q, want vsmb-share", resourceType)
+		}
+		if oldPath != `C:\host\share` {
+			t.Fatalf("got oldPath %q, want C:\\host\\share", oldPath)
+		}
+		return oldPath
+	}
+	cd := NewCloneDataWithRemapper(&hcsschema.ComputeSystem{}, `C:\scratch\clone-1`, "clone-1", remap)
+	tmpl := &vsmbShareTemplate{HostPath: `C:\host\share`}
+
+	// AddVSMB needs a real UtilityVM to succeed against, so this call is
+	// expected to fail; only that RemapPath was consulted first is checked.
+	_ = tmpl.Clone(context.Background(), &UtilityVM{}, cd)
+
+	if !called {
+		t.Fatal("expected Clone to consult cd.RemapPath for HostPath")
+	}
+}
+
+func TestVSMBShareTemplate_CloneReattachesReadOnlyShareUnchanged(t *testing.T) {
+	cd := NewCloneData(&hcsschema.ComputeSystem{}, `C:\scratch\clone-1`, "clone-1")
+	tmpl := &vsmbShareTemplate{HostPath: `C:\host\share`, ReadOnly: true}
+
+	// A read-only share is never subject to WritableVSMBClonePolicy, so
+	// Clone should reach AddVSMB (and fail there, against a fake UVM) rather
+	// than being refused up front.
+	err := tmpl.Clone(context.Background(), &UtilityVM{}, cd)
+	if !errors.Is(err, errNotSupported) {
+		t.Fatalf("got %v, want errNotSupported from AddVSMB", err)
+	}
+}
+
+func TestVSMBShareTemplate_CloneRefusesWritableShareByDefault(t *testing.T) {
+	cd := NewCloneData(&hcsschema.ComputeSystem{}, `C:\scratch\clone-1`, "clone-1")
+	tmpl := &vsmbShareTemplate{HostPath: `C:\host\share`, ReadOnly: false}
+
+	err := tmpl.Clone(context.Background(), &UtilityVM{}, cd)
+	if err == nil || errors.Is(err, errNotSupported) {
+		t.Fatalf("got %v, want a refusal before AddVSMB was ever reached", err)
+	}
+}
+
+func TestVSMBShareTemplate_CloneDowngradesWritableShareWhenPolicySaysSo(t *testing.T) {
+	cd := NewCloneDataWithVSMBWritePolicy(&hcsschema.ComputeSystem{}, `C:\scratch\clone-1`, "clone-1", nil, FullCopyScratchDisk, nil, DowngradeWritableVSMBShareToReadOnly)
+	tmpl := &vsmbShareTemplate{HostPath: `C:\host\share`, ReadOnly: false}
+
+	// The downgrade policy should let Clone proceed to AddVSMB (and fail
+	// there, against a fake UVM) instead of refusing.
+	err := tmpl.Clone(context.Background(), &UtilityVM{}, cd)
+	if !errors.Is(err, errNotSupported) {
+		t.Fatalf("got %v, want errNotSupported from AddVSMB", err)
+	}
+}
+
+func TestSCSIMountTemplate_CloneDefaultsToFullCopyScratchDisk(t *testing.T) {
+	old := SetDifferencingDiskCreator(func(parentPath, childPath string) error {
+		t.Fatal("expected FullCopyScratchDisk to never consult the differencing disk creator")
+		return nil
+	})
+	defer SetDifferencingDiskCreator(old)
+
+	cd := NewCloneData(&hcsschema.ComputeSystem{}, `C:\scratch\clone-1`, "clone-1")
+	tmpl := &scsiMountTemplate{HostPath: `C:\template\scratch.vhdx`}
+
+	// AddSCSI needs a real UtilityVM to succeed against; only that the
+	// differencing disk creator was never consulted is checked.
+	_ = tmpl.Clone(context.Background(), &UtilityVM{}, cd)
+}
+
+func TestSCSIMountTemplate_CloneAppliesDifferencingScratchDisk(t *testing.T) {
+	var gotParent, gotChild string
+	old := SetDifferencingDiskCreator(func(parentPath, childPath string) error {
+		gotParent = parentPath
+		gotChild = childPath
+		return nil
+	})
+	defer SetDifferencingDiskCreator(old)
+
+	cd := NewCloneDataWithStrategy(&hcsschema.ComputeSystem{}, `C:\scratch\clone-1`, "clone-1", nil, DifferencingScratchDisk)
+	tmpl := &scsiMountTemplate{HostPath: `C:\template\scratch.vhdx`}
+
+	_ = tmpl.Clone(context.Background(), &UtilityVM{}, cd)
+
+	if gotParent != `C:\template\scratch.vhdx` {
+		t.Fatalf("got parent %q, want the template's scratch disk path", gotParent)
+	}
+	wantChild := `C:\scratch\clone-1\scratch.vhdx`
+	if gotChild != wantChild {
+		t.Fatalf("got child %q, want %q", gotChild, wantChild)
+	}
+}
+
+func TestSCSIMountTemplate_CloneReportsProgress(t *testing.T) {
+	old := SetDifferencingDiskCreator(func(parentPath, childPath string) error { return nil })
+	defer SetDifferencingDiskCreator(old)
+
+	var reported []float64
+	progress := func(resourceType string, fraction float64) {
+		if resourceType != "scsi-mount" {
+			t.Fatalf("got resourceType %q, want scsi-mount", resourceType)
+		}
+		reported = append(reported, fraction)
+	}
+	cd := NewCloneDataWithProgress(&hcsschema.ComputeSystem{}, `C:\scratch\clone-1`, "clone-1", nil, DifferencingScratchDisk, progress)
+	tmpl := &scsiMountTemplate{HostPath: `C:\template\scratch.vhdx`}
+
+	// AddSCSI fails against a fake UVM with no SCSI controllers, after the
+	// differencing disk (and its progress reports) is already done.
+	if err := tmpl.Clone(context.Background(), &UtilityVM{}, cd); !errors.Is(err, ErrNoSCSIControllers) {
+		t.Fatalf("got %v, want ErrNoSCSIControllers from AddSCSI", err)
+	}
+	if want := []float64{0, 1}; !reflect.DeepEqual(reported, want) {
+		t.Fatalf("got progress reports %v, want %v", reported, want)
+	}
+}
+
+func TestSCSIMountTemplate_CloneSkipsProgressReportingWhenNoneRegistered(t *testing.T) {
+	old := SetDifferencingDiskCreator(func(parentPath, childPath string) error { return nil })
+	defer SetDifferencingDiskCreator(old)
+
+	cd := NewCloneDataWithStrategy(&hcsschema.ComputeSystem{}, `C:\scratch\clone-1`, "clone-1", nil, DifferencingScratchDisk)
+	tmpl := &scsiMountTemplate{HostPath: `C:\template\scratch.vhdx`}
+
+	// With no reporter registered, Clone still gets past the differencing
+	// disk to AddSCSI, which fails against a fake UVM with no SCSI
+	// controllers.
+	if err := tmpl.Clone(context.Background(), &UtilityVM{}, cd); !errors.Is(err, ErrNoSCSIControllers) {
+		t.Fatalf("got %v, want ErrNoSCSIControllers from AddSCSI", err)
+	}
+}
+
+func TestSCSIMountTemplate_CloneIgnoresDifferencingForLayers(t *testing.T) {
+	old := SetDifferencingDiskCreator(func(parentPath, childPath string) error {
+		t.Fatal("expected a read-only layer mount to never consult the differencing disk creator")
+		return nil
+	})
+	defer SetDifferencingDiskCreator(old)
+
+	cd := NewCloneDataWithStrategy(&hcsschema.ComputeSystem{}, `C:\scratch\clone-1`, "clone-1", nil, DifferencingScratchDisk)
+	tmpl := &scsiMountTemplate{HostPath: `C:\template\layer.vhdx`, IsLayer: true}
+
+	_ = tmpl.Clone(context.Background(), &UtilityVM{}, cd)
+}
+
+func TestSCSIMountTemplate_CloneDifferencingWithoutCreatorFails(t *testing.T) {
+	old := SetDifferencingDiskCreator(nil)
+	defer SetDifferencingDiskCreator(old)
+
+	cd := NewCloneDataWithStrategy(&hcsschema.ComputeSystem{}, `C:\scratch\clone-1`, "clone-1", nil, DifferencingScratchDisk)
+	tmpl := &scsiMountTemplate{HostPath: `C:\template\scratch.vhdx`}
+
+	err := tmpl.Clone(context.Background(), &UtilityVM{}, cd)
+	if err == nil || !strings.Contains(err.Error(), "no differencing disk creator registered") {
+		t.Fatalf("got %v, want a 'no differencing disk creator registered' error", err)
+	}
+}
+
+func TestVPCIDeviceTemplate_CloneWrapsAssignmentFailure(t *testing.T) {
+	// AssignDevice needs a real LCOW UVM to succeed against; exercise the
+	// deterministic failure it returns for a WCOW UVM (device assignment
+	// isn't supported there) as a stand-in for "no equivalent device is
+	// available on the clone", and assert Clone names the device instead of
+	// letting AssignDevice's error pass through unqualified.
+	vm := &UtilityVM{operatingSystem: "windows"}
+	tmpl := &vpciDeviceTemplate{DeviceInstanceID: "vpci-instance-1"}
+
+	err := tmpl.Clone(context.Background(), vm, &CloneData{})
+	if err == nil || !strings.Contains(err.Error(), "vpci-instance-1") {
+		t.Fatalf("got %v, want an error naming the vpci device", err)
+	}
+}
+
+func TestVPCIDeviceTemplate_ResourceIDIsDeviceInstanceID(t *testing.T) {
+	tmpl := &vpciDeviceTemplate{DeviceInstanceID: "vpci-instance-1"}
+	if got := tmpl.ResourceID(); got != "vpci-instance-1" {
+		t.Fatalf("got %q, want %q", got, "vpci-instance-1")
+	}
+}
+
+func TestRAMScratchTemplate_CloneWithoutCreatorFails(t *testing.T) {
+	old := SetRAMScratchCreator(nil)
+	defer SetRAMScratchCreator(old)
+
+	tmpl := &ramScratchTemplate{SizeInBytes: 1 << 20}
+	err := tmpl.Clone(context.Background(), &UtilityVM{}, &CloneData{})
+	if err == nil || !strings.Contains(err.Error(), "no RAM scratch creator registered") {
+		t.Fatalf("got %v, want a 'no RAM scratch creator registered' error", err)
+	}
+}
+
+func TestGenerateTemplateConfig_RAMScratchRoundTrip(t *testing.T) {
+	vm := &UtilityVM{id: "template-ram-scratch"}
+	vm.SetRAMScratchSize(64 << 20)
+
+	cfg, err := GenerateTemplateConfig(context.Background(), vm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := cfg.ResourceTypeCounts()
+	if counts["ram-scratch"] != 1 {
+		t.Fatalf("got %d ram-scratch, want 1", counts["ram-scratch"])
+	}
+
+	var clonedSize int64
+	old := SetRAMScratchCreator(func(ctx context.Context, vm *UtilityVM, sizeInBytes int64) error {
+		clonedSize = sizeInBytes
+		return nil
+	})
+	defer SetRAMScratchCreator(old)
+
+	clone := &UtilityVM{id: "clone-1"}
+	cd := NewCloneData(&hcsschema.ComputeSystem{}, `C:\scratch\clone-1`, "clone-1")
+	for _, r := range cfg.Resources {
+		if err := r.Clone(context.Background(), clone, cd); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if clonedSize != 64<<20 {
+		t.Fatalf("got RAM scratch creator called with %d bytes, want %d", clonedSize, 64<<20)
+	}
+	if got := clone.RAMScratchSize(); got != 64<<20 {
+		t.Fatalf("got clone.RAMScratchSize() %d, want %d", got, 64<<20)
+	}
+}
+
+// TestGenerateTemplateConfig_VPMemEncodeRoundTrip guards against vpmemInfo -
+// which has no exported fields - ever being collected into cfg.Resources
+// directly again: gob refuses to encode a type with no exported fields, so
+// that regression would fail EncodeTemplateConfig for every LCOW UVM with a
+// VPMem-backed read-only layer.
+func TestGenerateTemplateConfig_VPMemEncodeRoundTrip(t *testing.T) {
+	vm := &UtilityVM{
+		vpmemDevices: [MaxVPMEMCount]*vpmemInfo{
+			0: {hostPath: `C:\vpmem\1`, uvmPath: `/vpmem/1`},
+		},
+	}
+
+	cfg, err := GenerateTemplateConfig(context.Background(), vm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts := cfg.ResourceTypeCounts(); counts["vpmem"] != 1 {
+		t.Fatalf("got %d vpmem, want 1", counts["vpmem"])
+	}
+
+	data, err := EncodeTemplateConfig(cfg)
+	if err != nil {
+		t.Fatalf("failed to encode template config with a VPMem resource: %v", err)
+	}
+	decoded, err := DecodeTemplateConfig(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.Equal(cfg) {
+		t.Fatalf("decoded config %+v does not match original %+v", decoded, cfg)
+	}
+	if got := decoded.Resources[0].(*vpmemTemplate).HostPath; got != `C:\vpmem\1` {
+		t.Fatalf("got decoded HostPath %q, want %q", got, `C:\vpmem\1`)
+	}
+}
+
+func TestGenerateTemplateConfig_CimLayerRoundTrip(t *testing.T) {
+	vm := &UtilityVM{id: "template-cim"}
+	vm.SetCimLayers([]string{`C:\cims\base.cim`, `C:\cims\app.cim`})
+
+	cfg, err := GenerateTemplateConfig(context.Background(), vm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := cfg.ResourceTypeCounts()
+	if counts["cim-layer"] != 2 {
+		t.Fatalf("got %d cim-layer, want 2", counts["cim-layer"])
+	}
+
+	data, err := EncodeTemplateConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodeTemplateConfig(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.Equal(cfg) {
+		t.Fatalf("decoded config %+v does not match original %+v", decoded, cfg)
+	}
+
+	var mounted []string
+	old := SetCimLayerMounter(func(ctx context.Context, vm *UtilityVM, cimPath string) error {
+		mounted = append(mounted, cimPath)
+		return nil
+	})
+	defer SetCimLayerMounter(old)
+
+	clone := &UtilityVM{id: "clone-1"}
+	cd := NewCloneData(&hcsschema.ComputeSystem{}, `C:\scratch\clone-1`, "clone-1")
+	for _, r := range decoded.Resources {
+		if err := r.Clone(context.Background(), clone, cd); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(mounted) != 2 || mounted[0] != `C:\cims\base.cim` || mounted[1] != `C:\cims\app.cim` {
+		t.Fatalf("got mounted CIMs %v, want [C:\\cims\\base.cim C:\\cims\\app.cim]", mounted)
+	}
+}
+
+func TestCimLayerTemplate_CloneFailsWithoutMounterConfigured(t *testing.T) {
+	old := SetCimLayerMounter(nil)
+	defer SetCimLayerMounter(old)
+
+	t2 := &cimLayerTemplate{CimPath: `C:\cims\base.cim`}
+	cd := NewCloneData(&hcsschema.ComputeSystem{}, `C:\scratch\clone-1`, "clone-1")
+	if err := t2.Clone(context.Background(), &UtilityVM{id: "clone-1"}, cd); err == nil {
+		t.Fatal("expected an error cloning a CIM layer with no mounter configured, got nil")
+	}
+}
+
+func TestDecodeTemplateConfig_LegacyBlobWithoutCimLayersDecodesCleanly(t *testing.T) {
+	cfg := &UVMTemplateConfig{
+		UVMID:     "uvm-legacy-no-cim",
+		Resources: []Cloneable{&vsmbShareTemplate{HostPath: `C:\vsmb\1`}},
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := DecodeTemplateConfig(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts := decoded.ResourceTypeCounts(); counts["cim-layer"] != 0 {
+		t.Fatalf("got %d cim-layer resources decoding a config with none, want 0", counts["cim-layer"])
+	}
+	if !decoded.Equal(cfg) {
+		t.Fatalf("decoded config %+v does not match original %+v", decoded, cfg)
+	}
+}
+
+func TestCloneData_Validate(t *testing.T) {
+	doc := &hcsschema.ComputeSystem{}
+
+	tests := []struct {
+		name          string
+		cd            *CloneData
+		wantErrSubstr string
+	}{
+		{
+			name: "valid",
+			cd:   NewCloneData(doc, `C:\scratch\clone-1`, "clone-1"),
+		},
+		{
+			name:          "nil doc",
+			cd:            NewCloneData(nil, `C:\scratch\clone-1`, "clone-1"),
+			wantErrSubstr: "doc is nil",
+		},
+		{
+			name:          "empty scratch folder",
+			cd:            NewCloneData(doc, "", "clone-1"),
+			wantErrSubstr: "scratchFolder is empty",
+		},
+		{
+			name:          "empty uvmID",
+			cd:            NewCloneData(doc, `C:\scratch\clone-1`, ""),
+			wantErrSubstr: "uvmID is empty",
+		},
+		{
+			name:          "everything missing",
+			cd:            NewCloneData(nil, "", ""),
+			wantErrSubstr: "doc is nil; scratchFolder is empty; uvmID is empty",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cd.Validate()
+			if tt.wantErrSubstr == "" {
+				if err != nil {
+					t.Fatalf("expected no error, got %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErrSubstr) {
+				t.Fatalf("got %v, want an error containing %q", err, tt.wantErrSubstr)
+			}
+		})
+	}
+}
+
+func TestNetworkEndpoints_GobRoundTrip(t *testing.T) {
+	cfg := &UVMTemplateConfig{
+		UVMID: "template-net",
+		Resources: []Cloneable{
+			&NetworkEndpoints{EndpointIDs: []string{"endpoint-1", "endpoint-2"}, Namespace: "ns-1"},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded UVMTemplateConfig
+	if err := gob.NewDecoder(&buf).Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Resources) != 1 {
+		t.Fatalf("got %d resources, want 1", len(decoded.Resources))
+	}
+	got, ok := decoded.Resources[0].(*NetworkEndpoints)
+	if !ok {
+		t.Fatalf("got resource of type %T, want *NetworkEndpoints", decoded.Resources[0])
+	}
+	if got.Namespace != "ns-1" || len(got.EndpointIDs) != 2 {
+		t.Fatalf("got %+v, want Namespace=ns-1 with 2 endpoint IDs", got)
+	}
+}
+
+func TestNetworkEndpoints_AddressingRoundTrip(t *testing.T) {
+	cfg := &UVMTemplateConfig{
+		UVMID: "template-net-addressing",
+		Resources: []Cloneable{
+			&NetworkEndpoints{
+				EndpointIDs: []string{"endpoint-1"},
+				Namespace:   "ns-1",
+				Addressing: map[string]EndpointAddressing{
+					"endpoint-1": {
+						MacAddress:  "00:11:22:33:44:55",
+						IPAddress:   net.ParseIP("10.0.0.1"),
+						IPv6Address: net.ParseIP("fd00::1"),
+					},
+				},
+			},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded UVMTemplateConfig
+	if err := gob.NewDecoder(&buf).Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	got := decoded.Resources[0].(*NetworkEndpoints)
+	addr, ok := got.Addressing["endpoint-1"]
+	if !ok {
+		t.Fatal("expected captured addressing for endpoint-1 to survive the round trip")
+	}
+	if addr.MacAddress != "00:11:22:33:44:55" || !addr.IPAddress.Equal(net.ParseIP("10.0.0.1")) || !addr.IPv6Address.Equal(net.ParseIP("fd00::1")) {
+		t.Fatalf("got %+v, want the original addressing", addr)
+	}
+}
+
+func TestAddressingMatches(t *testing.T) {
+	live := &hns.HNSEndpoint{MacAddress: "00:11:22:33:44:55", IPAddress: net.ParseIP("10.0.0.1"), IPv6Address: net.ParseIP("fd00::1")}
+
+	cases := []struct {
+		name     string
+		captured EndpointAddressing
+		want     bool
+	}{
+		{"exact match", EndpointAddressing{MacAddress: "00:11:22:33:44:55", IPAddress: net.ParseIP("10.0.0.1"), IPv6Address: net.ParseIP("fd00::1")}, true},
+		{"case-insensitive mac", EndpointAddressing{MacAddress: "00:11:22:33:44:55"}, true},
+		{"unrecorded fields are skipped", EndpointAddressing{}, true},
+		{"mac mismatch", EndpointAddressing{MacAddress: "aa:bb:cc:dd:ee:ff"}, false},
+		{"ipv4 mismatch", EndpointAddressing{IPAddress: net.ParseIP("10.0.0.2")}, false},
+		{"ipv6 mismatch", EndpointAddressing{IPv6Address: net.ParseIP("fd00::2")}, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := addressingMatches(c.captured, live); got != c.want {
+				t.Fatalf("got %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestRewriteNamespacePolicies_RewritesEmbeddedNamespaceReference(t *testing.T) {
+	endpoint := &hns.HNSEndpoint{
+		Policies: []json.RawMessage{
+			json.RawMessage(`{"Type":"ACL","NetworkNamespaceId":"ns-original"}`),
+			json.RawMessage(`{"Type":"OutBoundNAT"}`),
+		},
+	}
+
+	rewriteNamespacePolicies(endpoint, "ns-original", "ns-clone")
+
+	if !strings.Contains(string(endpoint.Policies[0]), "ns-clone") {
+		t.Fatalf("expected namespace reference to be rewritten, got %s", endpoint.Policies[0])
+	}
+	if string(endpoint.Policies[1]) != `{"Type":"OutBoundNAT"}` {
+		t.Fatalf("expected policy without a namespace reference to be left untouched, got %s", endpoint.Policies[1])
+	}
+}
+
+func TestRewriteNamespacePolicies_NoOpWhenNamespaceUnchanged(t *testing.T) {
+	endpoint := &hns.HNSEndpoint{
+		Policies: []json.RawMessage{json.RawMessage(`{"NetworkNamespaceId":"ns-1"}`)},
+	}
+
+	rewriteNamespacePolicies(endpoint, "ns-1", "ns-1")
+
+	if string(endpoint.Policies[0]) != `{"NetworkNamespaceId":"ns-1"}` {
+		t.Fatalf("expected no rewrite when the namespace ID hasn't changed, got %s", endpoint.Policies[0])
+	}
+}
+
+func TestGenerateTemplateConfig_ResourceTypeCounts(t *testing.T) {
+	vm := &UtilityVM{
+		id: "template-counts",
+		vsmbDirShares: map[string]*VSMBShare{
+			`C:\dir\1`: {HostPath: `C:\dir\1`},
+			`C:\dir\2`: {HostPath: `C:\dir\2`},
+		},
+		vsmbFileShares: map[string]*VSMBShare{
+			`C:\file\1`: {HostPath: `C:\file\1`},
+		},
+	}
+	vm.scsiLocations[0][0] = &SCSIMount{HostPath: `C:\scsi\1`}
+	vm.scsiLocations[0][1] = &SCSIMount{HostPath: `C:\scsi\2`}
+	vm.scsiLocations[0][2] = &SCSIMount{HostPath: `C:\scsi\3`}
+
+	cfg, err := GenerateTemplateConfig(context.Background(), vm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := cfg.ResourceTypeCounts()
+	if counts["vsmb-share"] != 3 {
+		t.Fatalf("got %d vsmb-share, want 3", counts["vsmb-share"])
+	}
+	if counts["scsi-mount"] != 3 {
+		t.Fatalf("got %d scsi-mount, want 3", counts["scsi-mount"])
+	}
+	if counts["vpmem"] != 0 || counts["layers"] != 0 {
+		t.Fatalf("expected no vpmem/layers entries, got %+v", counts)
+	}
+}
+
+// TestGenerateTemplateConfig_SafeAgainstConcurrentMutation races
+// GenerateTemplateConfig against goroutines mutating vsmbDirShares,
+// vsmbFileShares and scsiLocations the same way AddVSMB/AddSCSI and
+// their removal counterparts would - i.e. under vm.m - to make sure the
+// collection loops' vm.m.Lock() actually excludes concurrent map writers
+// instead of just racing them. Run with -race to catch a regression.
+func TestGenerateTemplateConfig_SafeAgainstConcurrentMutation(t *testing.T) {
+	vm := &UtilityVM{
+		id:             "template-stress",
+		vsmbDirShares:  map[string]*VSMBShare{},
+		vsmbFileShares: map[string]*VSMBShare{},
+	}
+
+	const iterations = 200
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		for i := 0; i < iterations; i++ {
+			path := fmt.Sprintf(`C:\dir\%d`, i)
+			vm.m.Lock()
+			vm.vsmbDirShares[path] = &VSMBShare{HostPath: path}
+			delete(vm.vsmbFileShares, path)
+			vm.vsmbFileShares[path] = &VSMBShare{HostPath: path}
+			delete(vm.vsmbDirShares, path)
+			vm.m.Unlock()
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+		for i := 0; i < iterations; i++ {
+			vm.m.Lock()
+			sm, err := vm.allocateSCSISlot(context.Background(), fmt.Sprintf(`C:\scsi\%d`, i), "")
+			vm.m.Unlock()
+			if err != nil {
+				continue
+			}
+			vm.deallocateSCSIMount(context.Background(), sm)
+		}
+	}()
+
+	for i := 0; i < iterations; i++ {
+		if _, err := GenerateTemplateConfig(context.Background(), vm); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	wg.Wait()
+}
+
+func TestGenerateTemplateConfigWithOptions_IncludeResourceTypesFiltersOutOthers(t *testing.T) {
+	vm := &UtilityVM{
+		id: "template-filtered",
+		vsmbDirShares: map[string]*VSMBShare{
+			`C:\dir\1`: {HostPath: `C:\dir\1`},
+		},
+	}
+	vm.scsiLocations[0][0] = &SCSIMount{HostPath: `C:\scsi\1`}
+
+	cfg, err := GenerateTemplateConfigWithOptions(context.Background(), vm, GenerateTemplateConfigOptions{
+		IncludeResourceTypes: []string{"scsi-mount"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := cfg.ResourceTypeCounts()
+	if counts["scsi-mount"] != 1 {
+		t.Fatalf("got %d scsi-mount, want 1", counts["scsi-mount"])
+	}
+	if counts["vsmb-share"] != 0 {
+		t.Fatalf("expected vsmb-share to be filtered out, got %d", counts["vsmb-share"])
+	}
+}
+
+func TestGenerateTemplateConfigWithOptions_ExcludeResourceTypesWinsOverInclude(t *testing.T) {
+	vm := &UtilityVM{
+		id: "template-exclude",
+		vsmbDirShares: map[string]*VSMBShare{
+			`C:\dir\1`: {HostPath: `C:\dir\1`},
+		},
+	}
+	vm.scsiLocations[0][0] = &SCSIMount{HostPath: `C:\scsi\1`}
+
+	cfg, err := GenerateTemplateConfigWithOptions(context.Background(), vm, GenerateTemplateConfigOptions{
+		IncludeResourceTypes: []string{"scsi-mount", "vsmb-share"},
+		ExcludeResourceTypes: []string{"vsmb-share"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := cfg.ResourceTypeCounts()
+	if counts["scsi-mount"] != 1 {
+		t.Fatalf("got %d scsi-mount, want 1", counts["scsi-mount"])
+	}
+	if counts["vsmb-share"] != 0 {
+		t.Fatalf("expected vsmb-share to be excluded, got %d", counts["vsmb-share"])
+	}
+}
+
+func TestGenerateTemplateConfig_CapturesVPCIDevicesInStrictMode(t *testing.T) {
+	// VPCI devices are always convertible into a vpciDeviceTemplate, so
+	// StrictTemplateGeneration captures them the same as LenientTemplateGeneration
+	// - like VSMB/SCSI/VPMem/layers, and there's nothing else lenient mode
+	// currently adds.
+	vm := &UtilityVM{
+		id: "template-lenient",
+		vpciDevices: map[string]*VPCIDevice{
+			"vpci-1": {deviceInstanceID: "vpci-1"},
+		},
+	}
+
+	strict, err := GenerateTemplateConfig(context.Background(), vm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(strict.SkippedResources) != 0 {
+		t.Fatalf("expected no skipped resources in strict mode, got %v", strict.SkippedResources)
+	}
+	if got := strict.ResourceTypeCounts()["vpci-device"]; got != 1 {
+		t.Fatalf("got %d vpci-device resources in strict mode, want 1", got)
+	}
+
+	lenient, err := GenerateTemplateConfigWithMode(context.Background(), vm, LenientTemplateGeneration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lenient.SkippedResources) != 0 {
+		t.Fatalf("got %d skipped resources, want 0: %v", len(lenient.SkippedResources), lenient.SkippedResources)
+	}
+}
+
+func TestUVMTemplateConfig_SelectResourcesByType(t *testing.T) {
+	cfg := &UVMTemplateConfig{
+		UVMID: "template-select",
+		Resources: []Cloneable{
+			&vsmbShareTemplate{HostPath: `C:\vsmb\1`},
+			&scsiMountTemplate{HostPath: `C:\scsi\1`},
+			&vsmbShareTemplate{HostPath: `C:\vsmb\2`},
+		},
+	}
+
+	selected := cfg.SelectResources(ByResourceType("vsmb-share"))
+	if len(selected) != 2 {
+		t.Fatalf("got %d resources, want 2: %v", len(selected), selected)
+	}
+	for _, r := range selected {
+		if _, ok := r.(*vsmbShareTemplate); !ok {
+			t.Fatalf("got resource of type %T, want *vsmbShareTemplate", r)
+		}
+	}
+	// Selecting preserves cfg.Resources' relative order.
+	if selected[0].(*vsmbShareTemplate).HostPath != `C:\vsmb\1` || selected[1].(*vsmbShareTemplate).HostPath != `C:\vsmb\2` {
+		t.Fatalf("selection did not preserve order: %v", selected)
+	}
+}
+
+func TestUVMTemplateConfig_SelectResourcesByID(t *testing.T) {
+	cfg := &UVMTemplateConfig{
+		UVMID: "template-select-id",
+		Resources: []Cloneable{
+			&vsmbShareTemplate{HostPath: `C:\vsmb\1`},
+			&vsmbShareTemplate{HostPath: `C:\vsmb\2`},
+		},
+	}
+
+	selected := cfg.SelectResources(ByResourceID(`C:\vsmb\2`))
+	if len(selected) != 1 {
+		t.Fatalf("got %d resources, want 1: %v", len(selected), selected)
+	}
+	if selected[0].(*vsmbShareTemplate).HostPath != `C:\vsmb\2` {
+		t.Fatalf("got %v, want C:\\vsmb\\2", selected[0])
+	}
+}
+
+func TestUVMTemplateConfig_DeepCopyIsIndependent(t *testing.T) {
+	cfg := &UVMTemplateConfig{
+		UVMID: "template-deepcopy",
+		Resources: []Cloneable{
+			&vsmbShareTemplate{HostPath: `C:\vsmb\1`},
+		},
+	}
+
+	copied, err := cfg.DeepCopy()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	copied.Resources[0].(*vsmbShareTemplate).HostPath = `C:\vsmb\mutated`
+
+	if cfg.Resources[0].(*vsmbShareTemplate).HostPath != `C:\vsmb\1` {
+		t.Fatalf("mutating the copy affected the original: %+v", cfg.Resources[0])
+	}
+	if copied.UVMID != cfg.UVMID {
+		t.Fatalf("got UVMID %q, want %q", copied.UVMID, cfg.UVMID)
+	}
+}
+
+// TestUVMTemplateConfig_DeepCopySucceedsWithVPMemResource guards against
+// DeepCopy's gob round-trip failing for a decoded LCOW template - see
+// synth-517, where an unwrapped *vpmemInfo (no exported fields) in
+// cfg.Resources made gob.Encode fail for any VPMem-backed config.
+func TestUVMTemplateConfig_DeepCopySucceedsWithVPMemResource(t *testing.T) {
+	cfg := &UVMTemplateConfig{
+		UVMID:     "template-deepcopy-vpmem",
+		Resources: []Cloneable{&vpmemTemplate{HostPath: `C:\vpmem\1`}},
+	}
+
+	copied, err := cfg.DeepCopy()
+	if err != nil {
+		t.Fatalf("failed to deep copy a config with a VPMem resource: %v", err)
+	}
+	if got := copied.Resources[0].(*vpmemTemplate).HostPath; got != `C:\vpmem\1` {
+		t.Fatalf("got HostPath %q, want %q", got, `C:\vpmem\1`)
+	}
+}
+
+func TestUVMTemplateConfig_Equal(t *testing.T) {
+	cfg := &UVMTemplateConfig{
+		UVMID: "template-equal",
+		Resources: []Cloneable{
+			&vsmbShareTemplate{HostPath: `C:\vsmb\1`},
+			&scsiMountTemplate{HostPath: `C:\scratch\scsi.vhdx`, UVMPath: `C:\guest\scsi`},
+		},
+	}
+
+	t.Run("identical config is equal", func(t *testing.T) {
+		other := &UVMTemplateConfig{
+			UVMID: "template-equal",
+			Resources: []Cloneable{
+				&vsmbShareTemplate{HostPath: `C:\vsmb\1`},
+				&scsiMountTemplate{HostPath: `C:\scratch\scsi.vhdx`, UVMPath: `C:\guest\scsi`},
+			},
+		}
+		if !cfg.Equal(other) {
+			t.Fatal("expected identical configs to be equal")
+		}
+	})
+
+	t.Run("reordered resources are still equal", func(t *testing.T) {
+		other := &UVMTemplateConfig{
+			UVMID: "template-equal",
+			Resources: []Cloneable{
+				&scsiMountTemplate{HostPath: `C:\scratch\scsi.vhdx`, UVMPath: `C:\guest\scsi`},
+				&vsmbShareTemplate{HostPath: `C:\vsmb\1`},
+			},
+		}
+		if !cfg.Equal(other) {
+			t.Fatal("expected reordered-but-equal configs to be equal")
+		}
+	})
+
+	t.Run("differing UVMID is not equal", func(t *testing.T) {
+		other := &UVMTemplateConfig{
+			UVMID:     "template-different",
+			Resources: cfg.Resources,
+		}
+		if cfg.Equal(other) {
+			t.Fatal("expected configs with different UVMIDs to not be equal")
+		}
+	})
+
+	t.Run("differing resource field is not equal", func(t *testing.T) {
+		other := &UVMTemplateConfig{
+			UVMID: "template-equal",
+			Resources: []Cloneable{
+				&vsmbShareTemplate{HostPath: `C:\vsmb\different`},
+				&scsiMountTemplate{HostPath: `C:\scratch\scsi.vhdx`, UVMPath: `C:\guest\scsi`},
+			},
+		}
+		if cfg.Equal(other) {
+			t.Fatal("expected configs with a differing resource field to not be equal")
+		}
+	})
+
+	t.Run("differing resource count is not equal", func(t *testing.T) {
+		other := &UVMTemplateConfig{
+			UVMID:     "template-equal",
+			Resources: []Cloneable{&vsmbShareTemplate{HostPath: `C:\vsmb\1`}},
+		}
+		if cfg.Equal(other) {
+			t.Fatal("expected configs with different resource counts to not be equal")
+		}
+	})
+}
+
+func TestFindEquivalentTemplate_FindsMatchUnderDifferentID(t *testing.T) {
+	old := clone.SetTemplateStore(clone.NewInMemoryTemplateStore())
+	defer clone.SetTemplateStore(old)
+
+	seeded := &UVMTemplateConfig{
+		UVMID:     "template-seeded",
+		Resources: []Cloneable{&vsmbShareTemplate{HostPath: `C:\vsmb\1`}},
+	}
+	data, err := EncodeTemplateConfig(seeded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := clone.SaveTemplateConfig(context.Background(), "template-stored-id", data); err != nil {
+		t.Fatal(err)
+	}
+
+	candidate := &UVMTemplateConfig{
+		UVMID:     "template-seeded",
+		Resources: []Cloneable{&vsmbShareTemplate{HostPath: `C:\vsmb\1`}},
+	}
+	id, found, err := FindEquivalentTemplate(context.Background(), candidate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || id != "template-stored-id" {
+		t.Fatalf("got (%q, %v), want (\"template-stored-id\", true)", id, found)
+	}
+}
+
+func TestFindEquivalentTemplate_NoMatchReturnsFalse(t *testing.T) {
+	old := clone.SetTemplateStore(clone.NewInMemoryTemplateStore())
+	defer clone.SetTemplateStore(old)
+
+	seeded := &UVMTemplateConfig{
+		UVMID:     "template-seeded",
+		Resources: []Cloneable{&vsmbShareTemplate{HostPath: `C:\vsmb\1`}},
+	}
+	data, err := EncodeTemplateConfig(seeded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := clone.SaveTemplateConfig(context.Background(), "template-seeded", data); err != nil {
+		t.Fatal(err)
+	}
+
+	candidate := &UVMTemplateConfig{
+		UVMID:     "template-different",
+		Resources: []Cloneable{&vsmbShareTemplate{HostPath: `C:\vsmb\different`}},
+	}
+	id, found, err := FindEquivalentTemplate(context.Background(), candidate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found || id != "" {
+		t.Fatalf("got (%q, %v), want (\"\", false)", id, found)
+	}
+}
+
+func TestGenerateTemplateConfig_RecordsMetrics(t *testing.T) {
+	oldHook := metrics.SetHook(nil)
+	defer metrics.SetHook(oldHook)
+
+	var gotOp, gotUVMID string
+	var gotDuration time.Duration
+	metrics.SetHook(func(op, uvmID string, duration time.Duration) {
+		gotOp, gotUVMID, gotDuration = op, uvmID, duration
+	})
+
+	vm := &UtilityVM{id: "template-metrics"}
+	if _, err := GenerateTemplateConfig(context.Background(), vm); err != nil {
+		t.Fatal(err)
+	}
+
+	if gotOp != "GenerateTemplateConfig" {
+		t.Fatalf("got op %q, want %q", gotOp, "GenerateTemplateConfig")
+	}
+	if gotUVMID != vm.id {
+		t.Fatalf("got uvmID %q, want %q", gotUVMID, vm.id)
+	}
+	if gotDuration < 0 {
+		t.Fatalf("got negative duration %v", gotDuration)
+	}
+}
+
+type fakePauseResumer struct {
+	pauseErr   error
+	pauseCount int
+	resumed    bool
+	resumeErr  error
+}
+
+func (f *fakePauseResumer) Pause(ctx context.Context) error {
+	f.pauseCount++
+	return f.pauseErr
+}
+
+func (f *fakePauseResumer) Resume(ctx context.Context) error {
+	f.resumed = true
+	return f.resumeErr
+}
+
+func TestSaveAsTemplate_ResumesOnSaveFailure(t *testing.T) {
+	old := clone.SetTemplateStore(clone.NewInMemoryTemplateStore())
+	defer clone.SetTemplateStore(old)
+
+	// Reserve the template ID as non-provisional so SaveTemplateConfig fails,
+	// simulating a failure after Pause has already succeeded.
+	if err := clone.SaveTemplateConfig(context.Background(), "template-save-fails", []byte("existing")); err != nil {
+		t.Fatal(err)
+	}
+
+	vm := &UtilityVM{id: "uvm-save-fails"}
+	sys := &fakePauseResumer{}
+
+	err := saveAsTemplate(context.Background(), vm, sys, "template-save-fails", nil)
+	if err == nil {
+		t.Fatal("expected an error from the already-existing template")
+	}
+	if !sys.resumed {
+		t.Fatal("expected Resume to be called after Save failed")
+	}
+}
+
+func TestSaveAsTemplate_ResumeErrorIsWrapped(t *testing.T) {
+	old := clone.SetTemplateStore(clone.NewInMemoryTemplateStore())
+	defer clone.SetTemplateStore(old)
+
+	if err := clone.SaveTemplateConfig(context.Background(), "template-save-fails-2", []byte("existing")); err != nil {
+		t.Fatal(err)
+	}
+
+	vm := &UtilityVM{id: "uvm-save-fails-2"}
+	resumeErr := errors.New("resume also failed")
+	sys := &fakePauseResumer{resumeErr: resumeErr}
+
+	err := saveAsTemplate(context.Background(), vm, sys, "template-save-fails-2", nil)
+	if err == nil {
+		t.Fatal("expected an error from the already-existing template")
+	}
+	if !sys.resumed {
+		t.Fatal("expected Resume to be attempted")
+	}
+	if !strings.Contains(err.Error(), resumeErr.Error()) {
+		t.Fatalf("expected the resume error to be included, got %v", err)
+	}
+}
+
+// fakeCloneableCloser is a Cloneable that also implements Closer, for
+// exercising closeTemplateResources' interface assertion.
+type fakeCloneableCloser struct {
+	closed   bool
+	closeErr error
+}
+
+func (f *fakeCloneableCloser) Clone(ctx context.Context, vm *UtilityVM, cd *CloneData) error {
+	return nil
+}
+
+func (f *fakeCloneableCloser) Close(ctx context.Context) error {
+	f.closed = true
+	return f.closeErr
+}
+
+func TestCloseTemplateResources_ClosesResourcesImplementingCloser(t *testing.T) {
+	closer := &fakeCloneableCloser{}
+	cfg := &UVMTemplateConfig{Resources: []Cloneable{closer, &fakeCloneable{}}}
+
+	closeTemplateResources(context.Background(), cfg)
+
+	if !closer.closed {
+		t.Fatal("expected the Closer resource to be closed")
+	}
+}
+
+func TestCloseTemplateResources_ClosesEveryCloserDespiteOneFailing(t *testing.T) {
+	failing := &fakeCloneableCloser{closeErr: errors.New("close failed")}
+	other := &fakeCloneableCloser{}
+	cfg := &UVMTemplateConfig{Resources: []Cloneable{failing, other}}
+
+	closeTemplateResources(context.Background(), cfg)
+
+	if !failing.closed || !other.closed {
+		t.Fatal("expected both Closer resources to be closed even though one failed")
+	}
+}
+
+func TestUVMTemplateConfig_NICsSurviveGobRoundTrip(t *testing.T) {
+	nicID, err := guid.NewV4()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &UVMTemplateConfig{
+		UVMID: "template-nics",
+		NICs: []NICSnapshot{
+			{ID: nicID, NamespaceID: "ns-1", EndpointID: "endpoint-1"},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded UVMTemplateConfig
+	if err := gob.NewDecoder(&buf).Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.NICs) != 1 {
+		t.Fatalf("got %d NICs, want 1", len(decoded.NICs))
+	}
+	if decoded.NICs[0] != cfg.NICs[0] {
+		t.Fatalf("got %+v, want %+v", decoded.NICs[0], cfg.NICs[0])
+	}
+}
+
+func TestSaveAsTemplate_SnapshotsAndRemovesNICs(t *testing.T) {
+	old := clone.SetTemplateStore(clone.NewInMemoryTemplateStore())
+	defer clone.SetTemplateStore(old)
+
+	nicID, err := guid.NewV4()
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm := &UtilityVM{
+		id: "uvm-with-nics",
+		namespaces: map[string]*namespaceInfo{
+			"ns-1": {
+				nics: map[string]*nicInfo{
+					"endpoint-1": {ID: nicID, Endpoint: &hns.HNSEndpoint{Id: "endpoint-1"}},
+				},
+			},
+		},
+	}
+	sys := &fakePauseResumer{}
+
+	if err := saveAsTemplate(context.Background(), vm, sys, "template-with-nics", nil); err != nil {
+		t.Fatal(err)
+	}
+	if sys.resumed {
+		t.Fatal("did not expect Resume to be called on success")
+	}
+	if len(vm.namespaces["ns-1"].nics) != 0 {
+		t.Fatalf("expected NICs to be removed from the uvm, got %+v", vm.namespaces["ns-1"].nics)
+	}
+
+	data, err := clone.FetchTemplateConfig(context.Background(), "template-with-nics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodeTemplateConfig(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.NICs) != 1 {
+		t.Fatalf("got %d NICs in saved config, want 1", len(decoded.NICs))
+	}
+	if decoded.NICs[0] != (NICSnapshot{ID: nicID, NamespaceID: "ns-1", EndpointID: "endpoint-1"}) {
+		t.Fatalf("got %+v", decoded.NICs[0])
+	}
+}
+
+func TestSaveAsTemplate_ReattachesNICsBeforeResumeOnSaveFailure(t *testing.T) {
+	old := clone.SetTemplateStore(clone.NewInMemoryTemplateStore())
+	defer clone.SetTemplateStore(old)
+
+	// Reserve the template ID as non-provisional so SaveTemplateConfig fails
+	// after RemoveAllNICs has already run, simulating a failure that leaves
+	// the uvm with its NICs detached.
+	if err := clone.SaveTemplateConfig(context.Background(), "template-nics-save-fails", []byte("existing")); err != nil {
+		t.Fatal(err)
+	}
+
+	nicID, err := guid.NewV4()
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm := &UtilityVM{
+		id: "uvm-nics-save-fails",
+		namespaces: map[string]*namespaceInfo{
+			"ns-1": {
+				nics: map[string]*nicInfo{
+					"endpoint-1": {ID: nicID, Endpoint: &hns.HNSEndpoint{Id: "endpoint-1"}},
+				},
+			},
+		},
+	}
+	sys := &fakePauseResumer{}
+
+	err = saveAsTemplate(context.Background(), vm, sys, "template-nics-save-fails", nil)
+	if err == nil {
+		t.Fatal("expected an error from the already-existing template")
+	}
+	// There's no real HNS in this test to reattach the NICs against, so
+	// ReattachNICs fails too - the uvm should be left paused rather than
+	// resumed with no network connectivity.
+	if sys.resumed {
+		t.Fatal("did not expect Resume to be called when reattaching NICs failed")
+	}
+	if !strings.Contains(err.Error(), "failed to reattach nics") {
+		t.Fatalf("expected the reattach failure to be included, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "DiscardTemplate") {
+		t.Fatalf("expected the error to point the caller at DiscardTemplate, got %v", err)
+	}
+}
+
+func TestSaveAsTemplate_SecondCallReturnsErrAlreadyTemplate(t *testing.T) {
+	old := clone.SetTemplateStore(clone.NewInMemoryTemplateStore())
+	defer clone.SetTemplateStore(old)
+
+	vm := &UtilityVM{id: "uvm-save-twice"}
+	sys := &fakePauseResumer{}
+
+	if err := saveAsTemplate(context.Background(), vm, sys, "template-save-twice", nil); err != nil {
+		t.Fatal(err)
+	}
+	if !vm.IsTemplate() {
+		t.Fatal("expected vm.IsTemplate() to be true after a successful SaveAsTemplate")
+	}
+	if sys.pauseCount != 1 {
+		t.Fatalf("got %d Pause calls, want 1", sys.pauseCount)
+	}
+
+	err := saveAsTemplate(context.Background(), vm, sys, "template-save-twice", nil)
+	if !errors.Is(err, ErrAlreadyTemplate) {
+		t.Fatalf("got err %v, want ErrAlreadyTemplate", err)
+	}
+	if sys.pauseCount != 1 {
+		t.Fatalf("got %d Pause calls after second SaveAsTemplate, want still 1 (Pause should not be called again)", sys.pauseCount)
+	}
+}
+
+// fakeTerminator is a terminator for exercising DiscardTemplate without a
+// real HCS system to terminate.
+type fakeTerminator struct {
+	terminated   bool
+	terminateErr error
+}
+
+func (f *fakeTerminator) Terminate(ctx context.Context) error {
+	f.terminated = true
+	return f.terminateErr
+}
+
+func TestDiscardTemplate_RemovesPartialConfigAndTerminates(t *testing.T) {
+	old := clone.SetTemplateStore(clone.NewInMemoryTemplateStore())
+	defer clone.SetTemplateStore(old)
+
+	// Simulate a save that failed after a partial config had already made
+	// it to the store, e.g. via ReserveTemplateConfig, for the same
+	// half-dismantled state SaveAsTemplate's own doc comment describes.
+	if err := clone.ReserveTemplateConfig(context.Background(), "template-discard", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	sys := &fakeTerminator{}
+	if err := discardTemplate(context.Background(), sys, "template-discard"); err != nil {
+		t.Fatal(err)
+	}
+	if !sys.terminated {
+		t.Fatal("expected Terminate to be called")
+	}
+	if _, err := clone.FetchTemplateConfig(context.Background(), "template-discard"); !errors.Is(err, clone.ErrTemplateNotFound) {
+		t.Fatalf("expected the partial config to be removed, got %v", err)
+	}
+}
+
+func TestDiscardTemplate_NoConfigIsNotAnError(t *testing.T) {
+	old := clone.SetTemplateStore(clone.NewInMemoryTemplateStore())
+	defer clone.SetTemplateStore(old)
+
+	sys := &fakeTerminator{}
+	if err := discardTemplate(context.Background(), sys, "template-never-saved"); err != nil {
+		t.Fatalf("expected no error when there's no config to remove, got %v", err)
+	}
+	if !sys.terminated {
+		t.Fatal("expected Terminate to be called")
+	}
+}
+
+func TestDiscardTemplate_CombinesTerminateAndRemoveErrors(t *testing.T) {
+	old := clone.SetTemplateStore(clone.NewInMemoryTemplateStore())
+	defer clone.SetTemplateStore(old)
+
+	terminateErr := errors.New("terminate failed")
+	sys := &fakeTerminator{terminateErr: terminateErr}
+
+	err := discardTemplate(context.Background(), sys, "template-discard-terminate-fails")
+	if err == nil || !strings.Contains(err.Error(), terminateErr.Error()) {
+		t.Fatalf("expected the terminate error to be included, got %v", err)
+	}
+}
+
+func TestReconstructTemplateConfig_RebuildsFromLiveTemplate(t *testing.T) {
+	old := clone.SetTemplateStore(clone.NewInMemoryTemplateStore())
+	defer clone.SetTemplateStore(old)
+
+	vm := &UtilityVM{
+		id:            "uvm-reconstruct",
+		vsmbDirShares: map[string]*VSMBShare{"share-1": {HostPath: `C:\share`, guestPath: `C:\guest\share`, readOnly: true}},
+	}
+
+	cfg, err := ReconstructTemplateConfig(context.Background(), vm, "template-reconstruct", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.UVMID != vm.id {
+		t.Fatalf("got UVMID %q, want %q", cfg.UVMID, vm.id)
+	}
+
+	data, err := clone.FetchTemplateConfig(context.Background(), "template-reconstruct")
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodeTemplateConfig(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.UVMID != vm.id {
+		t.Fatalf("got decoded UVMID %q, want %q", decoded.UVMID, vm.id)
+	}
+}
+
+func TestReconstructTemplateConfig_RefusesExistingConfigWithoutOverwrite(t *testing.T) {
+	old := clone.SetTemplateStore(clone.NewInMemoryTemplateStore())
+	defer clone.SetTemplateStore(old)
+
+	if err := clone.SaveTemplateConfig(context.Background(), "template-exists", []byte("existing")); err != nil {
+		t.Fatal(err)
+	}
+
+	vm := &UtilityVM{id: "uvm-reconstruct-2"}
+	if _, err := ReconstructTemplateConfig(context.Background(), vm, "template-exists", false); !errors.Is(err, clone.ErrTemplateExists) {
+		t.Fatalf("got err %v, want ErrTemplateExists", err)
+	}
+
+	data, err := clone.FetchTemplateConfig(context.Background(), "template-exists")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "existing" {
+		t.Fatalf("expected the existing config to be left untouched, got %q", data)
+	}
+}
+
+func TestReconstructTemplateConfig_OverwritesWhenAsked(t *testing.T) {
+	old := clone.SetTemplateStore(clone.NewInMemoryTemplateStore())
+	defer clone.SetTemplateStore(old)
+
+	if err := clone.SaveTemplateConfig(context.Background(), "template-overwrite", []byte("stale")); err != nil {
+		t.Fatal(err)
+	}
+
+	vm := &UtilityVM{id: "uvm-reconstruct-3"}
+	if _, err := ReconstructTemplateConfig(context.Background(), vm, "template-overwrite", true); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := clone.FetchTemplateConfig(context.Background(), "template-overwrite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) == "stale" {
+		t.Fatal("expected the stale config to be overwritten")
+	}
+}
+
+func TestEncodeTemplateConfig_RoundTripsWithDefaultGobCodec(t *testing.T) {
+	cfg := &UVMTemplateConfig{UVMID: "uvm-codec-gob"}
+
+	data, err := EncodeTemplateConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodeTemplateConfig(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.UVMID != cfg.UVMID {
+		t.Fatalf("got UVMID %q, want %q", decoded.UVMID, cfg.UVMID)
+	}
+}
+
+func TestDecodeTemplateConfig_FallsBackToPlainGobForLegacyBlobs(t *testing.T) {
+	cfg := &UVMTemplateConfig{UVMID: "uvm-codec-legacy"}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := DecodeTemplateConfig(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.UVMID != cfg.UVMID {
+		t.Fatalf("got UVMID %q, want %q", decoded.UVMID, cfg.UVMID)
+	}
+}
+
+func TestJSONCodec_RoundTripsThroughSaveAndFetch(t *testing.T) {
+	old := clone.SetTemplateStore(clone.NewInMemoryTemplateStore())
+	defer clone.SetTemplateStore(old)
+
+	RegisterCodec("json", JSONCodec)
+	oldCodec, err := SetDefaultTemplateCodec("json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if _, err := SetDefaultTemplateCodec(oldCodec); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	vm := &UtilityVM{id: "uvm-codec-json"}
+	if _, err := ReconstructTemplateConfig(context.Background(), vm, "template-json-codec", false); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := clone.FetchTemplateConfig(context.Background(), "template-json-codec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodeTemplateConfig(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.UVMID != vm.id {
+		t.Fatalf("got decoded UVMID %q, want %q", decoded.UVMID, vm.id)
+	}
+}
+
+func TestSetDefaultTemplateCodec_RejectsUnregisteredName(t *testing.T) {
+	if _, err := SetDefaultTemplateCodec("no-such-codec"); err == nil {
+		t.Fatal("expected an error selecting an unregistered codec")
+	}
+}
+
+func TestMarkAsClone_RecordsTemplateSourceID(t *testing.T) {
+	old := clone.SetTemplateStore(clone.NewInMemoryTemplateStore())
+	defer clone.SetTemplateStore(old)
+
+	if err := clone.SaveTemplateConfig(context.Background(), "template-for-clone", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+
+	vm := &UtilityVM{id: "uvm-clone-1"}
+	if err := vm.MarkAsClone(context.Background(), "template-for-clone"); err != nil {
+		t.Fatal(err)
+	}
+
+	if !vm.IsClone() {
+		t.Fatal("expected IsClone() to be true after MarkAsClone")
+	}
+	if got := vm.TemplateSourceID(); got != "template-for-clone" {
+		t.Fatalf("got TemplateSourceID() %q, want %q", got, "template-for-clone")
+	}
+
+	clones, err := clone.ClonesFromTemplate(context.Background(), "template-for-clone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clones) != 1 || clones[0] != "uvm-clone-1" {
+		t.Fatalf("got clones %v, want [uvm-clone-1]", clones)
+	}
+}
+
+func TestTemplateSourceID_EmptyForNonClone(t *testing.T) {
+	vm := &UtilityVM{id: "uvm-not-a-clone"}
+	if vm.IsClone() {
+		t.Fatal("expected a freshly constructed uvm to not be a clone")
+	}
+	if got := vm.TemplateSourceID(); got != "" {
+		t.Fatalf("got TemplateSourceID() %q, want empty", got)
+	}
+}
+
+func TestMarkAsClone_FailsWithoutTemplateAndLeavesStateUnchanged(t *testing.T) {
+	old := clone.SetTemplateStore(clone.NewInMemoryTemplateStore())
+	defer clone.SetTemplateStore(old)
+
+	vm := &UtilityVM{id: "uvm-clone-2"}
+	if err := vm.MarkAsClone(context.Background(), "does-not-exist"); !errors.Is(err, clone.ErrTemplateNotFound) {
+		t.Fatalf("got err %v, want ErrTemplateNotFound", err)
+	}
+	if vm.IsClone() || vm.TemplateSourceID() != "" {
+		t.Fatal("expected vm to remain a non-clone after a failed MarkAsClone")
+	}
+}
+
+type fakePrioritizedCloneable struct {
+	fakeCloneable
+	name     string
+	priority int
+}
+
+func (f *fakePrioritizedCloneable) Priority() int {
+	return f.priority
+}
+
+func TestUVMTemplateConfig_OrderedResourcesIsDeterministic(t *testing.T) {
+	cfg := &UVMTemplateConfig{
+		UVMID: "template-order",
+		Resources: []Cloneable{
+			&fakePrioritizedCloneable{name: "b", priority: 5},
+			&vsmbShareTemplate{HostPath: `C:\vsmb\unprioritized`},
+			&fakePrioritizedCloneable{name: "a", priority: -1},
+			&fakePrioritizedCloneable{name: "c", priority: 5},
+		},
+	}
+
+	for i := 0; i < 5; i++ {
+		ordered := cfg.OrderedResources()
+		if len(ordered) != 4 {
+			t.Fatalf("got %d resources, want 4", len(ordered))
+		}
+		if ordered[0].(*fakePrioritizedCloneable).name != "a" {
+			t.Fatalf("run %d: got first resource %+v, want priority -1 ('a')", i, ordered[0])
+		}
+		if _, ok := ordered[1].(*vsmbShareTemplate); !ok {
+			t.Fatalf("run %d: expected the unprioritized resource (PriorityDefault=0) to sort before priority-5 ones, got %T", i, ordered[1])
+		}
+		if ordered[2].(*fakePrioritizedCloneable).name != "b" || ordered[3].(*fakePrioritizedCloneable).name != "c" {
+			t.Fatalf("run %d: expected tied priority-5 resources 'b' then 'c' to keep their original relative order, got %+v, %+v", i, ordered[2], ordered[3])
+		}
+	}
+}
+
+func TestApplyTemplateConfig_RunsResourcesInOrderAndReportsResults(t *testing.T) {
+	first := &fakePrioritizedCloneable{name: "first", priority: 5}
+	second := &fakePrioritizedCloneable{name: "second", priority: -1}
+	cfg := &UVMTemplateConfig{
+		UVMID:     "template-apply",
+		Resources: []Cloneable{first, second},
+	}
+
+	doc := &hcsschema.ComputeSystem{}
+	var order []string
+	cd := NewCloneDataWithPostCloneCallback(doc, `C:\scratch\apply-1`, "apply-1", nil, FullCopyScratchDisk, nil, RefuseWritableVSMBShare,
+		func(resource Cloneable, result interface{}, err error) {
+			order = append(order, resource.(*fakePrioritizedCloneable).name)
+		})
+
+	vm := &UtilityVM{id: "uvm-apply-1"}
+	if err := ApplyTemplateConfig(context.Background(), cfg, vm, cd); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"second", "first"}; !reflect.DeepEqual(order, want) {
+		t.Fatalf("got clone order %v, want %v (ascending priority)", order, want)
+	}
+	if first.sawUVMID != "apply-1" || second.sawUVMID != "apply-1" {
+		t.Fatal("expected both resources to see the CloneData passed to ApplyTemplateConfig, not vm's own state")
+	}
+	if vm.id != "uvm-apply-1" {
+		t.Fatal("expected ApplyTemplateConfig to leave vm untouched, only its resources' own Clone methods may mutate it")
+	}
+}
+
+func TestApplyTemplateConfig_StopsAtFirstError(t *testing.T) {
+	wantErr := errors.New("first resource failed")
+	first := &fakeCloneableWithError{err: wantErr}
+	second := &fakeCloneable{}
+	cfg := &UVMTemplateConfig{
+		UVMID:     "template-apply-err",
+		Resources: []Cloneable{first, second},
+	}
+
+	cd := NewCloneData(&hcsschema.ComputeSystem{}, `C:\scratch\apply-2`, "apply-2")
+	vm := &UtilityVM{id: "uvm-apply-2"}
+
+	err := ApplyTemplateConfig(context.Background(), cfg, vm, cd)
+	if err == nil || !errors.Is(err, wantErr) {
+		t.Fatalf("got %v, want an error wrapping %v", err, wantErr)
+	}
+	if second.sawUVMID != "" {
+		t.Fatal("expected the second resource to never be cloned once the first one failed")
+	}
+}
+
+type fakeCloneableWithError struct {
+	err error
+}
+
+func (f *fakeCloneableWithError) Clone(ctx context.Context, vm *UtilityVM, cd *CloneData) error {
+	return f.err
+}
+
+func TestCloneContainer_NoGCSConnection(t *testing.T) {
+	vm := &UtilityVM{}
+
+	_, err := vm.CloneContainer(context.Background(), "clone-container-1", nil)
+	if !errors.Is(err, ErrNoGCSConnection) {
+		t.Fatalf("expected ErrNoGCSConnection, got %v", err)
+	}
+}
+
+// TestCloneContainer_ProtocolMismatch stands fakeGCSServer in for a guest
+// reporting an incompatible protocol version, by connecting to it for real
+// (so vm.protocol is genuinely populated from the negotiated version) and
+// then raising minCloneContainerProtocol above whatever that turned out to
+// be, the same effect as the guest having negotiated an older version than
+// this host requires.
+func TestCloneContainer_ProtocolMismatch(t *testing.T) {
+	client, server := net.Pipe()
+	go fakeGCSServer(t, server)
+
+	vm := &UtilityVM{}
+	if err := vm.ConnectExternalGCS(context.Background(), client); err != nil {
+		t.Fatal(err)
+	}
+
+	old := SetMinCloneContainerProtocol(vm.protocol + 1)
+	defer SetMinCloneContainerProtocol(old)
+
+	_, err := vm.CloneContainer(context.Background(), "clone-container-1", nil)
+	if !errors.Is(err, ErrCloneProtocolMismatch) {
+		t.Fatalf("expected ErrCloneProtocolMismatch, got %v", err)
+	}
+}
+
+// fakeGCSHeaderSize/fakeGCSMsgType*/fakeGCSRpc* mirror the unexported
+// wire-format constants in package gcs (hdrSize and the header layout in
+// bridge.go, and the rpcNegotiateProtocol/rpcCreate values in protocol.go).
+// They're duplicated here, rather than imported, because gcs doesn't export
+// them; fakeGCSServer below only needs to speak the same bytes a real GCS
+// bridge would.
+const (
+	fakeGCSHeaderSize           = 16
+	fakeGCSMsgTypeResponse      = 0x20100000
+	fakeGCSMsgTypeMask          = 0xfff00000
+	fakeGCSRpcCreate            = 1<<8 | 1
+	fakeGCSRpcNegotiateProtocol = 11<<8 | 1
+)
+
+// fakeGCSServer answers just enough of the GCS bridge protocol - protocol
+// negotiation and container creation - for ConnectExternalGCS and
+// CloneContainer to succeed against it, and stops as soon as `rw` is closed
+// or an unrecognized request arrives.
+func fakeGCSServer(t *testing.T, rw io.ReadWriteCloser) {
+	defer rw.Close()
+	for {
+		id, typ, err := readFakeGCSMessage(rw)
+		if err != nil {
+			return
+		}
+		switch typ &^ fakeGCSMsgTypeMask {
+		case fakeGCSRpcNegotiateProtocol:
+			writeFakeGCSMessage(t, rw, fakeGCSMsgTypeResponse|fakeGCSRpcNegotiateProtocol, id, map[string]interface{}{
+				"Result":  0,
+				"Version": 4,
+				"Capabilities": map[string]interface{}{
+					"RuntimeOsType": "linux",
+				},
+			})
+		case fakeGCSRpcCreate:
+			writeFakeGCSMessage(t, rw, fakeGCSMsgTypeResponse|fakeGCSRpcCreate, id, map[string]interface{}{"Result": 0})
+		default:
+			return
+		}
+	}
+}
+
+func readFakeGCSMessage(r io.Reader) (id int64, typ uint32, err error) {
+	var h [fakeGCSHeaderSize]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return 0, 0, err
+	}
+	typ = binary.LittleEndian.Uint32(h[0:])
+	n := binary.LittleEndian.Uint32(h[4:])
+	id = int64(binary.LittleEndian.Uint64(h[8:]))
+	if _, err := io.ReadFull(r, make([]byte, n-fakeGCSHeaderSize)); err != nil {
+		return 0, 0, err
+	}
+	return id, typ, nil
+}
+
+func writeFakeGCSMessage(t *testing.T, w io.Writer, typ uint32, id int64, msg interface{}) {
+	t.Helper()
+	body, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var h [fakeGCSHeaderSize]byte
+	binary.LittleEndian.PutUint32(h[0:], typ)
+	binary.LittleEndian.PutUint32(h[4:], uint32(len(body)+fakeGCSHeaderSize))
+	binary.LittleEndian.PutUint64(h[8:], uint64(id))
+	if _, err := w.Write(h[:]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(body); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConnectExternalGCS_EnablesCloneContainer(t *testing.T) {
+	client, server := net.Pipe()
+	go fakeGCSServer(t, server)
+
+	vm := &UtilityVM{}
+
+	if _, err := vm.CloneContainer(context.Background(), "clone-container-1", nil); !errors.Is(err, ErrNoGCSConnection) {
+		client.Close()
+		t.Fatalf("expected ErrNoGCSConnection before ConnectExternalGCS, got %v", err)
+	}
+
+	if err := vm.ConnectExternalGCS(context.Background(), client); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := vm.CloneContainer(context.Background(), "clone-container-1", nil)
+	if err != nil {
+		t.Fatalf("expected CloneContainer to succeed after ConnectExternalGCS, got %v", err)
+	}
+	c.Close()
+}
+
+func TestCloneContainer_InvokesReattachCallback(t *testing.T) {
+	vm := &UtilityVM{}
+
+	var gotID string
+	var gotErr error
+	called := false
+	vm.SetCloneReattachCallback(func(id string, err error) {
+		called = true
+		gotID = id
+		gotErr = err
+	})
+
+	_, err := vm.CloneContainer(context.Background(), "clone-container-1", nil)
+
+	if !called {
+		t.Fatal("expected the reattach callback to be invoked")
+	}
+	if gotID != "clone-container-1" {
+		t.Fatalf("got id %q, want clone-container-1", gotID)
+	}
+	if !errors.Is(gotErr, ErrNoGCSConnection) || !errors.Is(err, ErrNoGCSConnection) {
+		t.Fatalf("expected the callback and the return value to both surface ErrNoGCSConnection, got callback=%v return=%v", gotErr, err)
+	}
+}
+
+func TestCloneContainer_NoCallbackRegisteredIsSafe(t *testing.T) {
+	vm := &UtilityVM{}
+
+	if _, err := vm.CloneContainer(context.Background(), "clone-container-1", nil); !errors.Is(err, ErrNoGCSConnection) {
+		t.Fatalf("expected ErrNoGCSConnection, got %v", err)
+	}
+}
+
+func TestRunWithTimeout_ReturnsResultWhenFnFinishesInTime(t *testing.T) {
+	c, err := runWithTimeout(context.Background(), time.Minute, func(ctx context.Context) (cow.Container, error) {
+		return nil, errors.New("fn error")
+	})
+	if c != nil {
+		t.Fatalf("got container %v, want nil", c)
+	}
+	if err == nil || err.Error() != "fn error" {
+		t.Fatalf("got err %v, want fn error", err)
+	}
+}
+
+func TestRunWithTimeout_ReturnsCtxErrWhenFnBlocksPastTimeout(t *testing.T) {
+	started := make(chan struct{})
+	_, err := runWithTimeout(context.Background(), time.Millisecond, func(ctx context.Context) (cow.Container, error) {
+		close(started)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	<-started
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got err %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestRunWithTimeout_ReturnsCtxErrWhenParentCtxCancelledFirst(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	fnStarted := make(chan struct{})
+	fnDone := make(chan struct{})
+
+	go func() {
+		cancel()
+	}()
+
+	_, err := runWithTimeout(ctx, time.Minute, func(ctx context.Context) (cow.Container, error) {
+		close(fnStarted)
+		<-ctx.Done()
+		close(fnDone)
+		return nil, ctx.Err()
+	})
+	<-fnStarted
+	<-fnDone
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got err %v, want context.Canceled", err)
+	}
+}
+
+func TestNetNSIDs(t *testing.T) {
+	vm := &UtilityVM{
+		namespaces: map[string]*namespaceInfo{
+			"ns-1": {nics: map[string]*nicInfo{}},
+			"ns-2": {nics: map[string]*nicInfo{}},
+		},
+	}
+
+	ids := vm.NetNSIDs()
+	sort.Strings(ids)
+	want := []string{"ns-1", "ns-2"}
+	if !reflect.DeepEqual(ids, want) {
+		t.Fatalf("got %v, want %v", ids, want)
+	}
+}
+
+func TestNetNSIDs_NoNamespaces(t *testing.T) {
+	vm := &UtilityVM{}
+	if ids := vm.NetNSIDs(); len(ids) != 0 {
+		t.Fatalf("got %v, want none", ids)
+	}
+}
+
+func TestOrderIPv4BeforeIPv6(t *testing.T) {
+	v4Only := &hns.HNSEndpoint{Id: "v4-only", IPAddress: net.ParseIP("10.0.0.1")}
+	v6Only := &hns.HNSEndpoint{Id: "v6-only", IPv6Address: net.ParseIP("fd00::1")}
+	dualStack := &hns.HNSEndpoint{Id: "dual-stack", IPAddress: net.ParseIP("10.0.0.2"), IPv6Address: net.ParseIP("fd00::2")}
+
+	ordered := orderIPv4BeforeIPv6([]*hns.HNSEndpoint{v6Only, v4Only, dualStack})
+
+	want := []string{"v4-only", "dual-stack", "v6-only"}
+	var got []string
+	for _, e := range ordered {
+		got = append(got, e.Id)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got order %v, want %v", got, want)
+	}
+}
+
+func TestOrderIPv4BeforeIPv6_StableAmongEqualFamily(t *testing.T) {
+	a := &hns.HNSEndpoint{Id: "a", IPAddress: net.ParseIP("10.0.0.1")}
+	b := &hns.HNSEndpoint{Id: "b", IPAddress: net.ParseIP("10.0.0.2")}
+
+	ordered := orderIPv4BeforeIPv6([]*hns.HNSEndpoint{a, b})
+
+	if ordered[0].Id != "a" || ordered[1].Id != "b" {
+		t.Fatalf("expected original relative order to be preserved, got %+v", ordered)
+	}
+}
+
+func TestValidateDualStackEndpoints_MissingIPv6(t *testing.T) {
+	endpoints := []*hns.HNSEndpoint{
+		{Id: "endpoint-1", IPAddress: net.ParseIP("10.0.0.1")},
+	}
+
+	err := validateDualStackEndpoints(endpoints)
+	if err == nil {
+		t.Fatal("expected an error for a missing IPv6 address")
+	}
+	if !strings.Contains(err.Error(), "endpoint-1") || !strings.Contains(err.Error(), "IPv6") {
+		t.Fatalf("expected the error to name the endpoint and the missing family, got %v", err)
+	}
+}
+
+func TestValidateDualStackEndpoints_MissingIPv4(t *testing.T) {
+	endpoints := []*hns.HNSEndpoint{
+		{Id: "endpoint-1", IPv6Address: net.ParseIP("fd00::1")},
+	}
+
+	err := validateDualStackEndpoints(endpoints)
+	if err == nil {
+		t.Fatal("expected an error for a missing IPv4 address")
+	}
+	if !strings.Contains(err.Error(), "endpoint-1") || !strings.Contains(err.Error(), "IPv4") {
+		t.Fatalf("expected the error to name the endpoint and the missing family, got %v", err)
+	}
+}
+
+func TestValidateDualStackEndpoints_AllDualStackIsValid(t *testing.T) {
+	endpoints := []*hns.HNSEndpoint{
+		{Id: "endpoint-1", IPAddress: net.ParseIP("10.0.0.1"), IPv6Address: net.ParseIP("fd00::1")},
+	}
+
+	if err := validateDualStackEndpoints(endpoints); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+}
+
+func TestAddEndpointsToNSWithOptions_RequireDualStackRejectsSingleStack(t *testing.T) {
+	vm := &UtilityVM{
+		namespaces: map[string]*namespaceInfo{
+			"ns-1": {nics: map[string]*nicInfo{}},
+		},
+	}
+	endpoints := []*hns.HNSEndpoint{
+		{Id: "endpoint-1", IPAddress: net.ParseIP("10.0.0.1")},
+	}
+
+	err := vm.AddEndpointsToNSWithOptions(context.Background(), "ns-1", endpoints, AddEndpointsToNSOptions{RequireDualStack: true})
+	if err == nil {
+		t.Fatal("expected an error for a single-stack endpoint")
+	}
+	if len(vm.namespaces["ns-1"].nics) != 0 {
+		t.Fatal("expected no endpoint to be added when validation fails")
+	}
+}
+
+func TestReattachNetworkNamespace_MatchingEndpointsHaveNoDrift(t *testing.T) {
+	nicID, err := guid.NewV4()
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm := &UtilityVM{
+		namespaces: map[string]*namespaceInfo{
+			"ns-1": {
+				nics: map[string]*nicInfo{
+					"endpoint-1": {ID: nicID, Endpoint: &hns.HNSEndpoint{Id: "endpoint-1"}},
+				},
+			},
+		},
+	}
+
+	endpoints, drift, err := vm.reattachNetworkNamespace("ns-1", []string{"endpoint-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if drift.HasDrift() {
+		t.Fatalf("expected no drift, got %+v", drift)
+	}
+	if len(endpoints.EndpointIDs) != 1 || endpoints.EndpointIDs[0] != "endpoint-1" {
+		t.Fatalf("got %+v", endpoints)
+	}
+	if endpoints.Namespace != "ns-1" {
+		t.Fatalf("got namespace %q, want ns-1", endpoints.Namespace)
+	}
+	// The pre-existing NIC's tracked info, including its GUID, must survive
+	// untouched - reattaching a namespace that hasn't drifted shouldn't
+	// disturb bookkeeping a later RemoveNetNS depends on.
+	if got := vm.namespaces["ns-1"].nics["endpoint-1"].ID; got != nicID {
+		t.Fatalf("got nic ID %v, want %v", got, nicID)
+	}
+}
+
+func TestReattachNetworkNamespace_DetectsDrift(t *testing.T) {
+	trackedNicID, err := guid.NewV4()
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm := &UtilityVM{
+		namespaces: map[string]*namespaceInfo{
+			"ns-1": {
+				nics: map[string]*nicInfo{
+					"stale-endpoint": {ID: trackedNicID, Endpoint: &hns.HNSEndpoint{Id: "stale-endpoint"}},
+				},
+			},
+		},
+	}
+
+	endpoints, drift, err := vm.reattachNetworkNamespace("ns-1", []string{"fresh-endpoint"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(drift.MissingInUVM) != 1 || drift.MissingInUVM[0] != "fresh-endpoint" {
+		t.Fatalf("got MissingInUVM %v, want [fresh-endpoint]", drift.MissingInUVM)
+	}
+	if len(drift.MissingInHNS) != 1 || drift.MissingInHNS[0] != "stale-endpoint" {
+		t.Fatalf("got MissingInHNS %v, want [stale-endpoint]", drift.MissingInHNS)
+	}
+	if len(endpoints.EndpointIDs) != 1 || endpoints.EndpointIDs[0] != "fresh-endpoint" {
+		t.Fatalf("got %+v", endpoints)
+	}
+
+	ns := vm.namespaces["ns-1"]
+	if _, ok := ns.nics["stale-endpoint"]; ok {
+		t.Fatal("expected stale-endpoint to be dropped from tracking")
+	}
+	if _, ok := ns.nics["fresh-endpoint"]; !ok {
+		t.Fatal("expected fresh-endpoint to be recorded in tracking")
+	}
+}
+
+func TestReattachNetworkNamespace_UntrackedNamespaceIsAdopted(t *testing.T) {
+	vm := &UtilityVM{}
+
+	endpoints, drift, err := vm.reattachNetworkNamespace("ns-unknown", []string{"endpoint-1", "endpoint-2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(drift.MissingInUVM) != 2 {
+		t.Fatalf("got MissingInUVM %v, want 2 entries", drift.MissingInUVM)
+	}
+	if len(drift.MissingInHNS) != 0 {
+		t.Fatalf("got MissingInHNS %v, want none", drift.MissingInHNS)
+	}
+	if len(endpoints.EndpointIDs) != 2 {
+		t.Fatalf("got %+v", endpoints)
+	}
+	if ns, ok := vm.namespaces["ns-unknown"]; !ok || len(ns.nics) != 2 {
+		t.Fatalf("expected namespace to be adopted with both endpoints tracked, got %+v", vm.namespaces["ns-unknown"])
+	}
+}
+
+func TestReconcileCloneNamespace_NoMismatchForConsistentClone(t *testing.T) {
+	vm := &UtilityVM{
+		isClone: true,
+		namespaces: map[string]*namespaceInfo{
+			CLONING_DEFAULT_NETWORK_NAMESPACE_ID: {nics: map[string]*nicInfo{}},
+		},
+	}
+
+	hnsEndpoints := []*hns.HNSEndpoint{
+		{Id: "endpoint-1", Namespace: &hns.Namespace{ID: "real-nsid"}},
+	}
+
+	mismatch, err := vm.reconcileCloneNamespace("real-nsid", SharedCloneNamespaceID, hnsEndpoints)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mismatch.HasMismatch() {
+		t.Fatalf("expected no mismatch, got %+v", mismatch)
+	}
+}
+
+func TestReconcileCloneNamespace_DetectsInUVMNSIDMismatch(t *testing.T) {
+	vm := &UtilityVM{
+		isClone: true,
+		namespaces: map[string]*namespaceInfo{
+			"some-other-nsid": {nics: map[string]*nicInfo{}},
+		},
+	}
+
+	mismatch, err := vm.reconcileCloneNamespace("real-nsid", SharedCloneNamespaceID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !mismatch.HasMismatch() {
+		t.Fatal("expected a mismatch")
+	}
+	if mismatch.WantInUVMNSID != CLONING_DEFAULT_NETWORK_NAMESPACE_ID {
+		t.Fatalf("got WantInUVMNSID %q, want %q", mismatch.WantInUVMNSID, CLONING_DEFAULT_NETWORK_NAMESPACE_ID)
+	}
+	if mismatch.GotInUVMNSID != "some-other-nsid" {
+		t.Fatalf("got GotInUVMNSID %q, want some-other-nsid", mismatch.GotInUVMNSID)
+	}
+}
+
+func TestReconcileCloneNamespace_DetectsMisboundEndpoints(t *testing.T) {
+	vm := &UtilityVM{
+		isClone: true,
+		namespaces: map[string]*namespaceInfo{
+			CLONING_DEFAULT_NETWORK_NAMESPACE_ID: {nics: map[string]*nicInfo{}},
+		},
+	}
+
+	hnsEndpoints := []*hns.HNSEndpoint{
+		{Id: "endpoint-1", Namespace: &hns.Namespace{ID: "real-nsid"}},
+		{Id: "endpoint-2", Namespace: &hns.Namespace{ID: "some-stale-nsid"}},
+		{Id: "endpoint-3", Namespace: nil},
+	}
+
+	mismatch, err := vm.reconcileCloneNamespace("real-nsid", SharedCloneNamespaceID, hnsEndpoints)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"endpoint-2", "endpoint-3"}
+	if !reflect.DeepEqual(mismatch.MisboundEndpoints, want) {
+		t.Fatalf("got MisboundEndpoints %v, want %v", mismatch.MisboundEndpoints, want)
+	}
+}
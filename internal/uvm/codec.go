@@ -0,0 +1,152 @@
+package uvm
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// Codec is a pluggable serialization strategy for UVMTemplateConfig,
+// selectable at save time via SetDefaultTemplateCodec and registered under a
+// name with RegisterCodec. The name used to encode is recorded in the
+// header EncodeTemplateConfig prepends to the result, so DecodeTemplateConfig
+// picks the matching codec back out regardless of which codec is currently
+// the default.
+type Codec interface {
+	Encode(cfg *UVMTemplateConfig) ([]byte, error)
+	Decode(data []byte) (*UVMTemplateConfig, error)
+}
+
+// gobCodecName is the name gobCodec is registered under, and the default
+// codec name used by EncodeTemplateConfig until SetDefaultTemplateCodec
+// changes it. Gob is also the legacy format: a blob with no recognized
+// header is assumed to be a config saved before this header existed, and is
+// decoded as plain gob.
+const gobCodecName = "gob"
+
+// gobCodec is the Codec this package has always used for real persistence
+// (GenerateTemplateConfig/SaveAsTemplate/ReconstructTemplateConfig).
+type gobCodec struct{}
+
+func (gobCodec) Encode(cfg *UVMTemplateConfig) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(cfg); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Decode(data []byte) (*UVMTemplateConfig, error) {
+	var cfg UVMTemplateConfig
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&cfg); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// jsonCodec is a Codec built on UVMTemplateConfig's existing MarshalJSON/
+// UnmarshalJSON, for interop with tooling that would rather not link gob's
+// wire format. Not registered by default; register it with RegisterCodec if
+// wanted.
+type jsonCodec struct{}
+
+func (jsonCodec) Encode(cfg *UVMTemplateConfig) ([]byte, error) {
+	return json.Marshal(cfg)
+}
+
+func (jsonCodec) Decode(data []byte) (*UVMTemplateConfig, error) {
+	var cfg UVMTemplateConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// JSONCodec is the Codec built on UVMTemplateConfig's MarshalJSON/
+// UnmarshalJSON; register it under a name with RegisterCodec to make it
+// available to SetDefaultTemplateCodec.
+var JSONCodec Codec = jsonCodec{}
+
+var (
+	codecsMu = sync.Mutex{}
+	codecs   = map[string]Codec{gobCodecName: gobCodec{}}
+	// defaultCodecName is the codec name EncodeTemplateConfig uses, set by
+	// SetDefaultTemplateCodec.
+	defaultCodecName = gobCodecName
+)
+
+// RegisterCodec makes `codec` available under `name` for
+// SetDefaultTemplateCodec and for DecodeTemplateConfig to pick a matching
+// codec out of a blob's header. Registering under an already-registered name
+// (including "gob") replaces it.
+func RegisterCodec(name string, codec Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[name] = codec
+}
+
+// SetDefaultTemplateCodec selects, by name, the codec EncodeTemplateConfig
+// uses, returning the previous default so a caller (typically a test) can
+// restore it. The name must already be registered via RegisterCodec (gob is
+// registered by default); otherwise this returns an error and leaves the
+// default unchanged.
+func SetDefaultTemplateCodec(name string) (old string, err error) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	if _, ok := codecs[name]; !ok {
+		return "", fmt.Errorf("no codec registered under %q, see RegisterCodec", name)
+	}
+	old = defaultCodecName
+	defaultCodecName = name
+	return old, nil
+}
+
+// codecHeaderSeparator terminates the codec-name header EncodeTemplateConfig
+// prepends to its output. Codec names are short ASCII identifiers, so this
+// can't appear as part of one.
+const codecHeaderSeparator = '\n'
+
+// EncodeTemplateConfig serializes cfg with the codec selected by
+// SetDefaultTemplateCodec (gob by default), prepending a small header naming
+// that codec so DecodeTemplateConfig can find it again later regardless of
+// what the default codec is by then.
+func EncodeTemplateConfig(cfg *UVMTemplateConfig) ([]byte, error) {
+	codecsMu.Lock()
+	name := defaultCodecName
+	codec := codecs[name]
+	codecsMu.Unlock()
+
+	payload, err := codec.Encode(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode template config with codec %q: %w", name, err)
+	}
+	header := append([]byte(name), codecHeaderSeparator)
+	return append(header, payload...), nil
+}
+
+// DecodeTemplateConfig decodes a blob produced by EncodeTemplateConfig,
+// selecting the codec its header names. If `data` has no recognizable
+// header - e.g. it was saved before this header existed - it falls back to
+// plain gob, the format every such config was written in.
+func DecodeTemplateConfig(data []byte) (*UVMTemplateConfig, error) {
+	if i := bytes.IndexByte(data, codecHeaderSeparator); i >= 0 {
+		name := string(data[:i])
+		codecsMu.Lock()
+		codec, ok := codecs[name]
+		codecsMu.Unlock()
+		if ok {
+			cfg, err := codec.Decode(data[i+1:])
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode template config with codec %q: %w", name, err)
+			}
+			return cfg, nil
+		}
+	}
+	cfg, err := gobCodec{}.Decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode template config: no recognized codec header, and legacy gob decoding also failed: %w", err)
+	}
+	return cfg, nil
+}
@@ -146,6 +146,64 @@ func (uvm *UtilityVM) OS() string {
 	return uvm.operatingSystem
 }
 
+// IsTemplate returns true if the UVM has been saved as a template that other
+// UVMs can be cloned from.
+func (uvm *UtilityVM) IsTemplate() bool {
+	return uvm.isTemplate
+}
+
+// IsClone returns true if the UVM was created by cloning a template UVM.
+func (uvm *UtilityVM) IsClone() bool {
+	return uvm.isClone
+}
+
+// TemplateSourceID returns the ID of the template this UVM was cloned from,
+// as recorded by MarkAsClone, or "" if it isn't a clone (IsClone() is
+// false).
+func (uvm *UtilityVM) TemplateSourceID() string {
+	return uvm.templateSourceID
+}
+
+// SetLayerFolders records the host paths of the container image layers
+// mounted into the UVM, so a later GenerateTemplateConfig can capture them
+// for clones to reconstitute.
+func (uvm *UtilityVM) SetLayerFolders(folders []string) {
+	uvm.layerFolders = folders
+}
+
+// LayerFolders returns the host paths of the container image layers recorded
+// via SetLayerFolders.
+func (uvm *UtilityVM) LayerFolders() []string {
+	return uvm.layerFolders
+}
+
+// SetCimLayers records the host paths of the CimFS combined-layer CIMs
+// mounted into the UVM, so a later GenerateTemplateConfig can capture them
+// for clones to reconstitute via cimLayerTemplate.Clone.
+func (uvm *UtilityVM) SetCimLayers(cims []string) {
+	uvm.cimLayers = cims
+}
+
+// CimLayers returns the host paths of the CimFS combined-layer CIMs recorded
+// via SetCimLayers.
+func (uvm *UtilityVM) CimLayers() []string {
+	return uvm.cimLayers
+}
+
+// SetRAMScratchSize records that this UVM was set up with a RAM-backed
+// scratch of `sizeInBytes`, so a later GenerateTemplateConfig can capture it
+// for clones to reconstitute via ramScratchTemplate.Clone. `sizeInBytes` <= 0
+// means no RAM-backed scratch, the default.
+func (uvm *UtilityVM) SetRAMScratchSize(sizeInBytes int64) {
+	uvm.ramScratchSizeInBytes = sizeInBytes
+}
+
+// RAMScratchSize returns the size recorded via SetRAMScratchSize, or 0 if
+// none was set.
+func (uvm *UtilityVM) RAMScratchSize() int64 {
+	return uvm.ramScratchSizeInBytes
+}
+
 func (uvm *UtilityVM) create(ctx context.Context, doc interface{}) error {
 	uvm.exitCh = make(chan struct{})
 	system, err := hcs.CreateComputeSystem(ctx, uvm.id, doc)
@@ -26,3 +26,28 @@ func TestCreateWCOWBadLayerFolders(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestIsTemplateIsClone(t *testing.T) {
+	tests := []struct {
+		name         string
+		isTemplate   bool
+		isClone      bool
+		wantTemplate bool
+		wantClone    bool
+	}{
+		{name: "normal", isTemplate: false, isClone: false, wantTemplate: false, wantClone: false},
+		{name: "template", isTemplate: true, isClone: false, wantTemplate: true, wantClone: false},
+		{name: "clone", isTemplate: false, isClone: true, wantTemplate: false, wantClone: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm := &UtilityVM{isTemplate: tt.isTemplate, isClone: tt.isClone}
+			if got := vm.IsTemplate(); got != tt.wantTemplate {
+				t.Errorf("IsTemplate() = %v, want %v", got, tt.wantTemplate)
+			}
+			if got := vm.IsClone(); got != tt.wantClone {
+				t.Errorf("IsClone() = %v, want %v", got, tt.wantClone)
+			}
+		})
+	}
+}
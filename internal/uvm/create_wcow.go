@@ -45,7 +45,6 @@ func NewDefaultOptionsWCOW(id, owner string) *OptionsWCOW {
 //
 // WCOW Notes:
 //   - The scratch is always attached to SCSI 0:0
-//
 func CreateWCOW(ctx context.Context, opts *OptionsWCOW) (_ *UtilityVM, err error) {
 	ctx, span := trace.StartSpan(ctx, "uvm::CreateWCOW")
 	defer span.End()
@@ -1,10 +1,14 @@
 package uvm
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"net"
 	"os"
+	"sort"
+	"strings"
 
 	"github.com/Microsoft/go-winio/pkg/guid"
 	"github.com/Microsoft/hcsshim/hcn"
@@ -24,14 +28,171 @@ var (
 	// ErrNetNSNotFound is an error indicating the guest UVM does not have a
 	// network namespace by this id.
 	ErrNetNSNotFound = errors.New("network namespace not found")
+	// ErrEndpointAddressConflict is returned (wrapped) by
+	// NetworkEndpoints.Clone when a captured endpoint's addressing no
+	// longer matches the live HNS endpoint of the same ID, e.g. because HNS
+	// reassigned it after the template was saved. Match with errors.Is; the
+	// concrete error also carries both addressings, for diagnosing the
+	// drift.
+	ErrEndpointAddressConflict = errors.New("network endpoint addressing conflicts with template's captured addressing")
 )
 
+// EndpointAddressing captures a single network endpoint's IP/MAC addressing,
+// so a template's clones can be checked against it instead of silently
+// picking up whatever addressing HNS happens to report at clone time.
+type EndpointAddressing struct {
+	MacAddress  string
+	IPAddress   net.IP
+	IPv6Address net.IP
+}
+
+// addressingMatches reports whether live's addressing matches captured.
+// A zero value in captured means that field wasn't recorded, not that it
+// must be empty, so it's skipped rather than compared.
+func addressingMatches(captured EndpointAddressing, live *hns.HNSEndpoint) bool {
+	if captured.MacAddress != "" && !strings.EqualFold(captured.MacAddress, live.MacAddress) {
+		return false
+	}
+	if len(captured.IPAddress) > 0 && !captured.IPAddress.Equal(live.IPAddress) {
+		return false
+	}
+	if len(captured.IPv6Address) > 0 && !captured.IPv6Address.Equal(live.IPv6Address) {
+		return false
+	}
+	return true
+}
+
+// addressConflictError wraps ErrEndpointAddressConflict with the endpoint ID
+// and both addressings involved.
+type addressConflictError struct {
+	endpointID string
+	want, got  EndpointAddressing
+}
+
+func (e *addressConflictError) Error() string {
+	return fmt.Sprintf("network endpoint '%s' addressing %+v conflicts with template's captured addressing %+v", e.endpointID, e.got, e.want)
+}
+
+func (e *addressConflictError) Is(target error) bool {
+	return target == ErrEndpointAddressConflict
+}
+
 // NetworkEndpoints is a struct containing all of the endpoint IDs of a network
 // namespace.
 type NetworkEndpoints struct {
 	EndpointIDs []string
 	// ID of the namespace the endpoints belong to
 	Namespace string
+	// Addressing captures each endpoint's IP/MAC addressing as of when this
+	// NetworkEndpoints was captured for a template - see
+	// NewNetworkEndpointsTemplate - keyed by endpoint ID, so Clone can
+	// detect drift instead of silently cloning a namespace with different
+	// addressing than the template had. Nil for a NetworkEndpoints built
+	// outside template capture, e.g. by createNetworkNamespace, where
+	// there's nothing yet to compare against.
+	Addressing map[string]EndpointAddressing
+}
+
+// NewNetworkEndpointsTemplate builds a NetworkEndpoints for namespace `id`
+// with `endpointIDs`, capturing each live endpoint's IP/MAC addressing so a
+// later Clone can detect if HNS has since reassigned it - see
+// EndpointAddressing. It's the network counterpart of newVSMBShareTemplate
+// and friends in clone.go, for a caller assembling a UVMTemplateConfig's
+// Resources to include the current network namespace.
+func NewNetworkEndpointsTemplate(id string, endpointIDs []string) (*NetworkEndpoints, error) {
+	addressing := make(map[string]EndpointAddressing, len(endpointIDs))
+	for _, endpointID := range endpointIDs {
+		endpoint, err := hns.GetHNSEndpointByID(endpointID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to capture addressing for network endpoint '%s': %w", endpointID, err)
+		}
+		addressing[endpointID] = EndpointAddressing{
+			MacAddress:  endpoint.MacAddress,
+			IPAddress:   endpoint.IPAddress,
+			IPv6Address: endpoint.IPv6Address,
+		}
+	}
+	return &NetworkEndpoints{
+		EndpointIDs: endpointIDs,
+		Namespace:   id,
+		Addressing:  addressing,
+	}, nil
+}
+
+// Clone recreates the network namespace and its endpoints inside the clone
+// UVM `vm`, remapping Namespace the same way SetupNetworkNamespace would (see
+// CLONING_DEFAULT_NETWORK_NAMESPACE_ID) so the namespace ID matches what's
+// baked into the template's GCS bridge state. If endpoints.Addressing was
+// captured (see NewNetworkEndpointsTemplate) and no longer matches the live
+// endpoint of the same ID, this returns an error matching
+// errors.Is(err, ErrEndpointAddressConflict) instead of cloning a namespace
+// with different addressing than the template had.
+func (endpoints *NetworkEndpoints) Clone(ctx context.Context, vm *UtilityVM, cd *CloneData) error {
+	return cd.runBounded(ctx, "network-endpoints", func(ctx context.Context) error {
+		return endpoints.clone(ctx, vm)
+	})
+}
+
+// clone is Clone's work, run under cd.runBounded.
+func (endpoints *NetworkEndpoints) clone(ctx context.Context, vm *UtilityVM) error {
+	nsidInsideUVM, err := vm.NetNSIDInsideUVM(endpoints.Namespace, SharedCloneNamespaceID)
+	if err != nil {
+		return err
+	}
+
+	hnsEndpoints := make([]*hns.HNSEndpoint, 0, len(endpoints.EndpointIDs))
+	for _, id := range endpoints.EndpointIDs {
+		endpoint, err := hns.GetHNSEndpointByID(id)
+		if err != nil {
+			return fmt.Errorf("failed to clone network endpoint '%s': %w", id, err)
+		}
+		if captured, ok := endpoints.Addressing[id]; ok && !addressingMatches(captured, endpoint) {
+			return &addressConflictError{
+				endpointID: id,
+				want:       captured,
+				got: EndpointAddressing{
+					MacAddress:  endpoint.MacAddress,
+					IPAddress:   endpoint.IPAddress,
+					IPv6Address: endpoint.IPv6Address,
+				},
+			}
+		}
+		rewriteNamespacePolicies(endpoint, endpoints.Namespace, nsidInsideUVM)
+		hnsEndpoints = append(hnsEndpoints, endpoint)
+	}
+
+	if err := vm.AddNetNS(ctx, nsidInsideUVM); err != nil {
+		return fmt.Errorf("failed to clone network namespace '%s': %w", nsidInsideUVM, err)
+	}
+	if err := vm.AddEndpointsToNS(ctx, nsidInsideUVM, hnsEndpoints); err != nil {
+		return fmt.Errorf("failed to clone endpoints into network namespace '%s': %w", nsidInsideUVM, err)
+	}
+	return nil
+}
+
+// rewriteNamespacePolicies rewrites any of endpoint's policy blobs that embed
+// oldNamespace as a raw string reference (e.g. an ACL policy scoped to the
+// template's namespace ID) to newNamespace instead, so the policy still
+// applies once the endpoint is re-added under the clone's in-UVM namespace.
+// endpoint.Namespace itself isn't touched by this - HNS repopulates it -
+// only the opaque policy payloads, which HNS doesn't rewrite for us.
+// Policies with no such reference are left byte-for-byte untouched.
+func rewriteNamespacePolicies(endpoint *hns.HNSEndpoint, oldNamespace, newNamespace string) {
+	if oldNamespace == newNamespace {
+		return
+	}
+	old := []byte(oldNamespace)
+	new := []byte(newNamespace)
+	for i, policy := range endpoint.Policies {
+		if bytes.Contains(policy, old) {
+			endpoint.Policies[i] = bytes.ReplaceAll(policy, old, new)
+		}
+	}
+}
+
+// ResourceID returns the namespace ID, for uvm.ByResourceID.
+func (endpoints *NetworkEndpoints) ResourceID() string {
+	return endpoints.Namespace
 }
 
 // Release releases the resources for all of the network endpoints in a namespace.
@@ -56,6 +217,51 @@ func (endpoints *NetworkEndpoints) Release(ctx context.Context) error {
 	return nil
 }
 
+// HasNetNS returns true if the UVM already has a network namespace matching
+// `id` hot-added, e.g. because it was added before a shim restart and is
+// being reattached to rather than created fresh.
+func (uvm *UtilityVM) HasNetNS(id string) bool {
+	uvm.m.Lock()
+	defer uvm.m.Unlock()
+	_, ok := uvm.namespaces[id]
+	return ok
+}
+
+// NetNSIDs returns the IDs of every network namespace currently hot-added to
+// the UVM, in no particular order.
+func (uvm *UtilityVM) NetNSIDs() []string {
+	uvm.m.Lock()
+	defer uvm.m.Unlock()
+	ids := make([]string, 0, len(uvm.namespaces))
+	for id := range uvm.namespaces {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// NamespaceEndpointIDs returns the IDs of the endpoints the UVM currently has
+// hot-added into network namespace `id`, and whether the namespace exists at
+// all. It reflects the UVM's own bookkeeping of what it has hot-added, not a
+// live query of the guest - this package has no call into the GCS bridge to
+// ask the guest what it actually has - so it catches AddEndpointsToNS having
+// silently failed to record an endpoint it should have, but not the guest
+// itself having lost track of one HNS still believes is present.
+func (uvm *UtilityVM) NamespaceEndpointIDs(id string) (ids []string, found bool) {
+	uvm.m.Lock()
+	defer uvm.m.Unlock()
+	ns, ok := uvm.namespaces[id]
+	if !ok {
+		return nil, false
+	}
+	ids = make([]string, 0, len(ns.nics))
+	for epID, ninfo := range ns.nics {
+		if ninfo != nil {
+			ids = append(ids, epID)
+		}
+	}
+	return ids, true
+}
+
 // AddNetNS adds network namespace inside the guest.
 //
 // If a namespace with `id` already exists returns `ErrNetNSAlreadyAttached`.
@@ -96,12 +302,43 @@ func (uvm *UtilityVM) AddNetNS(ctx context.Context, id string) error {
 	return nil
 }
 
-// AddEndpointsToNS adds all unique `endpoints` to the network namespace
-// matching `id`. On failure does not roll back any previously successfully
-// added endpoints.
+// AddEndpointsToNS is AddEndpointsToNSWithOptions with no dual-stack
+// requirement.
+func (uvm *UtilityVM) AddEndpointsToNS(ctx context.Context, id string, endpoints []*hns.HNSEndpoint) error {
+	return uvm.AddEndpointsToNSWithOptions(ctx, id, endpoints, AddEndpointsToNSOptions{})
+}
+
+// AddEndpointsToNSOptions controls AddEndpointsToNSWithOptions.
+type AddEndpointsToNSOptions struct {
+	// RequireDualStack, if true, requires every endpoint in the call to carry
+	// both an IPv4 address (HNSEndpoint.IPAddress) and an IPv6 address
+	// (HNSEndpoint.IPv6Address) - i.e. that every endpoint is itself
+	// dual-stack - rather than accepting whatever mix of single- and
+	// dual-stack endpoints the caller happened to pass.
+	RequireDualStack bool
+}
+
+// AddEndpointsToNSWithOptions adds all unique `endpoints` to the network
+// namespace matching `id`. On failure does not roll back any previously
+// successfully added endpoints.
 //
 // If no network namespace matches `id` returns `ErrNetNSNotFound`.
-func (uvm *UtilityVM) AddEndpointsToNS(ctx context.Context, id string, endpoints []*hns.HNSEndpoint) error {
+//
+// If opts.RequireDualStack is set and any endpoint is missing its IPv4 or
+// IPv6 address, this returns a descriptive error naming the endpoint and the
+// missing family without adding anything. Otherwise, endpoints are added in
+// `endpoints` order except that any endpoint with only an IPv6 address (no
+// IPv4) is moved after every endpoint that has one, since some HNS versions
+// require the IPv4 side of a dual-stack pod's networking to be wired up
+// before the IPv6 side.
+func (uvm *UtilityVM) AddEndpointsToNSWithOptions(ctx context.Context, id string, endpoints []*hns.HNSEndpoint, opts AddEndpointsToNSOptions) error {
+	if opts.RequireDualStack {
+		if err := validateDualStackEndpoints(endpoints); err != nil {
+			return err
+		}
+	}
+	endpoints = orderIPv4BeforeIPv6(endpoints)
+
 	uvm.m.Lock()
 	defer uvm.m.Unlock()
 
@@ -128,6 +365,39 @@ func (uvm *UtilityVM) AddEndpointsToNS(ctx context.Context, id string, endpoints
 	return nil
 }
 
+// validateDualStackEndpoints returns a descriptive error naming the first
+// endpoint, and the family it's missing, that doesn't carry both an IPv4
+// address (HNSEndpoint.IPAddress) and an IPv6 address (HNSEndpoint.IPv6Address).
+// Returns nil if every endpoint is dual-stack.
+func validateDualStackEndpoints(endpoints []*hns.HNSEndpoint) error {
+	for _, endpoint := range endpoints {
+		if endpoint.IPAddress == nil {
+			return fmt.Errorf("endpoint '%s' is missing an IPv4 address: dual-stack requires every endpoint to have both an IPv4 and an IPv6 address", endpoint.Id)
+		}
+		if endpoint.IPv6Address == nil {
+			return fmt.Errorf("endpoint '%s' is missing an IPv6 address: dual-stack requires every endpoint to have both an IPv4 and an IPv6 address", endpoint.Id)
+		}
+	}
+	return nil
+}
+
+// orderIPv4BeforeIPv6 returns a copy of `endpoints`, stably reordered so
+// every endpoint with an IPv4 address (HNSEndpoint.IPAddress) sorts before
+// every IPv6-only endpoint (nil IPAddress, non-nil IPv6Address). Endpoints
+// that are dual-stack (both set) count as IPv4 for ordering purposes, since
+// they already satisfy "IPv4 added before IPv6" by having both wired up in
+// the same add.
+func orderIPv4BeforeIPv6(endpoints []*hns.HNSEndpoint) []*hns.HNSEndpoint {
+	ordered := make([]*hns.HNSEndpoint, len(endpoints))
+	copy(ordered, endpoints)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		iIPv6Only := ordered[i].IPAddress == nil && ordered[i].IPv6Address != nil
+		jIPv6Only := ordered[j].IPAddress == nil && ordered[j].IPv6Address != nil
+		return !iIPv6Only && jIPv6Only
+	})
+	return ordered
+}
+
 // RemoveNetNS removes the namespace from the uvm and all remaining endpoints in
 // the namespace.
 //
@@ -180,17 +450,268 @@ func (uvm *UtilityVM) RemoveEndpointsFromNS(ctx context.Context, id string, endp
 		return ErrNetNSNotFound
 	}
 
+	var notFound []string
 	for _, endpoint := range endpoints {
-		if ninfo, ok := ns.nics[endpoint.Id]; ok && ninfo != nil {
+		ninfo, ok := ns.nics[endpoint.Id]
+		if !ok || ninfo == nil {
+			notFound = append(notFound, endpoint.Id)
+			continue
+		}
+		if err := uvm.removeNIC(ctx, ninfo.ID, ninfo.Endpoint); err != nil {
+			return err
+		}
+		delete(ns.nics, endpoint.Id)
+	}
+	if len(notFound) > 0 {
+		return fmt.Errorf("endpoint(s) %s not attached to network namespace '%s'", strings.Join(notFound, ", "), id)
+	}
+	return nil
+}
+
+// NICSnapshot records enough about a NIC that was hot-removed by
+// RemoveAllNICs to hot-add an equivalent one back later, e.g. after
+// SaveAsTemplate saves a UVM that HCS requires to have no NICs attached.
+type NICSnapshot struct {
+	ID          guid.GUID
+	NamespaceID string
+	EndpointID  string
+}
+
+// RemoveAllNICs detaches every hot-added NIC across every network namespace
+// on the UVM, leaving the namespaces themselves (and their endpoint
+// bookkeeping) in place, and returns a snapshot of what it removed so a
+// caller can reattach equivalent NICs afterwards. It stops and returns an
+// error, along with whatever it already removed, on the first failure.
+func (uvm *UtilityVM) RemoveAllNICs(ctx context.Context) ([]NICSnapshot, error) {
+	uvm.m.Lock()
+	defer uvm.m.Unlock()
+
+	var removed []NICSnapshot
+	for nsID, ns := range uvm.namespaces {
+		for epID, ninfo := range ns.nics {
+			if ninfo == nil {
+				continue
+			}
 			if err := uvm.removeNIC(ctx, ninfo.ID, ninfo.Endpoint); err != nil {
-				return err
+				return removed, fmt.Errorf("failed to remove nic for endpoint '%s' in namespace '%s': %w", epID, nsID, err)
 			}
-			delete(ns.nics, endpoint.Id)
+			removed = append(removed, NICSnapshot{ID: ninfo.ID, NamespaceID: nsID, EndpointID: epID})
+			delete(ns.nics, epID)
 		}
 	}
+	return removed, nil
+}
+
+// ReattachNICs re-hot-adds every NIC recorded in `snapshots`, e.g. to undo
+// RemoveAllNICs after a failed SaveAsTemplate rather than resuming the uvm
+// with no network connectivity. It looks up each endpoint's current state
+// from HNS by ID rather than reusing whatever *hns.HNSEndpoint the uvm last
+// saw, since a NICSnapshot only records IDs, not full endpoint state. It
+// stops and returns an error on the first failure, having already
+// reattached whatever NICs came before it in `snapshots` - the caller
+// decides what to do with a partially-reattached uvm from there (see
+// DiscardTemplate).
+func (uvm *UtilityVM) ReattachNICs(ctx context.Context, snapshots []NICSnapshot) error {
+	uvm.m.Lock()
+	defer uvm.m.Unlock()
+
+	for _, snap := range snapshots {
+		ns, ok := uvm.namespaces[snap.NamespaceID]
+		if !ok {
+			return fmt.Errorf("failed to reattach nic for endpoint '%s': network namespace '%s' no longer exists", snap.EndpointID, snap.NamespaceID)
+		}
+		endpoint, err := hns.GetHNSEndpointByID(snap.EndpointID)
+		if err != nil {
+			return fmt.Errorf("failed to reattach nic for endpoint '%s': %w", snap.EndpointID, err)
+		}
+		if err := uvm.addNIC(ctx, snap.ID, endpoint); err != nil {
+			return fmt.Errorf("failed to reattach nic for endpoint '%s': %w", snap.EndpointID, err)
+		}
+		ns.nics[snap.EndpointID] = &nicInfo{ID: snap.ID, Endpoint: endpoint}
+	}
 	return nil
 }
 
+// NamespaceDrift describes a mismatch ReattachNetworkNamespace found between
+// the endpoints HNS reports for a namespace and the ones the UVM was
+// tracking for it, e.g. because the two fell out of sync across a shim
+// restart.
+type NamespaceDrift struct {
+	// MissingInUVM lists endpoint IDs HNS reports for the namespace that the
+	// UVM has no record of having hot-added.
+	MissingInUVM []string
+	// MissingInHNS lists endpoint IDs the UVM was tracking for the namespace
+	// that HNS no longer reports.
+	MissingInHNS []string
+}
+
+// HasDrift reports whether either side found an endpoint the other didn't.
+func (d NamespaceDrift) HasDrift() bool {
+	return len(d.MissingInUVM) > 0 || len(d.MissingInHNS) > 0
+}
+
+// ReattachNetworkNamespace re-associates the UVM with network namespace `id`
+// that it (or a prior instance of this shim) already hot-added, without
+// hot-adding it fresh the way AddNetNS/AddEndpointsToNS do - this is the
+// recovery path for after a shim restart, where the namespace and its
+// endpoints are still attached in the guest but the shim's own bookkeeping
+// of them was lost along with its process.
+//
+// It queries HNS for the namespace's current endpoints and reconciles the
+// UVM's tracked state to match, reporting any drift between the two: an
+// endpoint HNS has that the UVM didn't know about is recorded going forward
+// without being hot-added again, since it's already present in the guest;
+// an endpoint the UVM was tracking that HNS no longer has for the namespace
+// is dropped from the UVM's tracking. Either kind of drift usually means
+// something changed out from under the shim while it was down, so callers
+// should treat a non-empty NamespaceDrift as worth logging even though this
+// function itself doesn't fail because of it.
+//
+// The returned NetworkEndpoints reflects the reconciled, HNS-authoritative
+// state and can be tracked as a resource the same way createNetworkNamespace
+// does for a freshly created namespace.
+func (uvm *UtilityVM) ReattachNetworkNamespace(ctx context.Context, id string) (*NetworkEndpoints, NamespaceDrift, error) {
+	hnsEndpointIDs, err := hns.GetNamespaceEndpoints(id)
+	if err != nil {
+		return nil, NamespaceDrift{}, fmt.Errorf("failed to query endpoints for network namespace '%s': %w", id, err)
+	}
+	return uvm.reattachNetworkNamespace(id, hnsEndpointIDs)
+}
+
+// reattachNetworkNamespace is ReattachNetworkNamespace's reconciliation
+// logic, taking the namespace's current endpoint IDs as already queried from
+// HNS so it can be tested without a real HNS namespace to query.
+func (uvm *UtilityVM) reattachNetworkNamespace(id string, hnsEndpointIDs []string) (*NetworkEndpoints, NamespaceDrift, error) {
+	hnsSet := make(map[string]bool, len(hnsEndpointIDs))
+	for _, epID := range hnsEndpointIDs {
+		hnsSet[epID] = true
+	}
+
+	uvm.m.Lock()
+	defer uvm.m.Unlock()
+
+	ns, tracked := uvm.namespaces[id]
+	trackedSet := make(map[string]bool)
+	if tracked {
+		for epID, ninfo := range ns.nics {
+			if ninfo != nil {
+				trackedSet[epID] = true
+			}
+		}
+	}
+
+	var drift NamespaceDrift
+	for epID := range hnsSet {
+		if !trackedSet[epID] {
+			drift.MissingInUVM = append(drift.MissingInUVM, epID)
+		}
+	}
+	for epID := range trackedSet {
+		if !hnsSet[epID] {
+			drift.MissingInHNS = append(drift.MissingInHNS, epID)
+		}
+	}
+	sort.Strings(drift.MissingInUVM)
+	sort.Strings(drift.MissingInHNS)
+
+	if !tracked {
+		ns = &namespaceInfo{nics: make(map[string]*nicInfo)}
+		if uvm.namespaces == nil {
+			uvm.namespaces = make(map[string]*namespaceInfo)
+		}
+		uvm.namespaces[id] = ns
+	}
+	for _, epID := range drift.MissingInUVM {
+		ns.nics[epID] = &nicInfo{Endpoint: &hns.HNSEndpoint{Id: epID}}
+	}
+	for _, epID := range drift.MissingInHNS {
+		delete(ns.nics, epID)
+	}
+
+	return &NetworkEndpoints{EndpointIDs: hnsEndpointIDs, Namespace: id}, drift, nil
+}
+
+// CloneNamespaceMismatch describes a way a clone UVM's network namespace
+// bookkeeping can drift from what cloning guarantees - see
+// CLONING_DEFAULT_NETWORK_NAMESPACE_ID's doc comment on clones keeping the
+// template's NSID inside the guest while HNS holds the real one. Unlike
+// NamespaceDrift (which compares tracked vs. HNS-reported endpoint sets for
+// a namespace both sides already agree is the same one), this catches the
+// mapping between the two NSIDs itself having rotted.
+type CloneNamespaceMismatch struct {
+	// WantInUVMNSID is the in-UVM NSID NetNSIDInsideUVM computes for the
+	// real namespace ID passed to ReconcileCloneNamespace.
+	WantInUVMNSID string
+	// GotInUVMNSID is the in-UVM NSID the UVM is actually tracking. Equal to
+	// WantInUVMNSID when the UVM tracks it; otherwise one of the other
+	// namespace IDs the UVM tracks (which one is not defined if it tracks
+	// several), or empty if it tracks none.
+	GotInUVMNSID string
+	// MisboundEndpoints lists the IDs of endpoints HNS reports for the
+	// real namespace whose own HNSEndpoint.Namespace.ID disagrees with it
+	// - i.e. HNS itself thinks the endpoint belongs to some other
+	// namespace than the one it was just reported under.
+	MisboundEndpoints []string
+}
+
+// HasMismatch reports whether m found any discrepancy.
+func (m CloneNamespaceMismatch) HasMismatch() bool {
+	return m.WantInUVMNSID != m.GotInUVMNSID || len(m.MisboundEndpoints) > 0
+}
+
+// ReconcileCloneNamespace checks a clone UVM's network namespace bookkeeping
+// for `realNSID` against HNS, reporting (but not fixing) the ways cloning
+// specifically can drift after a restart: the in-UVM NSID the UVM is
+// tracking for `realNSID` no longer matches what NetNSIDInsideUVM would
+// compute for `mode`, or an endpoint HNS reports for `realNSID` is bound, per
+// HNS's own records, to some other namespace. This is meant to run during
+// recovery to flag a clone as corrupted; a caller that gets back a
+// CloneNamespaceMismatch with HasMismatch() true should not attempt to keep
+// using the clone rather than try to repair it here.
+func (uvm *UtilityVM) ReconcileCloneNamespace(ctx context.Context, realNSID string, mode CloneNamespaceIDMode) (CloneNamespaceMismatch, error) {
+	hnsEndpointIDs, err := hns.GetNamespaceEndpoints(realNSID)
+	if err != nil {
+		return CloneNamespaceMismatch{}, fmt.Errorf("failed to query endpoints for network namespace '%s': %w", realNSID, err)
+	}
+	hnsEndpoints := make([]*hns.HNSEndpoint, 0, len(hnsEndpointIDs))
+	for _, epID := range hnsEndpointIDs {
+		endpoint, err := hns.GetHNSEndpointByID(epID)
+		if err != nil {
+			return CloneNamespaceMismatch{}, fmt.Errorf("failed to query endpoint '%s': %w", epID, err)
+		}
+		hnsEndpoints = append(hnsEndpoints, endpoint)
+	}
+	return uvm.reconcileCloneNamespace(realNSID, mode, hnsEndpoints)
+}
+
+// reconcileCloneNamespace is ReconcileCloneNamespace's comparison logic,
+// taking the namespace's endpoints as already queried from HNS so it can be
+// tested without a real HNS namespace to query.
+func (uvm *UtilityVM) reconcileCloneNamespace(realNSID string, mode CloneNamespaceIDMode, hnsEndpoints []*hns.HNSEndpoint) (CloneNamespaceMismatch, error) {
+	wantInUVMNSID, err := uvm.NetNSIDInsideUVM(realNSID, mode)
+	if err != nil {
+		return CloneNamespaceMismatch{}, fmt.Errorf("failed to compute expected in-uvm namespace id for '%s': %w", realNSID, err)
+	}
+
+	mismatch := CloneNamespaceMismatch{WantInUVMNSID: wantInUVMNSID, GotInUVMNSID: wantInUVMNSID}
+	if !uvm.HasNetNS(wantInUVMNSID) {
+		mismatch.GotInUVMNSID = ""
+		for _, id := range uvm.NetNSIDs() {
+			mismatch.GotInUVMNSID = id
+			break
+		}
+	}
+
+	for _, endpoint := range hnsEndpoints {
+		if endpoint.Namespace == nil || endpoint.Namespace.ID != realNSID {
+			mismatch.MisboundEndpoints = append(mismatch.MisboundEndpoints, endpoint.Id)
+		}
+	}
+	sort.Strings(mismatch.MisboundEndpoints)
+
+	return mismatch, nil
+}
+
 // IsNetworkNamespaceSupported returns bool value specifying if network namespace is supported inside the guest
 func (uvm *UtilityVM) isNetworkNamespaceSupported() bool {
 	return uvm.guestCaps.NamespaceAddRequestSupported
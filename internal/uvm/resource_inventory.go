@@ -0,0 +1,81 @@
+package uvm
+
+// ResourceInventory is a read-only snapshot of the shares and mounts
+// attached to a UtilityVM, for troubleshooting tools that want to see what a
+// live UVM has attached without going through the clone/template machinery.
+type ResourceInventory struct {
+	VSMBShares   []VSMBShareInfo
+	SCSIMounts   []SCSIMountInfo
+	VPMemDevices []VPMemDeviceInfo
+	VPCIDevices  []VPCIDeviceInfo
+}
+
+// VSMBShareInfo summarizes a VSMBShare attached to a UVM.
+type VSMBShareInfo struct {
+	HostPath  string
+	GuestPath string
+	ReadOnly  bool
+}
+
+// SCSIMountInfo summarizes a SCSIMount attached to a UVM.
+type SCSIMountInfo struct {
+	HostPath   string
+	UVMPath    string
+	Controller int
+	LUN        int32
+	IsLayer    bool
+}
+
+// VPMemDeviceInfo summarizes a VPMem device attached to a UVM.
+type VPMemDeviceInfo struct {
+	HostPath string
+	UVMPath  string
+}
+
+// VPCIDeviceInfo summarizes a VPCI device assigned to a UVM.
+type VPCIDeviceInfo struct {
+	DeviceInstanceID string
+}
+
+// ResourceInventory returns a structured summary of every share, mount and
+// device currently attached to vm, exported by identifier and path rather
+// than the live objects themselves so a caller can log or serialize it
+// without holding a reference into vm's internal state. It only reads vm's
+// bookkeeping, so it's safe to call on a live, running UVM without pausing
+// it.
+func (vm *UtilityVM) ResourceInventory() *ResourceInventory {
+	vm.m.Lock()
+	defer vm.m.Unlock()
+
+	inv := &ResourceInventory{}
+	for _, share := range vm.vsmbDirShares {
+		inv.VSMBShares = append(inv.VSMBShares, VSMBShareInfo{HostPath: share.HostPath, GuestPath: share.guestPath, ReadOnly: share.readOnly})
+	}
+	for _, share := range vm.vsmbFileShares {
+		inv.VSMBShares = append(inv.VSMBShares, VSMBShareInfo{HostPath: share.HostPath, GuestPath: share.guestPath, ReadOnly: share.readOnly})
+	}
+	for _, controller := range vm.scsiLocations {
+		for _, mount := range controller {
+			if mount != nil {
+				inv.SCSIMounts = append(inv.SCSIMounts, SCSIMountInfo{
+					HostPath:   mount.HostPath,
+					UVMPath:    mount.UVMPath,
+					Controller: mount.Controller,
+					LUN:        mount.LUN,
+					IsLayer:    mount.isLayer,
+				})
+			}
+		}
+	}
+	for _, dev := range vm.vpmemDevices {
+		if dev != nil {
+			inv.VPMemDevices = append(inv.VPMemDevices, VPMemDeviceInfo{HostPath: dev.hostPath, UVMPath: dev.uvmPath})
+		}
+	}
+	for _, dev := range vm.vpciDevices {
+		if dev != nil {
+			inv.VPCIDevices = append(inv.VPCIDevices, VPCIDeviceInfo{DeviceInstanceID: dev.deviceInstanceID})
+		}
+	}
+	return inv
+}
@@ -0,0 +1,36 @@
+package uvm
+
+import "testing"
+
+func TestResourceInventory(t *testing.T) {
+	vm := &UtilityVM{
+		vsmbDirShares: map[string]*VSMBShare{
+			`C:\dir\1`: {HostPath: `C:\dir\1`, guestPath: `C:\guest\1`, readOnly: true},
+		},
+		vsmbFileShares: map[string]*VSMBShare{
+			`C:\file\1`: {HostPath: `C:\file\1`, guestPath: `C:\guest\2`},
+		},
+		vpmemDevices: [MaxVPMEMCount]*vpmemInfo{
+			0: {hostPath: `C:\vpmem\1`, uvmPath: `/vpmem/1`},
+		},
+		vpciDevices: map[string]*VPCIDevice{
+			"vpci-1": {deviceInstanceID: "vpci-1"},
+		},
+	}
+	vm.scsiLocations[0][0] = &SCSIMount{HostPath: `C:\scsi\1`, UVMPath: `/scsi/1`, Controller: 0, LUN: 0, isLayer: true}
+
+	inv := vm.ResourceInventory()
+
+	if len(inv.VSMBShares) != 2 {
+		t.Fatalf("got %d vsmb shares, want 2", len(inv.VSMBShares))
+	}
+	if len(inv.SCSIMounts) != 1 || inv.SCSIMounts[0].HostPath != `C:\scsi\1` || !inv.SCSIMounts[0].IsLayer {
+		t.Fatalf("got %+v, want one scsi mount matching the layer added above", inv.SCSIMounts)
+	}
+	if len(inv.VPMemDevices) != 1 || inv.VPMemDevices[0].HostPath != `C:\vpmem\1` {
+		t.Fatalf("got %+v, want one vpmem device matching the one added above", inv.VPMemDevices)
+	}
+	if len(inv.VPCIDevices) != 1 || inv.VPCIDevices[0].DeviceInstanceID != "vpci-1" {
+		t.Fatalf("got %+v, want one vpci device matching the one added above", inv.VPCIDevices)
+	}
+}
@@ -45,7 +45,8 @@ type gcsLogEntry struct {
 }
 
 // FUTURE-jstarks: Change the GCS log format to include type information
-//                 (e.g. by using a different encoding such as protobuf).
+//
+//	(e.g. by using a different encoding such as protobuf).
 func (e *gcsLogEntry) UnmarshalJSON(b []byte) error {
 	// Default the log level to info.
 	e.Level = logrus.InfoLevel
@@ -118,6 +119,47 @@ func parseLogrus(vmid string) func(r io.Reader) {
 	}
 }
 
+// connectExternalGCS runs the GCS protocol over `conn` and wires the result
+// into uvm.gc/guestCaps/protocol, the same way Start does for a UVM's own
+// listener. It's factored out so ConnectExternalGCS can drive the identical
+// setup for a connection an orchestrator already holds - e.g. one accepted
+// against a freshly reattached clone UVM's forked bridge state.
+func (uvm *UtilityVM) connectExternalGCS(ctx context.Context, conn net.Conn) error {
+	gcc := &gcs.GuestConnectionConfig{
+		Conn:     conn,
+		Log:      log.G(ctx).WithField(logfields.UVMID, uvm.id),
+		IoListen: gcs.HvsockIoListen(uvm.runtimeID),
+	}
+	gc, err := gcc.Connect(ctx)
+	if err != nil {
+		return err
+	}
+	uvm.gc = gc
+	uvm.guestCaps = *uvm.gc.Capabilities()
+	uvm.protocol = uvm.gc.Protocol()
+
+	// initial setup required for external GCS connection
+	if err := uvm.configureHvSocketForGCS(ctx); err != nil {
+		return fmt.Errorf("failed to do initial GCS setup: %s", err)
+	}
+	return nil
+}
+
+// ConnectExternalGCS runs the GCS protocol over `conn`, an already-accepted
+// connection to the guest, and wires the result up as vm's GCS connection -
+// the same connection CloneContainer requires to be non-nil. It exists so an
+// orchestrator that constructs a clone UVM and reattaches its GCS bridge
+// itself, without going through Start's own listener/accept, has a supported
+// way to give the resulting *UtilityVM back to CloneContainer instead of
+// hitting ErrNoGCSConnection.
+//
+// It's the caller's responsibility to have already forked `conn`'s peer from
+// the template's bridge state; ConnectExternalGCS just runs the handshake
+// and does not itself do anything clone-specific.
+func (vm *UtilityVM) ConnectExternalGCS(ctx context.Context, conn net.Conn) error {
+	return vm.connectExternalGCS(ctx, conn)
+}
+
 // When using an external GCS connection it is necessary to send a ModifySettings request
 // for HvSockt so that the GCS can setup some registry keys that are required for running
 // containers inside the UVM. In non external GCS connection scenarios this is done by the
@@ -227,23 +269,9 @@ func (uvm *UtilityVM) Start(ctx context.Context) (err error) {
 		if err != nil {
 			return fmt.Errorf("failed to connect to GCS: %s", err)
 		}
-		// Start the GCS protocol.
-		gcc := &gcs.GuestConnectionConfig{
-			Conn:     conn,
-			Log:      log.G(ctx).WithField(logfields.UVMID, uvm.id),
-			IoListen: gcs.HvsockIoListen(uvm.runtimeID),
-		}
-		uvm.gc, err = gcc.Connect(ctx)
-		if err != nil {
+		if err := uvm.connectExternalGCS(ctx, conn); err != nil {
 			return err
 		}
-		uvm.guestCaps = *uvm.gc.Capabilities()
-		uvm.protocol = uvm.gc.Protocol()
-
-		// initial setup required for external GCS connection
-		if err = uvm.configureHvSocketForGCS(ctx); err != nil {
-			return fmt.Errorf("failed to do initial GCS setup: %s", err)
-		}
 	} else {
 		// Cache the guest connection properties.
 		properties, err := uvm.hcsSystem.Properties(ctx, schema1.PropertyTypeGuestConnection)
@@ -0,0 +1,91 @@
+package uvm
+
+import (
+	"context"
+	"sync"
+
+	"github.com/Microsoft/hcsshim/internal/clone"
+)
+
+// templateConfigCacheEnabled gates FetchDecodedTemplateConfig's in-process
+// cache of decoded UVMTemplateConfigs, keyed by template ID. It exists so a
+// caller pre-warming many clones from the same template doesn't pay
+// DecodeTemplateConfig's gob decode cost on every fetch. Disable it with
+// SetTemplateConfigCacheEnabled if that cost is preferable to holding
+// decoded configs in memory.
+var templateConfigCacheEnabled = true
+
+// templateConfigCacheMu guards templateConfigCache.
+var templateConfigCacheMu sync.Mutex
+
+// templateConfigCache holds the most recently decoded UVMTemplateConfig for
+// each template ID FetchDecodedTemplateConfig has been asked for. Every
+// entry is invalidated the moment anything in this package changes what's
+// persisted under that ID; see invalidateTemplateConfigCache.
+var templateConfigCache = make(map[string]*UVMTemplateConfig)
+
+// SetTemplateConfigCacheEnabled toggles FetchDecodedTemplateConfig's cache
+// and returns the previous value. Disabling it also drops every entry
+// currently cached, so a later re-enable starts empty rather than serving
+// whatever was cached before the disable.
+func SetTemplateConfigCacheEnabled(enabled bool) (old bool) {
+	old = templateConfigCacheEnabled
+	templateConfigCacheEnabled = enabled
+	if !enabled {
+		templateConfigCacheMu.Lock()
+		templateConfigCache = make(map[string]*UVMTemplateConfig)
+		templateConfigCacheMu.Unlock()
+	}
+	return old
+}
+
+// FetchDecodedTemplateConfig is clone.FetchTemplateConfig plus
+// DecodeTemplateConfig, with an optional in-process cache of the decoded
+// result keyed by templateID (see SetTemplateConfigCacheEnabled). Every
+// return, cached or not, is a fresh DeepCopy: the cache never hands out the
+// pointer it stores, so a caller that mutates its result can't corrupt what
+// a later caller reads back out of the cache.
+//
+// The cache is invalidated for templateID by SaveAsTemplate,
+// ReconstructTemplateConfig, and DiscardTemplate - the only paths in this
+// package that change what's persisted under a template ID - so a cached
+// decode never outlives whatever wrote or removed the data it came from.
+func FetchDecodedTemplateConfig(ctx context.Context, templateID string) (*UVMTemplateConfig, error) {
+	if templateConfigCacheEnabled {
+		templateConfigCacheMu.Lock()
+		cached, ok := templateConfigCache[templateID]
+		templateConfigCacheMu.Unlock()
+		if ok {
+			return cached.DeepCopy()
+		}
+	}
+
+	data, err := clone.FetchTemplateConfig(ctx, templateID)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := DecodeTemplateConfig(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if templateConfigCacheEnabled {
+		toCache, err := cfg.DeepCopy()
+		if err != nil {
+			return nil, err
+		}
+		templateConfigCacheMu.Lock()
+		templateConfigCache[templateID] = toCache
+		templateConfigCacheMu.Unlock()
+	}
+	return cfg, nil
+}
+
+// invalidateTemplateConfigCache drops templateID's cached decode, if any, so
+// the next FetchDecodedTemplateConfig call re-fetches and re-decodes instead
+// of returning stale data.
+func invalidateTemplateConfigCache(templateID string) {
+	templateConfigCacheMu.Lock()
+	delete(templateConfigCache, templateID)
+	templateConfigCacheMu.Unlock()
+}
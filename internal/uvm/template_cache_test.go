@@ -0,0 +1,127 @@
+package uvm
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Microsoft/hcsshim/internal/clone"
+)
+
+// TestFetchDecodedTemplateConfig_PopulatesAndServesCacheForVPMemResource
+// guards against the cache path's DeepCopy calls failing for a decoded LCOW
+// template - see synth-517, where an unwrapped *vpmemInfo (no exported
+// fields) made every gob round-trip of a VPMem-backed config fail, breaking
+// both populating and serving a cache hit here.
+func TestFetchDecodedTemplateConfig_PopulatesAndServesCacheForVPMemResource(t *testing.T) {
+	old := clone.SetTemplateStore(clone.NewInMemoryTemplateStore())
+	defer clone.SetTemplateStore(old)
+	oldEnabled := SetTemplateConfigCacheEnabled(true)
+	defer SetTemplateConfigCacheEnabled(oldEnabled)
+
+	id := "template-cache-vpmem"
+	cfg := &UVMTemplateConfig{
+		UVMID:     id,
+		Resources: []Cloneable{&vpmemTemplate{HostPath: `C:\vpmem\1`}},
+	}
+	data, err := EncodeTemplateConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := clone.SaveTemplateConfig(context.Background(), id, data); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := FetchDecodedTemplateConfig(context.Background(), id)
+	if err != nil {
+		t.Fatalf("failed to populate the cache for a VPMem-backed config: %v", err)
+	}
+	if got := first.Resources[0].(*vpmemTemplate).HostPath; got != `C:\vpmem\1` {
+		t.Fatalf("got HostPath %q, want %q", got, `C:\vpmem\1`)
+	}
+
+	second, err := FetchDecodedTemplateConfig(context.Background(), id)
+	if err != nil {
+		t.Fatalf("failed to serve a cache hit for a VPMem-backed config: %v", err)
+	}
+	if got := second.Resources[0].(*vpmemTemplate).HostPath; got != `C:\vpmem\1` {
+		t.Fatalf("got HostPath %q, want %q", got, `C:\vpmem\1`)
+	}
+}
+
+func TestFetchDecodedTemplateConfig_MutationsDontLeakBetweenFetches(t *testing.T) {
+	old := clone.SetTemplateStore(clone.NewInMemoryTemplateStore())
+	defer clone.SetTemplateStore(old)
+	oldEnabled := SetTemplateConfigCacheEnabled(true)
+	defer SetTemplateConfigCacheEnabled(oldEnabled)
+
+	id := "template-cache-mutate"
+	cfg := &UVMTemplateConfig{
+		UVMID:     id,
+		Resources: []Cloneable{&vsmbShareTemplate{HostPath: `C:\vsmb\1`}},
+	}
+	data, err := EncodeTemplateConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := clone.SaveTemplateConfig(context.Background(), id, data); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := FetchDecodedTemplateConfig(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.Resources[0].(*vsmbShareTemplate).HostPath = `C:\vsmb\mutated`
+
+	second, err := FetchDecodedTemplateConfig(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := second.Resources[0].(*vsmbShareTemplate).HostPath; got != `C:\vsmb\1` {
+		t.Fatalf("mutating one fetch's result leaked into another: got HostPath %q, want %q", got, `C:\vsmb\1`)
+	}
+}
+
+func TestFetchDecodedTemplateConfig_ReconstructInvalidatesCache(t *testing.T) {
+	old := clone.SetTemplateStore(clone.NewInMemoryTemplateStore())
+	defer clone.SetTemplateStore(old)
+	oldEnabled := SetTemplateConfigCacheEnabled(true)
+	defer SetTemplateConfigCacheEnabled(oldEnabled)
+
+	id := "template-cache-invalidate"
+	original := &UVMTemplateConfig{
+		UVMID:     id,
+		Resources: []Cloneable{&vsmbShareTemplate{HostPath: `C:\vsmb\original`}},
+	}
+	data, err := EncodeTemplateConfig(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := clone.SaveTemplateConfig(context.Background(), id, data); err != nil {
+		t.Fatal(err)
+	}
+
+	cached, err := FetchDecodedTemplateConfig(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cached.Equal(original) {
+		t.Fatalf("got %+v, want a fetch matching the saved config", cached)
+	}
+
+	// ReconstructTemplateConfig regenerates and re-saves under the same ID
+	// from vm's (empty) current resources, which must invalidate the cache
+	// entry populated by the fetch above.
+	vm := &UtilityVM{id: id}
+	if _, err := ReconstructTemplateConfig(context.Background(), vm, id, true); err != nil {
+		t.Fatal(err)
+	}
+
+	afterReconstruct, err := FetchDecodedTemplateConfig(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if afterReconstruct.Equal(original) {
+		t.Fatal("expected ReconstructTemplateConfig to invalidate the cached decode, got the stale one back")
+	}
+}
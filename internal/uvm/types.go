@@ -94,6 +94,40 @@ type UtilityVM struct {
 
 	namespaces map[string]*namespaceInfo
 
+	// isTemplate indicates that this UVM has been paused and saved as a
+	// template so that other UVMs can be cloned from it.
+	isTemplate bool
+	// isClone indicates that this UVM was created by cloning a template UVM.
+	isClone bool
+	// templateSourceID is the ID of the template this UVM was cloned from,
+	// set by MarkAsClone. Only meaningful when isClone is true.
+	templateSourceID string
+
+	// cloneReattachCallback, if set via SetCloneReattachCallback, is invoked
+	// by CloneContainer with the container ID and its result once the
+	// reattach completes.
+	cloneReattachCallback CloneReattachCallback
+
+	// layerFolders holds the host paths of the container image layers
+	// mounted into this UVM, recorded so GenerateTemplateConfig can capture
+	// them for clones to reconstitute.
+	layerFolders []string
+
+	// cimLayers holds the host paths of the CimFS-backed combined-layer CIMs
+	// mounted into this UVM, recorded so GenerateTemplateConfig can capture
+	// them for clones to reconstitute. Distinct from layerFolders: a
+	// CimFS-backed UVM doesn't populate layerFolders for these layers, since
+	// they're mounted as a single CIM rather than attached as individual VHD
+	// folders.
+	cimLayers []string
+
+	// ramScratchSizeInBytes holds the size of this UVM's RAM-backed scratch,
+	// if it was set up with one, recorded so GenerateTemplateConfig can
+	// capture it for clones to reconstitute. Zero means no RAM-backed
+	// scratch; a RAM-backed scratch isn't a SCSIMount, so nothing else on
+	// this struct already tracks it.
+	ramScratchSizeInBytes int64
+
 	outputListener       net.Listener
 	outputProcessingDone chan struct{}
 	outputHandler        OutputHandler